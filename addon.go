@@ -1,26 +1,159 @@
 package main
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
 	"github.com/jesperfj/byodemo/bucket"
 	"github.com/jesperfj/byodemo/database"
 	"github.com/jesperfj/byodemo/heroku"
 )
 
+const (
+	// Resources on the shared plan get a prefix in their team's shared bucket rather than a
+	// bucket of their own.
+	sharedPlan = "shared"
+)
+
+// Resources created before bucket names were recorded all use the default name.
+func resourceBucketName(providerId string, bucketName string) string {
+	if bucketName == "" {
+		return bucket.BucketName(providerId)
+	}
+	return bucketName
+}
+
+// Picks the linked account a new resource is provisioned with: the one named by --opt account=<alias>,
+// else the one whose alias matches the plan, else the team's default account.
+func selectAccount(ownerId string, plan string, options map[string]string) (database.Account, error) {
+	if alias, ok := options["account"]; ok {
+		account, found, err := db.FindAccountByAlias(ownerId, alias)
+		if err == nil && !found {
+			err = errors.New("The team has no linked AWS account named " + alias)
+		}
+		return account, err
+	}
+	account, found, err := db.FindAccountByAlias(ownerId, plan)
+	if err != nil || found {
+		return account, err
+	}
+	return db.FindDefaultAccount(ownerId)
+}
+
+// Creates the AWS side of a resource and records on it where the objects live. Depending on the
+// plan and options, that is a new bucket, a prefix in the team's shared bucket, or one of the
+// team's registered buckets adopted with --opt adopt=<bucket>.
+func provisionBucket(bc bucket.BucketController, resource *database.AddonResource, options map[string]string) (b bucket.Bucket, err error) {
+	name, adopt := options["adopt"]
+	if adopt && resource.Plan == sharedPlan {
+		return b, errors.New("Buckets can't be adopted on the " + sharedPlan + " plan")
+	}
+	if resource.Plan == sharedPlan {
+		return provisionPrefix(bc, resource)
+	}
+	if !adopt {
+		b, err = bc.CreateBucket(resource.ProviderId)
+		resource.BucketName = b.Name
+		return b, err
+	}
+	registered, found, err := db.FindRegisteredBucket(resource.OwnerId, name)
+	if err != nil {
+		return b, err
+	}
+	if !found {
+		return b, errors.New("Bucket " + name + " is not registered for adoption by the team")
+	}
+	if registered.AccountId != resource.AccountId {
+		return b, errors.New("Bucket " + name + " is registered in another of the team's AWS accounts. " +
+			"Choose it with --opt account=<alias>")
+	}
+	inUse, err := db.IsBucketInUse(name)
+	if err != nil {
+		return b, err
+	}
+	if inUse {
+		return b, errors.New("Bucket " + name + " is already in use by another add-on")
+	}
+	// Buckets registered before regions were checked may be somewhere the add-on can't manage.
+	if err := bc.VerifyBucketInAccount(name); err != nil {
+		return b, err
+	}
+	b, err = bc.CreateUser(resource.ProviderId, name)
+	resource.BucketName, resource.Adopted = name, true
+	return b, err
+}
+
+// Gives the resource the apps/<app id>/ prefix in the shared bucket of the resource's account,
+// creating the bucket for the account's first shared resource.
+func provisionPrefix(bc bucket.BucketController, resource *database.AddonResource) (b bucket.Bucket, err error) {
+	name, err := sharedBucket(bc, resource)
+	if err != nil {
+		return b, err
+	}
+	prefix := "apps/" + resource.AppId + "/"
+	inUse, err := db.IsPrefixInUse(name, prefix)
+	if err != nil {
+		return b, err
+	}
+	if inUse {
+		return b, errors.New("App " + resource.AppName + " already has an add-on on the " + sharedPlan + " plan")
+	}
+	b, err = bc.CreatePrefixUser(resource.ProviderId, name, prefix)
+	resource.BucketName, resource.BucketPrefix = name, prefix
+	return b, err
+}
+
+// The account's shared bucket, created if it has none. Resources provisioned at the same time, on
+// any dyno, may each create one; the shared_buckets key lets only one be saved and the others are
+// deleted again.
+func sharedBucket(bc bucket.BucketController, resource *database.AddonResource) (name string, err error) {
+	name, found, err := db.FindSharedBucket(resource.AccountId)
+	if err != nil || found {
+		return name, err
+	}
+	name = bucket.NewSharedBucketName()
+	if err := bc.CreateSharedBucket(name); err != nil {
+		return "", err
+	}
+	saveErr := db.SaveSharedBucket(resource.OwnerId, resource.AccountId, name)
+	if saveErr == nil {
+		return name, nil
+	}
+	// Either way the new bucket won't be used.
+	bc.DeleteSharedBucket(name)
+	existing, found, err := db.FindSharedBucket(resource.AccountId)
+	if err != nil || !found {
+		return "", saveErr
+	}
+	logger.Print("Account ", resource.AccountId, " got shared bucket ", existing, " concurrently, deleted ", name)
+	return existing, nil
+}
+
 func finishProvisioning(requestData *heroku.CreateAddonRequest, providerId string) {
-	c, err := heroku.NewClientFromCode(config.clientSecret, requestData.OAuthGrant.Code)
+	var ownerId string
+	var err error
+	defer func() { recordAudit(platformActor, ownerId, providerId, auditProvision, err) }()
+
+	c, err := herokuPlatform().ExchangeCode(config.clientSecret, requestData.OAuthGrant.Code)
 	if err != nil {
 		logger.Print(err)
 		return
 	}
-	ownerId, err := c.OwnerId(requestData.Uuid)
+	ownerId, err = c.OwnerId(requestData.Uuid)
 	if err != nil {
 		c.FailProvisioning(requestData.Uuid)
 		logger.Print("Couldn't find owner id for addon: ", requestData.Uuid, " :", err)
 		return
 	}
 
-	account, err := db.FindAccount(ownerId)
+	addonInfo, err := c.AddonInfo(requestData.Uuid)
+	if err != nil {
+		c.FailProvisioning(requestData.Uuid)
+		logger.Print("Couldn't find app for addon: ", requestData.Uuid, " :", err)
+		return
+	}
+
+	account, err := selectAccount(ownerId, requestData.Plan, requestData.Options)
 	if err != nil {
 		c.FailProvisioning(requestData.Uuid)
 		logger.Print("Couldn't provision addon: ", requestData.Uuid, " :", err)
@@ -31,15 +164,49 @@ func finishProvisioning(requestData *heroku.CreateAddonRequest, providerId strin
 	logger.Print("account aws id: ", account.AWSAccessKeyId)
 	logger.Print(requestData.Region)
 
+	resource := &database.AddonResource{
+		OwnerId:    ownerId,
+		ProviderId: providerId,
+		AddonId:    requestData.Uuid,
+		AppId:      addonInfo.App.Id,
+		AppName:    addonInfo.App.Name,
+		Plan:       requestData.Plan,
+		AccountId:  account.Id,
+	}
+
 	bc, _ := bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
-	bucket, err := bc.CreateBucket(providerId)
+	seed, err := findSeedSource(c, bc, resource, requestData.Options)
+	if err != nil {
+		c.FailProvisioning(requestData.Uuid)
+		logger.Print("Couldn't find objects to copy for addon ", requestData.Uuid, " :", err)
+		return
+	}
+
+	bucket, err := provisionBucket(bc, resource, requestData.Options)
 	if err != nil {
 		c.FailProvisioning(requestData.Uuid)
 		logger.Print("Couldn't create bucket for addon ", requestData.Uuid, " :", err)
 		return
 	}
+	resource.AWSAccessKeyId = bucket.AWSAccessKeyId
+	// From here on a failure leaves AWS resources behind unless they are removed again.
+	abandon := func() {
+		if !removeAWSResources(bc, resource) {
+			logger.Print("Couldn't remove AWS resources of failed addon ", requestData.Uuid, ". Check bucket ",
+				resource.BucketName, " and IAM user user-", providerId)
+		}
+		c.FailProvisioning(requestData.Uuid)
+	}
+
+	if seed != nil {
+		if err = seedBucket(bc, seed, resource); err != nil {
+			abandon()
+			logger.Print("Couldn't copy objects for addon ", requestData.Uuid, " :", err)
+			return
+		}
+	}
 
-	c.SetAddonConfig(requestData.Uuid, heroku.AddonConfig{
+	addonConfig := heroku.AddonConfig{
 		Config: []heroku.ConfigVar{
 			heroku.ConfigVar{
 				Name:  "BUCKET_NAME",
@@ -54,77 +221,137 @@ func finishProvisioning(requestData *heroku.CreateAddonRequest, providerId strin
 				Value: bucket.AWSSecretAccessKey,
 			},
 		},
-	})
+	}
+	if resource.BucketPrefix != "" {
+		addonConfig.Config = append(addonConfig.Config, heroku.ConfigVar{
+			Name:  "BUCKET_PREFIX",
+			Value: resource.BucketPrefix,
+		})
+	}
+	if err = c.SetAddonConfig(requestData.Uuid, addonConfig); err != nil {
+		abandon()
+		logger.Print("Couldn't set config of addon ", requestData.Uuid, " :", err)
+		return
+	}
 
-	err = db.SaveAddonResource(&database.AddonResource{
-		OwnerId:        ownerId,
-		ProviderId:     providerId,
-		AddonId:        requestData.Uuid,
-		AWSAccessKeyId: bucket.AWSAccessKeyId,
-	})
+	err = db.SaveAddonResource(resource)
 	if err != nil {
-		c.FailProvisioning(requestData.Uuid)
+		abandon()
 		logger.Print("Couldn't provision addon: ", requestData.Uuid, " :", err)
 		return
 	}
+	// c may have refreshed its token while seeding. Keep the latest one for later calls.
+	saveAddonGrant(providerId, c.Authorization)
+	persistAddonGrant(providerId, c)
+	tagResourceBucket(bc, resource)
+	subscribeAppWebhook(c, resource)
 
-	c.CompleteProvisioning(requestData.Uuid)
+	if err = c.CompleteProvisioning(requestData.Uuid); err != nil {
+		abandon()
+		if err := db.SetDeleted(providerId); err != nil {
+			logger.Print("Couldn't mark failed addon ", requestData.Uuid, " deleted: ", err)
+		}
+		db.DeleteAddonGrant(providerId)
+		logger.Print("Couldn't complete provisioning of addon ", requestData.Uuid, " :", err)
+		return
+	}
 	logger.Print("Addon provisioning completed for ", requestData.Uuid)
 }
 
+// Removes what provisioning created in AWS for the resource. Adopted buckets belong to the team, so
+// only the access the add-on created goes. Shared buckets belong to all of the team's shared
+// resources, so only this one's prefix goes.
+func removeAWSResources(bc bucket.BucketController, resource *database.AddonResource) bool {
+	if resource.Adopted {
+		return bc.DeleteUser(resource.ProviderId, resource.AWSAccessKeyId)
+	}
+	if resource.BucketPrefix != "" {
+		deleted := bc.DeleteObjects(resource.BucketName, resource.BucketPrefix) == nil
+		return bc.DeleteUser(resource.ProviderId, resource.AWSAccessKeyId) && deleted
+	}
+	return bc.DeleteBucket(resource.ProviderId, resource.AWSAccessKeyId)
+}
+
 func deleteResource(resourceId string) {
 	account, addon, err := db.FindAccountForAddon(resourceId)
 	if err != nil {
 		logger.Print("Cannot complete resource deletion. Error finding account for resource ", resourceId, ": ", err)
+		recordAudit(platformActor, "", resourceId, auditDeprovision, err)
 		return
 	}
 	bc, err := bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
 	if err != nil {
 		logger.Print("Cannot complete resource deletion for ", resourceId, ". Error initializing bucket controller: ", err)
+		recordAudit(platformActor, addon.OwnerId, resourceId, auditDeprovision, err)
 		return
 	}
-	if bc.DeleteBucket(resourceId, addon.AWSAccessKeyId) {
+	if removeAWSResources(bc, &addon) {
 		logger.Print("Resources deletion complete for ", resourceId)
 		err = db.SetDeleted(resourceId)
 		if err != nil {
 			logger.Print("Resource deletion complete for ", resourceId, " but failed to update database: ", err)
+		} else if err := db.PurgeDetachedAccount(account.Id); err != nil {
+			logger.Print("Couldn't purge account ", account.Id, " after deleting ", resourceId, ": ", err)
+		}
+		// Nothing calls the Platform API for the resource any more.
+		if err := db.DeleteAddonGrant(resourceId); err != nil {
+			logger.Print("Couldn't delete OAuth grant of ", resourceId, ": ", err)
 		}
 	} else {
+		err = errors.New("AWS resources were not fully deleted")
 		logger.Print("Resource deletion incomplete for ", resourceId, ": ", err)
 	}
+	recordAudit(platformActor, addon.OwnerId, resourceId, auditDeprovision, err)
 }
 
 func setupAddonRoutes(router *gin.Engine) {
 
-	addon := router.Group("/addon", gin.BasicAuth(gin.Accounts{"byodemo": config.addonProviderToken}))
+	addon := router.Group(addonAPIPath, gin.BasicAuth(gin.Accounts{addonManifestId: config.addonProviderToken}))
 
-	addon.POST("/heroku/resources", func(c *gin.Context) {
+	addon.POST("", func(c *gin.Context) {
 		requestData := &heroku.CreateAddonRequest{}
 		c.Bind(requestData)
 		providerId := heroku.NewAddonId()
 		c.JSON(202, heroku.AsyncCreateAddonResponse{
 			Id: providerId,
 			Message: "Warning: This request will fail silently if AWS credentials have not been configured.\n" +
-				"Set up AWS credentials for your team at https://byodemo-addon.herokuapp.com",
+				"Set up AWS credentials for your team at " + config.addonURL,
 		})
 
 		go finishProvisioning(requestData, providerId)
 
 	})
 
-	addon.PUT("/heroku/resources/:id", func(c *gin.Context) {
+	addon.PUT("/:id", func(c *gin.Context) {
 		data := &heroku.AddonPlanChangeRequest{}
 		c.Bind(data)
+		_, resource, err := db.FindAccountForAddon(c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"message": "Add-on not found"})
+			return
+		}
+		// Moving objects between a dedicated bucket and a shared prefix is not supported.
+		if (resource.Plan == sharedPlan) != (data.Plan == sharedPlan) {
+			recordAudit(platformActor, resource.OwnerId, c.Param("id"), auditPlanChange,
+				errors.New("Can't change from plan "+resource.Plan+" to "+data.Plan))
+			c.JSON(422, gin.H{"message": "Can't change between the " + sharedPlan + " plan and plans with a dedicated bucket. " +
+				"Create a new add-on instead."})
+			return
+		}
+		err = db.SetPlan(c.Param("id"), data.Plan)
+		recordAudit(platformActor, resource.OwnerId, c.Param("id"), auditPlanChange, err)
+		if err != nil {
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		// The plan doesn't change the bucket or its credentials, so the config stays as it is.
 		c.JSON(200, heroku.AddonPlanChangeResponse{
-			Message: "success for " + c.Param("id"),
-			Config: map[string]string{
-				"URL":   "https://blah.blah.com",
-				"OTHER": "blah",
-			},
+			Message: "Changed to plan " + data.Plan,
+			Config:  map[string]string{},
 		})
 	})
 
-	addon.DELETE("/heroku/resources/:id", func(c *gin.Context) {
+	addon.DELETE("/:id", func(c *gin.Context) {
 		logger.Print("Deleting addon ", c.Param("id"))
 		err := db.MarkResourceForDeletion(c.Param("id"))
 		if err != nil {
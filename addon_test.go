@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+func TestPlanChange(t *testing.T) {
+	useMemoryStore(t)
+	previous := config.addonProviderToken
+	config.addonProviderToken = "provider-token"
+	defer func() { config.addonProviderToken = previous }()
+	router := gin.New()
+	setupAddonRoutes(router)
+	header := http.Header{"Content-Type": {"application/json"},
+		"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(addonManifestId+":provider-token"))}}
+
+	account := database.Account{OwnerId: "team", Alias: "prod", AWSAccessKeyId: "AKIA", AWSSecretAccessKey: "secret"}
+	if err := db.SaveAccount(&account); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []database.AddonResource{
+		{OwnerId: "team", ProviderId: "p1", AddonId: "a1", Plan: "test", BucketName: "b1", AccountId: account.Id},
+		{OwnerId: "team", ProviderId: "p2", AddonId: "a2", Plan: sharedPlan, BucketName: "shared", BucketPrefix: "apps/app/", AccountId: account.Id},
+	} {
+		if err := db.SaveAddonResource(&r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		providerId string
+		plan       string
+		status     int
+		savedPlan  string
+	}{
+		{"between dedicated plans", "p1", "prod", 200, "prod"},
+		{"to the shared plan", "p1", sharedPlan, 422, "prod"},
+		{"from the shared plan", "p2", "prod", 422, sharedPlan},
+		{"unknown add-on", "p3", "prod", 404, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, _ := json.Marshal(heroku.AddonPlanChangeRequest{Plan: test.plan})
+			w := serve(router, "PUT", addonAPIPath+"/"+test.providerId, body, header)
+			if w.Code != test.status {
+				t.Fatalf("Status is %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if test.status == 200 {
+				var res heroku.AddonPlanChangeResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Config) != 0 {
+					t.Errorf("Response is %s: %v", w.Body, err)
+				}
+			}
+			if _, resource, _ := db.FindAccountForAddon(test.providerId); resource.Plan != test.savedPlan {
+				t.Errorf("Plan is %q, want %q", resource.Plan, test.savedPlan)
+			}
+		})
+	}
+}
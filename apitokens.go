@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+)
+
+const (
+	// Makes tokens easy to recognize, e.g. by secret scanners.
+	apiTokenPrefix = "byo_"
+	// Last-used times are only written this often, not on every request.
+	apiTokenTouchInterval = time.Minute
+)
+
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validAPITokenScope(scope string) bool {
+	for _, s := range database.APITokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// byodemo api-tokens create <name> <scope>... prints a new token. byodemo api-tokens list shows
+// the tokens without their values. byodemo api-tokens revoke <name> deletes one.
+func runAPITokens(args []string) {
+	usage := "Usage: byodemo api-tokens create <name> <scope>... | list | revoke <name>\nScopes: " +
+		strings.Join(database.APITokenScopes, ", ")
+	if len(args) == 0 {
+		logger.Fatal(usage)
+	}
+	c := connectDatabase()
+	switch {
+	case args[0] == "create" && len(args) >= 3:
+		for _, scope := range args[2:] {
+			if !validAPITokenScope(scope) {
+				logger.Fatal("Unknown scope ", scope, ". Scopes: ", strings.Join(database.APITokenScopes, ", "))
+			}
+		}
+		token, err := newAPIToken()
+		if err != nil {
+			logger.Fatal("Error generating token: ", err)
+		}
+		if err := c.SaveAPIToken(&database.APIToken{Name: args[1], TokenHash: hashAPIToken(token), Scopes: args[2:]}); err != nil {
+			logger.Fatal("Error saving token: ", err)
+		}
+		logger.Print("Created API token ", args[1], ". It can't be shown again:")
+		fmt.Println(token)
+	case args[0] == "list" && len(args) == 1:
+		tokens, err := c.FindAPITokens()
+		if err != nil {
+			logger.Fatal("Error finding tokens: ", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSCOPES\tCREATED\tLAST USED")
+		for _, t := range tokens {
+			lastUsed := "never"
+			if !t.LastUsedAt.IsZero() {
+				lastUsed = t.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Name, strings.Join(t.Scopes, " "), t.CreatedAt.Format(time.RFC3339), lastUsed)
+		}
+		w.Flush()
+	case args[0] == "revoke" && len(args) == 2:
+		found, err := c.DeleteAPIToken(args[1])
+		if err != nil {
+			logger.Fatal("Error revoking token: ", err)
+		}
+		if !found {
+			logger.Fatal("No API token named ", args[1])
+		}
+		logger.Print("Revoked API token ", args[1])
+	default:
+		logger.Fatal(usage)
+	}
+}
+
+// Lets requests with a bearer token that has scope through, and logs every request with the
+// token's name.
+func checkAPIToken(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		header := c.Request.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			logger.Print("API request without a token from ", c.ClientIP(), ": ", c.Request.Method, " ", c.Request.URL.Path)
+			c.Abort()
+			c.JSON(401, gin.H{"error": "An API token is required"})
+			return
+		}
+		token, found, err := db.FindAPIToken(hashAPIToken(strings.TrimPrefix(header, "Bearer ")))
+		if err != nil {
+			c.Abort()
+			c.JSON(500, gin.H{"error": "Error checking API token: " + err.Error()})
+			return
+		}
+		if !found {
+			logger.Print("API request with an unknown token from ", c.ClientIP(), ": ", c.Request.Method, " ", c.Request.URL.Path)
+			c.Abort()
+			c.JSON(401, gin.H{"error": "Invalid API token"})
+			return
+		}
+		if !token.HasScope(scope) {
+			logger.Print("API token ", token.Name, " lacks ", scope, " for ", c.Request.Method, " ", c.Request.URL.Path)
+			c.Abort()
+			c.JSON(403, gin.H{"error": "The API token doesn't have the " + scope + " scope"})
+			return
+		}
+		if start.Sub(token.LastUsedAt) > apiTokenTouchInterval {
+			db.TouchAPIToken(token.Id, start)
+		}
+		c.Set("api-token", token)
+		c.Next()
+		logger.Print("API token ", token.Name, ": ", c.Request.Method, " ", c.Request.URL.Path, " ",
+			c.Writer.Status(), " in ", time.Since(start))
+	}
+}
+
+// The audit trail actor for the request's API token.
+func apiActor(c *gin.Context) string {
+	val, exists := c.Get("api-token")
+	if !exists {
+		logger.Print("WARNING! API token not found in context as expected")
+		return "api:unknown"
+	}
+	return "api:" + val.(database.APIToken).Name
+}
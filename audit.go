@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+)
+
+const (
+	// Actor recorded for changes requested by Heroku through the add-on API.
+	platformActor = "heroku-platform"
+
+	auditLink              = "link"
+	auditUnlink            = "unlink"
+	auditUpdateCredentials = "update_credentials"
+	auditProvision         = "provision"
+	auditPlanChange        = "plan_change"
+	auditDeprovision       = "deprovision"
+	auditAppRename         = "app_rename"
+	auditAppTransfer       = "app_transfer"
+	auditAppDelete         = "app_delete"
+
+	auditPageSize = 200
+)
+
+var auditActions = []string{auditLink, auditUnlink, auditUpdateCredentials, auditProvision, auditPlanChange, auditDeprovision,
+	auditAppRename, auditAppTransfer, auditAppDelete}
+
+// Records the outcome of an action. Failing to record is logged but never fails the action itself.
+func recordAudit(actor, ownerId, resourceId, action string, err error) {
+	event := &database.AuditEvent{
+		Actor:      actor,
+		OwnerId:    ownerId,
+		ResourceId: resourceId,
+		Action:     action,
+		Outcome:    database.AuditSuccess,
+	}
+	if err != nil {
+		event.Outcome, event.Error = database.AuditFailure, err.Error()
+	}
+	if err := db.SaveAuditEvent(event); err != nil {
+		logger.Print("Couldn't record ", action, " of ", resourceId, " for ", ownerId, ": ", err)
+	}
+}
+
+// Reads the audit filter from the query string. Returns an error message for values that could
+// never match anything.
+func auditFilterFromQuery(c *gin.Context, ownerId string) (filter database.AuditFilter, message string) {
+	filter = database.AuditFilter{
+		OwnerId:    ownerId,
+		ResourceId: c.Query("resource_id"),
+		Action:     c.Query("action"),
+		Outcome:    c.Query("outcome"),
+	}
+	if filter.Action != "" && !contains(auditActions, filter.Action) {
+		return filter, "Unknown action " + filter.Action
+	}
+	if filter.Outcome != "" && filter.Outcome != database.AuditSuccess && filter.Outcome != database.AuditFailure {
+		return filter, "Outcome must be " + database.AuditSuccess + " or " + database.AuditFailure
+	}
+	return filter, ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func setupAuditRoutes(manage *gin.RouterGroup) {
+
+	manage.GET("/orgs/:org_id/audit", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed {
+			return
+		}
+		filter, message := auditFilterFromQuery(c, org.Id)
+		if message != "" {
+			c.String(400, message)
+			return
+		}
+		filter.Limit = auditPageSize
+		events, err := db.FindAuditEvents(filter)
+		if err != nil {
+			c.String(500, "Error finding audit events: "+err.Error())
+			return
+		}
+		renderManagePage(c, http.StatusOK, "audit.tmpl.html", gin.H{
+			"org":      org,
+			"events":   events,
+			"filter":   filter,
+			"actions":  auditActions,
+			"outcomes": []string{database.AuditSuccess, database.AuditFailure},
+			"query":    c.Request.URL.RawQuery,
+		})
+	})
+
+	// JSON export of every matching event, not just the latest page.
+	manage.GET("/orgs/:org_id/audit.json", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed {
+			return
+		}
+		filter, message := auditFilterFromQuery(c, org.Id)
+		if message != "" {
+			c.JSON(400, gin.H{"error": message})
+			return
+		}
+		events, err := db.FindAuditEvents(filter)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=\"audit-"+org.Name+".json\"")
+		c.JSON(200, events)
+	})
+}
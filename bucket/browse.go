@@ -0,0 +1,88 @@
+package bucket
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// One page of the objects and subfolders directly under a folder, like a directory listing.
+type Folder struct {
+	Prefix     string
+	Subfolders []string
+	Objects    []FolderObject
+	// Marker for the next page. Empty on the last page.
+	NextMarker string
+}
+
+type FolderObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Where the bucket lives. Buckets in us-east-1 have no location constraint, and some old buckets
+// in eu-west-1 have the constraint EU.
+func (c *BucketController) Region(bucketName string) (string, error) {
+	output, err := c.s3svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: &bucketName})
+	if err != nil {
+		logger.Print("Error finding location of bucket ", bucketName, ": ", err)
+		return "", err
+	}
+	switch region := aws.StringValue(output.LocationConstraint); region {
+	case "":
+		return "us-east-1", nil
+	case "EU":
+		return "eu-west-1", nil
+	default:
+		return region, nil
+	}
+}
+
+// Lists up to max keys under prefix, treating / as the folder separator. Pass the NextMarker of
+// the previous page as marker to continue.
+func (c *BucketController) ListFolder(bucketName string, prefix string, marker string, max int64) (folder Folder, err error) {
+	output, err := c.s3svc.ListObjects(&s3.ListObjectsInput{
+		Bucket:    &bucketName,
+		Prefix:    &prefix,
+		Delimiter: aws.String("/"),
+		Marker:    &marker,
+		MaxKeys:   &max,
+	})
+	if err != nil {
+		logger.Print("Error listing folder ", prefix, " of bucket ", bucketName, ": ", err)
+		return folder, err
+	}
+	folder.Prefix = prefix
+	for _, p := range output.CommonPrefixes {
+		folder.Subfolders = append(folder.Subfolders, aws.StringValue(p.Prefix))
+	}
+	for _, obj := range output.Contents {
+		// Folders created in the S3 console are empty objects named like the folder.
+		if key := aws.StringValue(obj.Key); key != prefix || !strings.HasSuffix(key, "/") {
+			folder.Objects = append(folder.Objects, FolderObject{
+				Key:          key,
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+	}
+	// S3 only returns NextMarker when a delimiter is given, which it always is here.
+	if aws.BoolValue(output.IsTruncated) {
+		folder.NextMarker = aws.StringValue(output.NextMarker)
+	}
+	return folder, nil
+}
+
+// A URL that downloads the object without credentials until it expires.
+func (c *BucketController) DownloadURL(bucketName string, key string, expires time.Duration) (string, error) {
+	req, _ := c.s3svc.GetObjectRequest(&s3.GetObjectInput{Bucket: &bucketName, Key: &key})
+	url, err := req.Presign(expires)
+	if err != nil {
+		logger.Print("Error signing download of ", bucketName, "/", key, ": ", err)
+		return "", err
+	}
+	return url, nil
+}
@@ -1,9 +1,14 @@
 package bucket
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,68 +33,149 @@ type Bucket struct {
 	AWSSecretAccessKey string
 }
 
+type Usage struct {
+	ObjectCount int64
+	TotalBytes  int64
+}
+
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// Objects selected for copying, with their total size so limits can be checked before copying.
+type ObjectList struct {
+	Objects    []ObjectInfo
+	TotalBytes int64
+}
+
+// Largest object CopyObject can copy in one request.
+const maxCopyObjectBytes = 5 * 1024 * 1024 * 1024
+
 const (
+	// Actions granted on a resource's bucket and the objects in it.
+	bucketActions = `[
+  "s3:AbortMultipartUpload",
+  "s3:DeleteObject",
+  "s3:DeleteObjectVersion",
+  "s3:GetAccelerateConfiguration",
+  "s3:GetBucketAcl",
+  "s3:GetBucketCORS",
+  "s3:GetBucketLocation",
+  "s3:GetBucketLogging",
+  "s3:GetBucketNotification",
+  "s3:GetBucketVersioning",
+  "s3:GetBucketWebsite",
+  "s3:GetLifecycleConfiguration",
+  "s3:GetObject",
+  "s3:GetObjectAcl",
+  "s3:GetObjectTorrent",
+  "s3:GetObjectVersion",
+  "s3:GetObjectVersionAcl",
+  "s3:GetObjectVersionTorrent",
+  "s3:GetReplicationConfiguration",
+  "s3:ListBucket",
+  "s3:ListBucketMultipartUploads",
+  "s3:ListBucketVersions",
+  "s3:ListMultipartUploadParts",
+  "s3:PutAccelerateConfiguration",
+  "s3:PutBucketAcl",
+  "s3:PutBucketCORS",
+  "s3:PutBucketLogging",
+  "s3:PutBucketNotification",
+  "s3:PutBucketRequestPayment",
+  "s3:PutBucketTagging",
+  "s3:PutBucketVersioning",
+  "s3:PutBucketWebsite",
+  "s3:PutLifecycleConfiguration",
+  "s3:PutReplicationConfiguration",
+  "s3:PutObject",
+  "s3:PutObjectAcl",
+  "s3:PutObjectVersionAcl",
+  "s3:ReplicateDelete",
+  "s3:ReplicateObject",
+  "s3:RestoreObject"
+]`
+
 	policyDocTemplate = `{
   "Id": "Policy%s",
   "Version": "2012-10-17",
   "Statement": [
     {
       "Sid": "Stmt%s",
+      "Action": %s,
+      "Effect": "Allow",
+      "Resource": [
+        "arn:aws:s3:::%s", 
+        "arn:aws:s3:::%s/*"
+      ],
+      "Principal": {
+        "AWS": [
+          "%s"
+        ]
+      }
+    }
+  ]
+}`
+
+	// Identity based policy attached to the IAM user for adopted buckets. Adopted buckets may
+	// already have a bucket policy we must not overwrite.
+	userPolicyDocTemplate = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Action": %s,
+      "Effect": "Allow",
+      "Resource": [
+        "arn:aws:s3:::%s",
+        "arn:aws:s3:::%s/*"
+      ]
+    }
+  ]
+}`
+
+	// Policy for a resource that lives under a prefix in a shared bucket. Listing is limited with
+	// an s3:prefix condition and object access with the object ARN.
+	prefixPolicyDocTemplate = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Action": ["s3:ListBucket", "s3:ListBucketVersions"],
+      "Effect": "Allow",
+      "Resource": ["arn:aws:s3:::%s"],
+      "Condition": {
+        "StringLike": {
+          "s3:prefix": ["%s*"]
+        }
+      }
+    },
+    {
+      "Action": ["s3:GetBucketLocation", "s3:ListBucketMultipartUploads"],
+      "Effect": "Allow",
+      "Resource": ["arn:aws:s3:::%s"]
+    },
+    {
       "Action": [
         "s3:AbortMultipartUpload",
         "s3:DeleteObject",
         "s3:DeleteObjectVersion",
-        "s3:GetAccelerateConfiguration",
-        "s3:GetBucketAcl",
-        "s3:GetBucketCORS",
-        "s3:GetBucketLocation",
-        "s3:GetBucketLogging",
-        "s3:GetBucketNotification",
-        "s3:GetBucketVersioning",
-        "s3:GetBucketWebsite",
-        "s3:GetLifecycleConfiguration",
         "s3:GetObject",
         "s3:GetObjectAcl",
-        "s3:GetObjectTorrent",
         "s3:GetObjectVersion",
         "s3:GetObjectVersionAcl",
-        "s3:GetObjectVersionTorrent",
-        "s3:GetReplicationConfiguration",
-        "s3:ListBucket",
-        "s3:ListBucketMultipartUploads",
-        "s3:ListBucketVersions",
         "s3:ListMultipartUploadParts",
-        "s3:PutAccelerateConfiguration",
-        "s3:PutBucketAcl",
-        "s3:PutBucketCORS",
-        "s3:PutBucketLogging",
-        "s3:PutBucketNotification",
-        "s3:PutBucketRequestPayment",
-        "s3:PutBucketTagging",
-        "s3:PutBucketVersioning",
-        "s3:PutBucketWebsite",
-        "s3:PutLifecycleConfiguration",
-        "s3:PutReplicationConfiguration",
         "s3:PutObject",
         "s3:PutObjectAcl",
         "s3:PutObjectVersionAcl",
-        "s3:ReplicateDelete",
-        "s3:ReplicateObject",
         "s3:RestoreObject"
       ],
       "Effect": "Allow",
-      "Resource": [
-        "arn:aws:s3:::%s", 
-        "arn:aws:s3:::%s/*"
-      ],
-      "Principal": {
-        "AWS": [
-          "%s"
-        ]
-      }
+      "Resource": ["arn:aws:s3:::%s/%s*"]
     }
   ]
 }`
+
+	userPolicyName = "bucket-access"
 )
 
 var (
@@ -108,11 +194,23 @@ func NewController(region string, awsAccessKeyId string, awsSecretAccessKey stri
 	return BucketController{session: sess, s3svc: s3.New(sess), iamsvc: iam.New(sess)}, nil
 }
 
+func BucketName(providerId string) string {
+	return "bucket-" + providerId
+}
+
+// Shared bucket names are random since bucket names are global and a team may relink to another
+// AWS account.
+func NewSharedBucketName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "shared-" + hex.EncodeToString(b)
+}
+
 func (c *BucketController) CreateBucket(providerId string) (bucket Bucket, err error) {
 
 	// Create the S3 bucket
 
-	bucket.Name = "bucket-" + providerId
+	bucket.Name = BucketName(providerId)
 	_, err = c.s3svc.CreateBucket(&s3.CreateBucketInput{Bucket: &bucket.Name})
 	if err != nil {
 		logger.Print("Error creating bucket: ", err)
@@ -121,29 +219,11 @@ func (c *BucketController) CreateBucket(providerId string) (bucket Bucket, err e
 
 	// Create the IAM user that will access the bucket
 
-	bucket.UserName = "user-" + providerId
-	createUserOutput, err := c.iamsvc.CreateUser(&iam.CreateUserInput{UserName: &bucket.UserName})
-	if err != nil {
-		logger.Print("Error creating IAM User: ", err)
-		return bucket, err
-	}
-	bucket.UserARN = *createUserOutput.User.Arn
-	logger.Print("Created IAM User ", bucket.UserARN)
-
-	// Create the credentials for the IAM user
-
-	credResp, err := c.iamsvc.CreateAccessKey(&iam.CreateAccessKeyInput{UserName: &bucket.UserName})
-	if err != nil {
-		logger.Print("Error creating access keys for IAM User: ", err)
+	if err = c.createUser(providerId, &bucket); err != nil {
 		return bucket, err
 	}
 
-	bucket.AWSAccessKeyId = *credResp.AccessKey.AccessKeyId
-	bucket.AWSSecretAccessKey = *credResp.AccessKey.SecretAccessKey
-
-	logger.Print("Created access key ", bucket.AWSAccessKeyId, " for IAM user ", bucket.UserARN)
-
-	policyDoc := fmt.Sprintf(policyDocTemplate, providerId, providerId, bucket.Name, bucket.Name, bucket.UserARN)
+	policyDoc := fmt.Sprintf(policyDocTemplate, providerId, providerId, bucketActions, bucket.Name, bucket.Name, bucket.UserARN)
 
 	// Setting bucket policy that refers to a newly created IAM user can fail seemingly due to an AWS race condition.
 	// Adding a 3 second delay seems to remove this issue
@@ -174,6 +254,112 @@ func (c *BucketController) CreateBucket(providerId string) (bucket Bucket, err e
 	return bucket, nil
 }
 
+// Creates an IAM user with access to an existing bucket in the account. Used for adopted buckets
+// so the bucket itself, including its policy, is left untouched.
+func (c *BucketController) CreateUser(providerId string, bucketName string) (bucket Bucket, err error) {
+	policyDoc := fmt.Sprintf(userPolicyDocTemplate, bucketActions, bucketName, bucketName)
+	return c.createUserWithPolicy(providerId, bucketName, policyDoc)
+}
+
+// Creates an IAM user that can only see and change objects under prefix in a shared bucket.
+func (c *BucketController) CreatePrefixUser(providerId string, bucketName string, prefix string) (bucket Bucket, err error) {
+	policyDoc := fmt.Sprintf(prefixPolicyDocTemplate, bucketName, prefix, bucketName, bucketName, prefix)
+	return c.createUserWithPolicy(providerId, bucketName, policyDoc)
+}
+
+// Creates a bucket shared by several resources, each confined to its own prefix by the policy on
+// its IAM user. The bucket itself gets no policy.
+func (c *BucketController) CreateSharedBucket(bucketName string) error {
+	_, err := c.s3svc.CreateBucket(&s3.CreateBucketInput{Bucket: &bucketName})
+	if err != nil {
+		logger.Print("Error creating shared bucket: ", err)
+		return err
+	}
+	logger.Print("Created shared bucket ", bucketName)
+	return nil
+}
+
+// Deletes a shared bucket no resource has used yet, like one that lost the race to become the
+// account's shared bucket.
+func (c *BucketController) DeleteSharedBucket(bucketName string) error {
+	_, err := c.s3svc.DeleteBucket(&s3.DeleteBucketInput{Bucket: &bucketName})
+	if err != nil {
+		logger.Print("Error deleting shared bucket: ", err)
+		return err
+	}
+	logger.Print("Deleted shared bucket ", bucketName)
+	return nil
+}
+
+func (c *BucketController) createUserWithPolicy(providerId string, bucketName string, policyDoc string) (bucket Bucket, err error) {
+	bucket.Name = bucketName
+	if err = c.createUser(providerId, &bucket); err != nil {
+		return bucket, err
+	}
+	_, err = c.iamsvc.PutUserPolicy(&iam.PutUserPolicyInput{
+		UserName:       &bucket.UserName,
+		PolicyName:     aws.String(userPolicyName),
+		PolicyDocument: &policyDoc,
+	})
+	if err != nil {
+		logger.Print("Error setting user policy for ", bucket.UserName, ": ", err)
+		return bucket, err
+	}
+	logger.Print("User policy for ", bucket.Name, " set on ", bucket.UserName)
+	return bucket, nil
+}
+
+// Creates the IAM user and access key for a resource and records them on bucket.
+func (c *BucketController) createUser(providerId string, bucket *Bucket) error {
+	bucket.UserName = "user-" + providerId
+	createUserOutput, err := c.iamsvc.CreateUser(&iam.CreateUserInput{UserName: &bucket.UserName})
+	if err != nil {
+		logger.Print("Error creating IAM User: ", err)
+		return err
+	}
+	bucket.UserARN = *createUserOutput.User.Arn
+	logger.Print("Created IAM User ", bucket.UserARN)
+
+	// Create the credentials for the IAM user
+
+	credResp, err := c.iamsvc.CreateAccessKey(&iam.CreateAccessKeyInput{UserName: &bucket.UserName})
+	if err != nil {
+		logger.Print("Error creating access keys for IAM User: ", err)
+		return err
+	}
+
+	bucket.AWSAccessKeyId = *credResp.AccessKey.AccessKeyId
+	bucket.AWSSecretAccessKey = *credResp.AccessKey.SecretAccessKey
+
+	logger.Print("Created access key ", bucket.AWSAccessKeyId, " for IAM user ", bucket.UserARN)
+	return nil
+}
+
+// Checks that the bucket exists, is owned by the account the controller's credentials belong to,
+// and is in the controller's region. The SDK doesn't follow S3's redirects to other regions, so
+// the controller couldn't manage a bucket anywhere else.
+func (c *BucketController) VerifyBucketInAccount(bucketName string) error {
+	output, err := c.s3svc.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		logger.Print("Error listing buckets: ", err)
+		return err
+	}
+	for _, b := range output.Buckets {
+		if aws.StringValue(b.Name) != bucketName {
+			continue
+		}
+		region, err := c.Region(bucketName)
+		if err != nil {
+			return err
+		}
+		if managed := aws.StringValue(c.session.Config.Region); region != managed {
+			return errors.New("Bucket " + bucketName + " is in " + region + ", but the add-on only manages buckets in " + managed)
+		}
+		return nil
+	}
+	return errors.New("Bucket " + bucketName + " not found in the linked AWS account")
+}
+
 func (c *BucketController) DeleteBucket(providerId string, awsAccessKeyId string) bool {
 
 	success := true
@@ -181,15 +367,40 @@ func (c *BucketController) DeleteBucket(providerId string, awsAccessKeyId string
 	c.DeleteAllObjects(providerId)
 	// if delete all objects fail, errors have already been logged and we'll keep going.
 
-	bucketName := "bucket-" + providerId
+	bucketName := BucketName(providerId)
 	_, err := c.s3svc.DeleteBucket(&s3.DeleteBucketInput{Bucket: &bucketName})
 	if err != nil {
 		logger.Print("Error deleting bucket: ", err)
 		success = false
 		// keep going
 	}
+
+	return c.DeleteUser(providerId, awsAccessKeyId) && success
+}
+
+// Deletes the IAM user for a resource along with its access key and inline policies. This is all
+// there is to deprovisioning an adopted bucket.
+func (c *BucketController) DeleteUser(providerId string, awsAccessKeyId string) bool {
+
+	success := true
 	userName := "user-" + providerId
 
+	policies, err := c.iamsvc.ListUserPolicies(&iam.ListUserPoliciesInput{UserName: &userName})
+	if err != nil {
+		logger.Print("Error listing IAM user policies: ", err)
+		success = false
+		// keep going
+	} else {
+		for _, policyName := range policies.PolicyNames {
+			_, err = c.iamsvc.DeleteUserPolicy(&iam.DeleteUserPolicyInput{UserName: &userName, PolicyName: policyName})
+			if err != nil {
+				logger.Print("Error deleting IAM user policy: ", err)
+				success = false
+				// keep going
+			}
+		}
+	}
+
 	_, err = c.iamsvc.DeleteAccessKey(&iam.DeleteAccessKeyInput{
 		AccessKeyId: &awsAccessKeyId,
 		UserName:    &userName,
@@ -211,15 +422,19 @@ func (c *BucketController) DeleteBucket(providerId string, awsAccessKeyId string
 }
 
 func (c *BucketController) DeleteAllObjects(providerId string) (err error) {
-	bucketName := "bucket-" + providerId
+	return c.DeleteObjects(BucketName(providerId), "")
+}
+
+// Deletes every object under prefix. An empty prefix empties the bucket.
+func (c *BucketController) DeleteObjects(bucketName string, prefix string) (err error) {
 	for {
-		output, err := c.s3svc.ListObjects(&s3.ListObjectsInput{Bucket: &bucketName})
+		output, err := c.s3svc.ListObjects(&s3.ListObjectsInput{Bucket: &bucketName, Prefix: &prefix})
 		if err != nil {
 			logger.Print("Error listing objects for bucket ", bucketName, ": ", err)
 			return err
 		}
 		if len(output.Contents) == 0 {
-			logger.Print("No more objects to delete from ", bucketName)
+			logger.Print("No more objects to delete from ", bucketName, "/", prefix)
 			return nil
 		}
 		deleteList := make([]*s3.ObjectIdentifier, len(output.Contents))
@@ -237,3 +452,71 @@ func (c *BucketController) DeleteAllObjects(providerId string) (err error) {
 		logger.Print("Deleted ", len(deleteList), " objects from ", bucketName)
 	}
 }
+
+// Usage walks the full object listing of a bucket, or of the part of it under prefix. CloudWatch's
+// daily BucketSizeBytes metric would be cheaper for very large buckets, but the CloudWatch client
+// isn't vendored, it can't measure a prefix, and the listing works for any bucket the linked
+// account can read.
+func (c *BucketController) Usage(bucketName string, prefix string) (usage Usage, err error) {
+	err = c.s3svc.ListObjectsPages(&s3.ListObjectsInput{Bucket: &bucketName, Prefix: &prefix},
+		func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				usage.ObjectCount++
+				if obj.Size != nil {
+					usage.TotalBytes += *obj.Size
+				}
+			}
+			return true
+		})
+	if err != nil {
+		logger.Print("Error listing objects for bucket ", bucketName, ": ", err)
+		return usage, err
+	}
+	return usage, nil
+}
+
+func (c *BucketController) ListObjects(bucketName string, prefix string) (list ObjectList, err error) {
+	err = c.s3svc.ListObjectsPages(&s3.ListObjectsInput{Bucket: &bucketName, Prefix: &prefix},
+		func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				info := ObjectInfo{Key: aws.StringValue(obj.Key), Size: aws.Int64Value(obj.Size)}
+				list.Objects = append(list.Objects, info)
+				list.TotalBytes += info.Size
+			}
+			return true
+		})
+	if err != nil {
+		logger.Print("Error listing objects for bucket ", bucketName, ": ", err)
+		return list, err
+	}
+	return list, nil
+}
+
+// Copies objects server side from one bucket to another. Keys have srcPrefix replaced with
+// dstPrefix. progress, if not nil, is called after every object.
+func (c *BucketController) CopyObjects(list ObjectList, srcBucket string, srcPrefix string, dstBucket string, dstPrefix string,
+	progress func(copiedObjects int, copiedBytes int64)) error {
+	var copiedBytes int64
+	for i, obj := range list.Objects {
+		if obj.Size > maxCopyObjectBytes {
+			return fmt.Errorf("Object %s is larger than 5 GB and can't be copied", obj.Key)
+		}
+		dstKey := dstPrefix + strings.TrimPrefix(obj.Key, srcPrefix)
+		// CopySource is bucket/key with the key URL encoded
+		copySource := srcBucket + "/" + (&url.URL{Path: obj.Key}).EscapedPath()
+		_, err := c.s3svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     &dstBucket,
+			Key:        &dstKey,
+			CopySource: &copySource,
+		})
+		if err != nil {
+			logger.Print("Error copying ", srcBucket, "/", obj.Key, " to ", dstBucket, "/", dstKey, ": ", err)
+			return err
+		}
+		copiedBytes += obj.Size
+		if progress != nil {
+			progress(i+1, copiedBytes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package bucket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A us-east-1 controller whose S3 requests go to handler.
+func newTestController(t *testing.T, handler http.HandlerFunc) BucketController {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("AKIA", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return BucketController{session: sess, s3svc: s3.New(sess)}
+}
+
+// Serves ListBuckets with the buckets in constraints, and GetBucketLocation with their constraints.
+func s3StandIn(constraints map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<ListAllMyBucketsResult><Buckets>`))
+			for name := range constraints {
+				w.Write([]byte(`<Bucket><Name>` + name + `</Name></Bucket>`))
+			}
+			w.Write([]byte(`</Buckets></ListAllMyBucketsResult>`))
+			return
+		}
+		if _, ok := r.URL.Query()["location"]; ok {
+			w.Write([]byte(`<LocationConstraint>` + constraints[strings.Trim(r.URL.Path, "/")] + `</LocationConstraint>`))
+			return
+		}
+		w.WriteHeader(404)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	c := newTestController(t, s3StandIn(map[string]string{"virginia": "", "ireland": "EU", "frankfurt": "eu-central-1"}))
+	for bucket, want := range map[string]string{"virginia": "us-east-1", "ireland": "eu-west-1", "frankfurt": "eu-central-1"} {
+		if region, err := c.Region(bucket); err != nil || region != want {
+			t.Errorf("Region of %s is %q, %v, want %s", bucket, region, err, want)
+		}
+	}
+}
+
+func TestVerifyBucketInAccount(t *testing.T) {
+	c := newTestController(t, s3StandIn(map[string]string{"virginia": "", "frankfurt": "eu-central-1"}))
+	if err := c.VerifyBucketInAccount("virginia"); err != nil {
+		t.Error(err)
+	}
+	if err := c.VerifyBucketInAccount("frankfurt"); err == nil || !strings.Contains(err.Error(), "eu-central-1") {
+		t.Errorf("Got %v for a bucket in another region", err)
+	}
+	if err := c.VerifyBucketInAccount("elsewhere"); err == nil {
+		t.Error("Verified a bucket the account doesn't have")
+	}
+}
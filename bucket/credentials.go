@@ -0,0 +1,34 @@
+package bucket
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// The 12 digit id of the AWS account the controller's credentials belong to. Fails if AWS
+// doesn't accept the credentials.
+func (c *BucketController) AWSAccountId() (string, error) {
+	output, err := sts.New(c.session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		logger.Print("Error checking credentials: ", err)
+		return "", err
+	}
+	return aws.StringValue(output.Account), nil
+}
+
+// Checks that the controller's credentials can still reach a resource's bucket and IAM user,
+// which is what deprovisioning needs.
+func (c *BucketController) VerifyResourceAccess(providerId string, bucketName string) error {
+	if _, err := c.s3svc.HeadBucket(&s3.HeadBucketInput{Bucket: &bucketName}); err != nil {
+		logger.Print("Error reaching bucket ", bucketName, ": ", err)
+		return err
+	}
+	userName := "user-" + providerId
+	if _, err := c.iamsvc.GetUser(&iam.GetUserInput{UserName: &userName}); err != nil {
+		logger.Print("Error reaching IAM user ", userName, ": ", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package bucket
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Developer editable bucket settings. These are a deliberately small subset of what S3 supports
+// so that they can be validated up front and round trip cleanly through the settings page.
+type Settings struct {
+	CORS      []CORSRule      `json:"cors"`
+	Lifecycle []LifecycleRule `json:"lifecycle"`
+	// Why the bucket's lifecycle rules can't be edited here, if they can't. Lifecycle then only
+	// shows the parts of them a LifecycleRule can hold.
+	LifecycleUnsupported string  `json:"lifecycle_unsupported,omitempty"`
+	Website              Website `json:"website"`
+}
+
+type CORSRule struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	ExposeHeaders  []string `json:"expose_headers,omitempty"`
+	MaxAgeSeconds  int64    `json:"max_age_seconds,omitempty"`
+}
+
+// Expire and/or transition objects under Prefix. Days are counted from object creation.
+type LifecycleRule struct {
+	Id                     string `json:"id"`
+	Prefix                 string `json:"prefix"`
+	ExpirationDays         int64  `json:"expiration_days,omitempty"`
+	TransitionDays         int64  `json:"transition_days,omitempty"`
+	TransitionStorageClass string `json:"transition_storage_class,omitempty"`
+}
+
+type Website struct {
+	Enabled       bool   `json:"enabled"`
+	IndexDocument string `json:"index_document,omitempty"`
+	ErrorDocument string `json:"error_document,omitempty"`
+	Endpoint      string `json:"endpoint,omitempty"`
+}
+
+const (
+	maxCORSRules      = 100
+	maxLifecycleRules = 1000
+)
+
+var (
+	corsMethods = map[string]bool{"GET": true, "PUT": true, "POST": true, "DELETE": true, "HEAD": true}
+	// Transitions to GLACIER and STANDARD_IA are the ones S3 accepts in a lifecycle rule.
+	transitionClasses = map[string]bool{s3.TransitionStorageClassGlacier: true, s3.TransitionStorageClassStandardIa: true}
+)
+
+func ValidateCORS(rules []CORSRule) error {
+	if len(rules) > maxCORSRules {
+		return fmt.Errorf("At most %d CORS rules are allowed", maxCORSRules)
+	}
+	for i, r := range rules {
+		if len(r.AllowedOrigins) == 0 {
+			return fmt.Errorf("CORS rule %d: at least one allowed origin is required", i+1)
+		}
+		if len(r.AllowedMethods) == 0 {
+			return fmt.Errorf("CORS rule %d: at least one allowed method is required", i+1)
+		}
+		for _, m := range r.AllowedMethods {
+			if !corsMethods[m] {
+				return fmt.Errorf("CORS rule %d: %q is not an allowed method. Use GET, PUT, POST, DELETE or HEAD", i+1, m)
+			}
+		}
+		for _, o := range r.AllowedOrigins {
+			if strings.Count(o, "*") > 1 {
+				return fmt.Errorf("CORS rule %d: origin %q can contain at most one wildcard", i+1, o)
+			}
+		}
+		if r.MaxAgeSeconds < 0 {
+			return fmt.Errorf("CORS rule %d: max age can't be negative", i+1)
+		}
+	}
+	return nil
+}
+
+func ValidateLifecycle(rules []LifecycleRule) error {
+	if len(rules) > maxLifecycleRules {
+		return fmt.Errorf("At most %d lifecycle rules are allowed", maxLifecycleRules)
+	}
+	ids := make(map[string]bool)
+	for i, r := range rules {
+		if r.Id == "" || len(r.Id) > 255 {
+			return fmt.Errorf("Lifecycle rule %d: id is required and can be at most 255 characters", i+1)
+		}
+		if ids[r.Id] {
+			return fmt.Errorf("Lifecycle rule %d: id %q is used more than once", i+1, r.Id)
+		}
+		ids[r.Id] = true
+		if r.ExpirationDays == 0 && r.TransitionDays == 0 {
+			return fmt.Errorf("Lifecycle rule %q: needs expiration days, transition days or both", r.Id)
+		}
+		if r.ExpirationDays < 0 || r.TransitionDays < 0 {
+			return fmt.Errorf("Lifecycle rule %q: days can't be negative", r.Id)
+		}
+		if r.TransitionDays > 0 {
+			if !transitionClasses[r.TransitionStorageClass] {
+				return fmt.Errorf("Lifecycle rule %q: transition storage class must be GLACIER or STANDARD_IA", r.Id)
+			}
+			if r.TransitionStorageClass == s3.TransitionStorageClassStandardIa && r.TransitionDays < 30 {
+				return fmt.Errorf("Lifecycle rule %q: objects can't transition to STANDARD_IA before 30 days", r.Id)
+			}
+			if r.ExpirationDays > 0 && r.ExpirationDays <= r.TransitionDays {
+				return fmt.Errorf("Lifecycle rule %q: expiration must come after transition", r.Id)
+			}
+		} else if r.TransitionStorageClass != "" {
+			return fmt.Errorf("Lifecycle rule %q: transition storage class given without transition days", r.Id)
+		}
+	}
+	return nil
+}
+
+// Returned by PutLifecycle instead of replacing lifecycle rules that LifecycleRule can't represent,
+// which would silently drop what it leaves out.
+type UnsupportedLifecycleError struct {
+	Reason string
+}
+
+func (e *UnsupportedLifecycleError) Error() string {
+	return "The bucket's lifecycle rules can't be changed here because " + e.Reason + ". Change them in the AWS console."
+}
+
+// Why the rule can't round trip through a LifecycleRule, or "" if it can.
+func unsupportedLifecycleRule(r *s3.LifecycleRule) string {
+	id := aws.StringValue(r.ID)
+	switch {
+	case aws.StringValue(r.Status) != s3.ExpirationStatusEnabled:
+		return fmt.Sprintf("rule %q is disabled", id)
+	case r.Filter != nil && (r.Filter.And != nil || r.Filter.Tag != nil):
+		return fmt.Sprintf("rule %q filters on tags", id)
+	case len(r.Transitions) > 1:
+		return fmt.Sprintf("rule %q has more than one transition", id)
+	case len(r.Transitions) == 1 && r.Transitions[0].Date != nil,
+		r.Expiration != nil && r.Expiration.Date != nil:
+		return fmt.Sprintf("rule %q uses a date", id)
+	case r.Expiration != nil && aws.BoolValue(r.Expiration.ExpiredObjectDeleteMarker):
+		return fmt.Sprintf("rule %q removes expired delete markers", id)
+	case r.NoncurrentVersionExpiration != nil || len(r.NoncurrentVersionTransitions) > 0:
+		return fmt.Sprintf("rule %q applies to noncurrent versions", id)
+	case r.AbortIncompleteMultipartUpload != nil:
+		return fmt.Sprintf("rule %q aborts incomplete multipart uploads", id)
+	}
+	return ""
+}
+
+func lifecycleRuleFromS3(r *s3.LifecycleRule) LifecycleRule {
+	rule := LifecycleRule{Id: aws.StringValue(r.ID), Prefix: aws.StringValue(r.Prefix)}
+	if r.Filter != nil && r.Filter.Prefix != nil {
+		rule.Prefix = *r.Filter.Prefix
+	}
+	if r.Expiration != nil {
+		rule.ExpirationDays = aws.Int64Value(r.Expiration.Days)
+	}
+	if len(r.Transitions) > 0 {
+		rule.TransitionDays = aws.Int64Value(r.Transitions[0].Days)
+		rule.TransitionStorageClass = aws.StringValue(r.Transitions[0].StorageClass)
+	}
+	return rule
+}
+
+func (r LifecycleRule) toS3() *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(r.Id),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(r.Prefix)},
+		Status: aws.String(s3.ExpirationStatusEnabled),
+	}
+	if r.ExpirationDays > 0 {
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(r.ExpirationDays)}
+	}
+	if r.TransitionDays > 0 {
+		rule.Transitions = []*s3.Transition{&s3.Transition{
+			Days:         aws.Int64(r.TransitionDays),
+			StorageClass: aws.String(r.TransitionStorageClass),
+		}}
+	}
+	return rule
+}
+
+func ValidateWebsite(website Website) error {
+	if !website.Enabled {
+		return nil
+	}
+	if website.IndexDocument == "" || strings.Contains(website.IndexDocument, "/") {
+		return errors.New("Website index document is required and can't contain a slash")
+	}
+	return nil
+}
+
+func WebsiteEndpoint(bucketName string, region string) string {
+	return "http://" + bucketName + ".s3-website-" + region + ".amazonaws.com"
+}
+
+func (c *BucketController) GetSettings(bucketName string) (settings Settings, err error) {
+	cors, err := c.s3svc.GetBucketCors(&s3.GetBucketCorsInput{Bucket: &bucketName})
+	if err != nil && !isErrorCode(err, "NoSuchCORSConfiguration") {
+		logger.Print("Error reading CORS configuration for ", bucketName, ": ", err)
+		return settings, err
+	}
+	if err == nil {
+		for _, r := range cors.CORSRules {
+			settings.CORS = append(settings.CORS, CORSRule{
+				AllowedOrigins: aws.StringValueSlice(r.AllowedOrigins),
+				AllowedMethods: aws.StringValueSlice(r.AllowedMethods),
+				AllowedHeaders: aws.StringValueSlice(r.AllowedHeaders),
+				ExposeHeaders:  aws.StringValueSlice(r.ExposeHeaders),
+				MaxAgeSeconds:  aws.Int64Value(r.MaxAgeSeconds),
+			})
+		}
+	}
+
+	lifecycle, err := c.s3svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: &bucketName})
+	if err != nil && !isErrorCode(err, "NoSuchLifecycleConfiguration") {
+		logger.Print("Error reading lifecycle configuration for ", bucketName, ": ", err)
+		return settings, err
+	}
+	if err == nil {
+		for _, r := range lifecycle.Rules {
+			if reason := unsupportedLifecycleRule(r); reason != "" && settings.LifecycleUnsupported == "" {
+				settings.LifecycleUnsupported = reason
+			}
+			settings.Lifecycle = append(settings.Lifecycle, lifecycleRuleFromS3(r))
+		}
+	}
+
+	website, err := c.s3svc.GetBucketWebsite(&s3.GetBucketWebsiteInput{Bucket: &bucketName})
+	if err != nil && !isErrorCode(err, "NoSuchWebsiteConfiguration") {
+		logger.Print("Error reading website configuration for ", bucketName, ": ", err)
+		return settings, err
+	}
+	if err == nil && website.IndexDocument != nil {
+		// The endpoint is in the bucket's region, which needn't be the controller's.
+		region, err := c.Region(bucketName)
+		if err != nil {
+			return settings, err
+		}
+		settings.Website = Website{
+			Enabled:       true,
+			IndexDocument: aws.StringValue(website.IndexDocument.Suffix),
+			Endpoint:      WebsiteEndpoint(bucketName, region),
+		}
+		if website.ErrorDocument != nil {
+			settings.Website.ErrorDocument = aws.StringValue(website.ErrorDocument.Key)
+		}
+	}
+	return settings, nil
+}
+
+// An empty rule list removes the CORS configuration.
+func (c *BucketController) PutCORS(bucketName string, rules []CORSRule) error {
+	if err := ValidateCORS(rules); err != nil {
+		return err
+	}
+	var err error
+	if len(rules) == 0 {
+		_, err = c.s3svc.DeleteBucketCors(&s3.DeleteBucketCorsInput{Bucket: &bucketName})
+	} else {
+		corsRules := make([]*s3.CORSRule, len(rules))
+		for i, r := range rules {
+			corsRules[i] = &s3.CORSRule{
+				AllowedOrigins: aws.StringSlice(r.AllowedOrigins),
+				AllowedMethods: aws.StringSlice(r.AllowedMethods),
+				AllowedHeaders: aws.StringSlice(r.AllowedHeaders),
+				ExposeHeaders:  aws.StringSlice(r.ExposeHeaders),
+			}
+			if r.MaxAgeSeconds > 0 {
+				corsRules[i].MaxAgeSeconds = aws.Int64(r.MaxAgeSeconds)
+			}
+		}
+		_, err = c.s3svc.PutBucketCors(&s3.PutBucketCorsInput{
+			Bucket:            &bucketName,
+			CORSConfiguration: &s3.CORSConfiguration{CORSRules: corsRules},
+		})
+	}
+	if err != nil {
+		logger.Print("Error setting CORS configuration for ", bucketName, ": ", err)
+		return err
+	}
+	return nil
+}
+
+// An empty rule list removes the lifecycle configuration. Returns an *UnsupportedLifecycleError
+// without changing anything if the bucket has rules a LifecycleRule can't represent.
+func (c *BucketController) PutLifecycle(bucketName string, rules []LifecycleRule) error {
+	if err := ValidateLifecycle(rules); err != nil {
+		return err
+	}
+	current, err := c.s3svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: &bucketName})
+	if err != nil && !isErrorCode(err, "NoSuchLifecycleConfiguration") {
+		logger.Print("Error reading lifecycle configuration for ", bucketName, ": ", err)
+		return err
+	}
+	if err == nil {
+		for _, r := range current.Rules {
+			if reason := unsupportedLifecycleRule(r); reason != "" {
+				return &UnsupportedLifecycleError{Reason: reason}
+			}
+		}
+	}
+	if len(rules) == 0 {
+		_, err = c.s3svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: &bucketName})
+	} else {
+		lifecycleRules := make([]*s3.LifecycleRule, len(rules))
+		for i, r := range rules {
+			lifecycleRules[i] = r.toS3()
+		}
+		_, err = c.s3svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 &bucketName,
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: lifecycleRules},
+		})
+	}
+	if err != nil {
+		logger.Print("Error setting lifecycle configuration for ", bucketName, ": ", err)
+		return err
+	}
+	return nil
+}
+
+// Enables or disables static website hosting. Making objects publicly readable is left to the
+// developer. The add-on never changes object ACLs.
+func (c *BucketController) PutWebsite(bucketName string, website Website) error {
+	if err := ValidateWebsite(website); err != nil {
+		return err
+	}
+	var err error
+	if !website.Enabled {
+		_, err = c.s3svc.DeleteBucketWebsite(&s3.DeleteBucketWebsiteInput{Bucket: &bucketName})
+	} else {
+		config := &s3.WebsiteConfiguration{
+			IndexDocument: &s3.IndexDocument{Suffix: aws.String(website.IndexDocument)},
+		}
+		if website.ErrorDocument != "" {
+			config.ErrorDocument = &s3.ErrorDocument{Key: aws.String(website.ErrorDocument)}
+		}
+		_, err = c.s3svc.PutBucketWebsite(&s3.PutBucketWebsiteInput{
+			Bucket:               &bucketName,
+			WebsiteConfiguration: config,
+		})
+	}
+	if err != nil {
+		logger.Print("Error setting website configuration for ", bucketName, ": ", err)
+		return err
+	}
+	return nil
+}
+
+// Replaces the bucket's tags. Keys are sorted so the tag set is stable between calls.
+func (c *BucketController) PutTags(bucketName string, tags map[string]string) error {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tagSet := make([]*s3.Tag, len(keys))
+	for i, k := range keys {
+		tagSet[i] = &s3.Tag{Key: aws.String(k), Value: aws.String(tags[k])}
+	}
+	_, err := c.s3svc.PutBucketTagging(&s3.PutBucketTaggingInput{
+		Bucket:  &bucketName,
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	if err != nil {
+		logger.Print("Error tagging bucket ", bucketName, ": ", err)
+		return err
+	}
+	return nil
+}
+
+func isErrorCode(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
@@ -0,0 +1,108 @@
+package bucket
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestLifecycleRulesRoundTrip(t *testing.T) {
+	rules := []LifecycleRule{
+		{Id: "expire", Prefix: "tmp/", ExpirationDays: 7},
+		{Id: "archive", Prefix: "", TransitionDays: 30, TransitionStorageClass: s3.TransitionStorageClassStandardIa},
+		{Id: "both", Prefix: "logs/", ExpirationDays: 365, TransitionDays: 90, TransitionStorageClass: s3.TransitionStorageClassGlacier},
+	}
+	for _, rule := range rules {
+		written := rule.toS3()
+		if reason := unsupportedLifecycleRule(written); reason != "" {
+			t.Errorf("Rule %q as written is unsupported: %s", rule.Id, reason)
+		}
+		if read := lifecycleRuleFromS3(written); read != rule {
+			t.Errorf("Rule %+v reads back as %+v", rule, read)
+		}
+	}
+	// Rules written before filters existed have their prefix on the rule.
+	old := &s3.LifecycleRule{ID: aws.String("old"), Prefix: aws.String("a/"), Status: aws.String("Enabled"),
+		Expiration: &s3.LifecycleExpiration{Days: aws.Int64(1)}}
+	if read := lifecycleRuleFromS3(old); read.Prefix != "a/" || unsupportedLifecycleRule(old) != "" {
+		t.Errorf("Rule with a prefix of its own reads as %+v", read)
+	}
+}
+
+func TestUnsupportedLifecycleRules(t *testing.T) {
+	supported := func() *s3.LifecycleRule {
+		return (LifecycleRule{Id: "rule", Prefix: "p/", ExpirationDays: 10}).toS3()
+	}
+	tests := []struct {
+		name   string
+		change func(r *s3.LifecycleRule)
+	}{
+		{"disabled", func(r *s3.LifecycleRule) { r.Status = aws.String(s3.ExpirationStatusDisabled) }},
+		{"tag filter", func(r *s3.LifecycleRule) {
+			r.Filter = &s3.LifecycleRuleFilter{Tag: &s3.Tag{Key: aws.String("k"), Value: aws.String("v")}}
+		}},
+		{"and filter", func(r *s3.LifecycleRule) {
+			r.Filter = &s3.LifecycleRuleFilter{And: &s3.LifecycleRuleAndOperator{Prefix: aws.String("p/")}}
+		}},
+		{"two transitions", func(r *s3.LifecycleRule) {
+			r.Transitions = []*s3.Transition{
+				{Days: aws.Int64(30), StorageClass: aws.String(s3.TransitionStorageClassStandardIa)},
+				{Days: aws.Int64(90), StorageClass: aws.String(s3.TransitionStorageClassGlacier)},
+			}
+		}},
+		{"noncurrent expiration", func(r *s3.LifecycleRule) {
+			r.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(5)}
+		}},
+		{"noncurrent transition", func(r *s3.LifecycleRule) {
+			r.NoncurrentVersionTransitions = []*s3.NoncurrentVersionTransition{{NoncurrentDays: aws.Int64(5)}}
+		}},
+		{"expired delete markers", func(r *s3.LifecycleRule) {
+			r.Expiration = &s3.LifecycleExpiration{ExpiredObjectDeleteMarker: aws.Bool(true)}
+		}},
+		{"multipart uploads", func(r *s3.LifecycleRule) {
+			r.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int64(7)}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := supported()
+			test.change(rule)
+			if unsupportedLifecycleRule(rule) == "" {
+				t.Errorf("%+v is reported as supported", rule)
+			}
+			// Writing back what the form shows would lose something.
+			if back := lifecycleRuleFromS3(rule).toS3(); reflect.DeepEqual(back, rule) {
+				t.Errorf("%+v round trips, so it shouldn't be refused", rule)
+			}
+		})
+	}
+}
+
+func TestWebsiteEndpointUsesBucketRegion(t *testing.T) {
+	c := newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		query := r.URL.Query()
+		switch {
+		case query["location"] != nil:
+			w.Write([]byte(`<LocationConstraint>eu-central-1</LocationConstraint>`))
+		case query["website"] != nil:
+			w.Write([]byte(`<WebsiteConfiguration><IndexDocument><Suffix>index.html</Suffix></IndexDocument></WebsiteConfiguration>`))
+		case query["cors"] != nil:
+			w.WriteHeader(404)
+			w.Write([]byte(`<Error><Code>NoSuchCORSConfiguration</Code></Error>`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`<Error><Code>NoSuchLifecycleConfiguration</Code></Error>`))
+		}
+	})
+	settings, err := c.GetSettings("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://site.s3-website-eu-central-1.amazonaws.com"; settings.Website.Endpoint != want {
+		t.Errorf("Endpoint is %q, want %q", settings.Website.Endpoint, want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+func renderBuckets(c *gin.Context, status int, org *heroku.Team, message string) {
+	buckets, err := db.FindRegisteredBuckets(org.Id)
+	if err != nil {
+		c.String(500, "Error finding registered buckets: "+err.Error())
+		return
+	}
+	accounts, err := db.FindAccounts([]string{org.Id})
+	if err != nil {
+		c.String(500, "Error finding linked accounts: "+err.Error())
+		return
+	}
+	renderManagePage(c, status, "buckets.tmpl.html", gin.H{"org": org, "buckets": buckets, "accounts": accounts[org.Id], "message": message})
+}
+
+func setupBucketRoutes(manage *gin.RouterGroup) {
+
+	manage.GET("/orgs/:org_id/buckets", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed {
+			return
+		}
+		renderBuckets(c, http.StatusOK, org, "")
+	})
+
+	manage.POST("/orgs/:org_id/buckets", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		name := c.PostForm("bucketName")
+		_, registered, err := db.FindRegisteredBucket(org.Id, name)
+		if err != nil {
+			c.String(500, "Error registering bucket: "+err.Error())
+			return
+		}
+		if registered {
+			renderBuckets(c, 400, org, "Bucket "+name+" is already registered.")
+			return
+		}
+		accountId, _ := strconv.ParseInt(c.PostForm("accountId"), 10, 64)
+		account, err := db.FindAccount(org.Id, accountId)
+		if err != nil {
+			renderBuckets(c, 400, org, "Choose one of the team's linked AWS accounts.")
+			return
+		}
+		bc, err := bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
+		if err != nil {
+			c.String(500, "Error initializing bucket controller: "+err.Error())
+			return
+		}
+		if err := bc.VerifyBucketInAccount(name); err != nil {
+			renderBuckets(c, 400, org, err.Error())
+			return
+		}
+		err = db.SaveRegisteredBucket(&database.RegisteredBucket{
+			OwnerId:      org.Id,
+			AccountId:    account.Id,
+			BucketName:   name,
+			RegisteredBy: currentUserEmail(c),
+		})
+		if err != nil {
+			c.String(500, "Error registering bucket: "+err.Error())
+			return
+		}
+		c.Redirect(302, "/manage/orgs/"+org.Id+"/buckets")
+	})
+
+	// Unregistering only stops future adoption. Resources that already adopted the bucket keep it.
+	manage.POST("/orgs/:org_id/buckets/:bucket_name/unregister", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		err := db.DeleteRegisteredBucket(org.Id, c.Param("bucket_name"))
+		if err != nil {
+			c.String(500, "Error unregistering bucket: "+err.Error())
+			return
+		}
+		c.Redirect(302, "/manage/orgs/"+org.Id+"/buckets")
+	})
+}
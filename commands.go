@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+	"github.com/jesperfj/byodemo/heroku/fakeheroku"
+	"github.com/jesperfj/byodemo/secrets"
+)
+
+// Subcommands run instead of the web server, e.g. `byodemo migrate` in the release phase.
+func runCommand(name string, args []string) {
+	switch name {
+	case "migrate":
+		c := connectDatabase()
+		if err := c.Migrate(); err != nil {
+			logger.Fatal("Migration failed: ", err)
+		}
+	// Same thing under two names: rotating Fernet keys and moving to another secret store both
+	// re-encrypt whatever isn't encrypted with the current store and key.
+	case "rotate-keys", "migrate-secrets":
+		c := connectDatabase()
+		rewritten, err := c.ReencryptSecrets()
+		if err != nil {
+			logger.Fatal("Re-encryption stopped after ", rewritten, " secrets: ", err)
+		}
+		logger.Print("Re-encrypted ", rewritten, " secrets with ", secretBackend())
+	case "fake-heroku":
+		runFakeHeroku()
+	case "manifest":
+		runManifest(args)
+	case "subscribe-webhooks":
+		subscribeAllAppWebhooks()
+	// Prints a new Fernet key for COOKIE_SECRET or DATABASE_SECRET.
+	case "genkey":
+		fmt.Println(secrets.GenerateFernetKey())
+	case "api-tokens":
+		runAPITokens(args)
+	default:
+		logger.Fatal("Unknown command ", name, ". Run without arguments to start the web server.")
+	}
+	os.Exit(0)
+}
+
+// Commands only need the database settings, not the full web configuration.
+func connectDatabase() database.DbController {
+	current, previous := secretStores()
+	c, err := database.NewController(getRequiredenv("DATABASE_URL"), current, previous...)
+	if err != nil {
+		logger.Fatal("Error connecting to database: ", err)
+	}
+	return c
+}
+
+// fernet unless SECRET_BACKEND says otherwise.
+func secretBackend() string {
+	if backend := os.Getenv("SECRET_BACKEND"); backend != "" {
+		return backend
+	}
+	return secrets.FernetName
+}
+
+// The store named by SECRET_BACKEND encrypts. Every other store that is configured is only used
+// to decrypt secrets it encrypted before the backend was changed.
+//
+//	fernet: DATABASE_SECRET
+//	kms:    KMS_KEY_ID, and optionally KMS_REGION (us-east-1)
+//	vault:  VAULT_ADDR, VAULT_TOKEN and optionally VAULT_TRANSIT_KEY (byodemo)
+func secretStores() (current secrets.SecretStore, previous []secrets.SecretStore) {
+	configured := make(map[string]secrets.SecretStore)
+	if key := os.Getenv("DATABASE_SECRET"); key != "" {
+		store, err := secrets.NewFernetStore(key)
+		if err != nil {
+			logger.Fatal("DATABASE_SECRET must be a comma separated list of Fernet keys: ", err)
+		}
+		configured[secrets.FernetName] = store
+	}
+	if keyId := os.Getenv("KMS_KEY_ID"); keyId != "" {
+		store, err := secrets.NewKMSStore(getenvDefault("KMS_REGION", "us-east-1"), keyId)
+		if err != nil {
+			logger.Fatal("Error initializing KMS: ", err)
+		}
+		configured[secrets.KMSName] = store
+	}
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		configured[secrets.VaultName] = secrets.NewVaultStore(addr, getRequiredenv("VAULT_TOKEN"),
+			getenvDefault("VAULT_TRANSIT_KEY", "byodemo"))
+	}
+
+	backend := secretBackend()
+	current, ok := configured[backend]
+	if !ok {
+		logger.Fatal("SECRET_BACKEND is ", backend, " but it isn't configured. Use fernet, kms or vault and set its variables.")
+	}
+	for name, store := range configured {
+		if name != backend {
+			previous = append(previous, store)
+		}
+	}
+	return current, previous
+}
+
+// Serves a fake Heroku on FAKE_HEROKU_PORT (5001) for the add-on running on PORT (5000), with a
+// team app and a personal app to provision add-ons for. Start the add-on with HEROKU_API_URL and
+// HEROKU_ID_URL pointing at it.
+func runFakeHeroku() {
+	addonURL := getenvDefault("ADDON_URL", "http://localhost:"+getenvDefault("PORT", "5000"))
+	fake := fakeheroku.New()
+	fake.OAuthCallbackURL = addonURL + "/callback"
+	fake.AddonURL = addonURL + "/addon"
+	fake.AddonPassword = getRequiredenv("ADDON_PROVIDER_TOKEN")
+	fake.SSOSalt = getRequiredenv("HEROKU_SSO_SALT")
+	team := fake.AddTeam(getenvDefault("FAKE_HEROKU_TEAM", "local-team"), nil)
+	app := fake.AddApp(getenvDefault("FAKE_HEROKU_APP", "local-app"), team)
+	personal := fake.AddApp(getenvDefault("FAKE_HEROKU_PERSONAL_APP", "local-personal-app"), nil)
+	logger.Print("Fake Heroku has team ", team.Name, " (", team.Id, ") with app ", app.Name,
+		" and user ", fake.Account.Email, " (", fake.Account.Id, ") with app ", personal.Name)
+
+	port := getenvDefault("FAKE_HEROKU_PORT", "5001")
+	logger.Print("Fake Heroku listening on port ", port)
+	logger.Fatal(http.ListenAndServe(":"+port, fake))
+}
+
+// Subscribes to app webhooks for resources provisioned before the add-on did so itself. Meant to
+// be run once after upgrading.
+func subscribeAllAppWebhooks() {
+	config.webhookSecret = getRequiredenv("HEROKU_WEBHOOK_SECRET")
+	config.addonURL = getenvDefault("ADDON_URL", defaultAddonURL)
+	config.clientSecret = getRequiredenv("ADDON_PROVIDER_CLIENT_SECRET")
+	config.herokuAPIURL = getenvDefault("HEROKU_API_URL", heroku.DefaultAPIURL)
+	config.herokuIdURL = getenvDefault("HEROKU_ID_URL", heroku.DefaultIdURL)
+	c := connectDatabase()
+	db = &c
+
+	resources, err := db.FindActiveAddonResources()
+	if err != nil {
+		logger.Fatal("Error finding resources: ", err)
+	}
+	subscribed := 0
+	for i := range resources {
+		client, err := addonClient(resources[i].ProviderId)
+		if err != nil {
+			logger.Print("Skipping ", resources[i].ProviderId, ": ", err)
+			continue
+		}
+		if subscribeAppWebhook(client, &resources[i]) == nil {
+			subscribed++
+		}
+	}
+	logger.Print("Subscribed to app webhooks for ", subscribed, " of ", len(resources), " resources")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// The id of the AWS account a linked account's credentials belong to.
+func awsAccountId(account database.Account) (string, error) {
+	bc, err := bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
+	if err != nil {
+		return "", err
+	}
+	return bc.AWSAccountId()
+}
+
+// Checks that new credentials work and belong to the same AWS account as the current ones, and
+// with verify set, that they can still reach every resource provisioned with the account. When the
+// current credentials no longer work, the AWS accounts can't be compared and the resources are
+// always verified. The returned status is meant for the HTTP response when err is not nil.
+func checkNewCredentials(current database.Account, newKeyId string, newSecret string, verify bool) (status int, err error) {
+	newBc, err := bucket.NewController("us-east-1", newKeyId, newSecret)
+	if err != nil {
+		return 500, err
+	}
+	newAWSAccount, err := newBc.AWSAccountId()
+	if err != nil {
+		return 400, errors.New("AWS rejected the new credentials: " + err.Error())
+	}
+	currentAWSAccount, err := awsAccountId(current)
+	if err != nil {
+		// Probably revoked already, so there is nothing to compare with.
+		logger.Print("Couldn't find the AWS account of account ", current.Id, ". Verifying resource access instead: ", err)
+		verify = true
+	} else if currentAWSAccount != newAWSAccount {
+		return 400, errors.New("The new credentials belong to AWS account " + newAWSAccount +
+			", not " + currentAWSAccount + ". Link them as another account instead.")
+	}
+	if !verify {
+		return 200, nil
+	}
+	resources, err := db.FindAccountResources(current.Id)
+	if err != nil {
+		return 500, err
+	}
+	failed := make([]string, 0)
+	for _, r := range resources {
+		if err := newBc.VerifyResourceAccess(r.ProviderId, resourceBucketName(r.ProviderId, r.BucketName)); err != nil {
+			failed = append(failed, appLabel(database.ResourceUsage{AppName: r.AppName, AddonId: r.AddonId}))
+		}
+	}
+	if len(failed) > 0 {
+		return 400, errors.New("The new credentials can't manage the add-ons of " + strings.Join(failed, ", ") +
+			". Nothing was changed.")
+	}
+	return 200, nil
+}
+
+func renderCredentials(c *gin.Context, status int, org *heroku.Team, account database.Account, message string) {
+	history, err := db.FindAccountKeyHistory(account.Id)
+	if err != nil {
+		c.String(500, "Error finding key history: "+err.Error())
+		return
+	}
+	renderManagePage(c, status, "credentials.tmpl.html", gin.H{"org": org, "account": account, "history": history, "message": message})
+}
+
+func setupCredentialsRoutes(manage *gin.RouterGroup) {
+
+	manage.GET("/orgs/:org_id/accounts/:account_id/credentials", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		account, failed := getAndValidateAccount(c, org)
+		if failed {
+			return
+		}
+		renderCredentials(c, http.StatusOK, org, account, "")
+	})
+
+	manage.POST("/orgs/:org_id/accounts/:account_id/credentials", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		account, failed := getAndValidateAccount(c, org)
+		if failed {
+			return
+		}
+		newKeyId, newSecret := c.PostForm("awsAccessKeyId"), c.PostForm("awsSecretAccessKey")
+		actor := currentUserEmail(c)
+		status, err := checkNewCredentials(account, newKeyId, newSecret, c.PostForm("verify") == "on")
+		if err == nil {
+			updated := account
+			updated.AWSAccessKeyId, updated.AWSSecretAccessKey = newKeyId, newSecret
+			status, err = 500, db.UpdateAccountCredentials(&updated, actor)
+		}
+		recordAudit(actor, org.Id, "", auditUpdateCredentials, err)
+		if err != nil {
+			renderCredentials(c, status, org, account, err.Error())
+			return
+		}
+		c.Redirect(302, "/manage/orgs/")
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku/hgin"
+)
+
+const (
+	dashboardPageSize = 100
+	// How long a download link from the object browser works.
+	downloadLinkLifetime = 5 * time.Minute
+)
+
+// used to render the object browser. Paths are relative to the resource's prefix, so developers
+// on the shared plan only see their own objects.
+type DashboardEntry struct {
+	Name         string
+	Path         string
+	Size         string
+	LastModified string
+}
+
+// Looks up the resource the developer signed on to, with a controller for its account.
+func getDashboardResource(c *gin.Context) (addon database.AddonResource, bc bucket.BucketController, failed bool) {
+	addon, err := db.FindAddonResource(c.Param("addon_id"))
+	if err != nil {
+		c.String(404, "The add-on was not found. It may still be provisioning.")
+		return addon, bc, true
+	}
+	account, _, err := db.FindAccountForAddon(addon.ProviderId)
+	if err != nil {
+		c.String(500, "Error finding the add-on's AWS account: "+err.Error())
+		return addon, bc, true
+	}
+	bc, err = bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
+	if err != nil {
+		c.String(500, "Error initializing bucket controller: "+err.Error())
+		return addon, bc, true
+	}
+	return addon, bc, false
+}
+
+// Folder paths from the query end in / and never climb out of the resource's prefix.
+func dashboardFolder(c *gin.Context) string {
+	folder := strings.TrimLeft(c.Query("prefix"), "/")
+	if folder != "" && !strings.HasSuffix(folder, "/") {
+		folder += "/"
+	}
+	return folder
+}
+
+func parentFolder(folder string) string {
+	parent := path.Dir(strings.TrimSuffix(folder, "/"))
+	if parent == "." {
+		return ""
+	}
+	return parent + "/"
+}
+
+func renderDashboard(c *gin.Context, addon database.AddonResource, bc bucket.BucketController) {
+	bucketName := resourceBucketName(addon.ProviderId, addon.BucketName)
+	region, err := bc.Region(bucketName)
+	if err != nil {
+		region = "unknown"
+	}
+	var usage *AppUsage
+	apps, _, err := findAppUsage(addon.OwnerId)
+	if err != nil {
+		// Usage is informational. Render the page without it.
+		logger.Print("Error finding usage: ", err)
+	}
+	for _, a := range apps {
+		if a.ProviderId == addon.ProviderId {
+			usage = a
+		}
+	}
+
+	data := gin.H{
+		"addon":   addon,
+		"bucket":  bucketName,
+		"region":  region,
+		"usage":   usage,
+		"session": hgin.CurrentSSOSession(c),
+	}
+	if addon.MarkedForDeletion {
+		c.HTML(http.StatusOK, "dashboard.tmpl.html", data)
+		return
+	}
+
+	folder := dashboardFolder(c)
+	listing, err := bc.ListFolder(bucketName, addon.BucketPrefix+folder, c.Query("marker"), dashboardPageSize)
+	if err != nil {
+		data["message"] = "Error listing objects: " + err.Error()
+		c.HTML(502, "dashboard.tmpl.html", data)
+		return
+	}
+	subfolders := make([]DashboardEntry, len(listing.Subfolders))
+	for i, p := range listing.Subfolders {
+		rel := strings.TrimPrefix(p, addon.BucketPrefix)
+		subfolders[i] = DashboardEntry{Name: strings.TrimPrefix(rel, folder), Path: rel}
+	}
+	objects := make([]DashboardEntry, len(listing.Objects))
+	for i, obj := range listing.Objects {
+		rel := strings.TrimPrefix(obj.Key, addon.BucketPrefix)
+		objects[i] = DashboardEntry{
+			Name:         strings.TrimPrefix(rel, folder),
+			Path:         rel,
+			Size:         formatBytes(obj.Size),
+			LastModified: obj.LastModified.Format(time.RFC822),
+		}
+	}
+	data["folder"] = folder
+	data["parent"] = parentFolder(folder)
+	data["subfolders"] = subfolders
+	data["objects"] = objects
+	data["nextMarker"] = listing.NextMarker
+	c.HTML(http.StatusOK, "dashboard.tmpl.html", data)
+}
+
+func setupDashboardRoutes(router *gin.Engine) {
+
+	// Heroku posts here from the browser, so this isn't behind the add-on API's basic auth.
+	router.POST(addonSSOPath, hgin.HandleSSO(config.ssoSalt, config.cookieSecret, "/dashboard/",
+		func(resourceId string) string { return "/dashboard/" + resourceId + "/" }))
+
+	dashboard := router.Group("/dashboard/:addon_id", hgin.CheckSSO(config.cookieSecret, "addon_id"), hgin.CheckCSRF())
+
+	dashboard.GET("/", func(c *gin.Context) {
+		addon, bc, failed := getDashboardResource(c)
+		if failed {
+			return
+		}
+		renderDashboard(c, addon, bc)
+	})
+
+	dashboard.GET("/download", func(c *gin.Context) {
+		addon, bc, failed := getDashboardResource(c)
+		if failed {
+			return
+		}
+		key := strings.TrimLeft(c.Query("key"), "/")
+		if key == "" || strings.HasSuffix(key, "/") {
+			c.String(400, "key must name an object")
+			return
+		}
+		link, err := bc.DownloadURL(resourceBucketName(addon.ProviderId, addon.BucketName), addon.BucketPrefix+key, downloadLinkLifetime)
+		if err != nil {
+			c.String(502, "Error creating download link: "+err.Error())
+			return
+		}
+		c.Redirect(302, link)
+	})
+
+	addSettingsRoutes(dashboard, dashboard.Group("/api"), findDashboardSettings)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fernet/fernet-go"
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+	"github.com/jesperfj/byodemo/heroku/hgin"
+)
+
+// A router with just the dashboard, and the cookie header of a session signed on to addonId.
+func dashboardRouter(t *testing.T, addonId string) (router *gin.Engine, session http.Header) {
+	t.Helper()
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	previous := config
+	config.cookieSecret, config.ssoSalt = key.Encode(), "salt"
+	t.Cleanup(func() { config = previous })
+	router = gin.New()
+	setupDashboardRoutes(router)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	form := url.Values{"resource_id": {addonId}, "timestamp": {timestamp}, "email": {"dev@example.com"},
+		"resource_token": {heroku.SSOToken("salt", addonId, timestamp)}}
+	w := serve(router, "POST", addonSSOPath, []byte(form.Encode()),
+		http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+	cookie := w.Header().Get("Set-Cookie")
+	if w.Code != 302 || !strings.HasPrefix(cookie, hgin.SSOCookieName+"=") {
+		t.Fatalf("Signing on gave %d: %s", w.Code, w.Body)
+	}
+	return router, http.Header{"Cookie": {strings.SplitN(cookie, ";", 2)[0]}}
+}
+
+func TestDashboardSettingsAccess(t *testing.T) {
+	useMemoryStore(t)
+	account := database.Account{OwnerId: "team", Alias: "prod", AWSAccessKeyId: "AKIA", AWSSecretAccessKey: "secret"}
+	if err := db.SaveAccount(&account); err != nil {
+		t.Fatal(err)
+	}
+	// On the shared plan, so nothing reaches S3.
+	if err := db.SaveAddonResource(&database.AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1",
+		BucketName: "shared", BucketPrefix: "p1/", AccountId: account.Id}); err != nil {
+		t.Fatal(err)
+	}
+	router, session := dashboardRouter(t, "a1")
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	for k, v := range session {
+		form[k] = v
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"page without signing on", "GET", "/dashboard/a1/settings", nil, 401},
+		{"API without signing on", "GET", "/dashboard/a1/api/settings", nil, 401},
+		{"another add-on", "GET", "/dashboard/a2/settings", session, 401},
+		{"form without a CSRF token", "POST", "/dashboard/a1/settings/cors", form, 403},
+		{"page of a shared bucket", "GET", "/dashboard/a1/settings", session, 400},
+		{"API of a shared bucket", "PUT", "/dashboard/a1/api/settings/cors", session, 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := serve(router, test.method, test.path, []byte("rules=[]"), test.header); w.Code != test.status {
+				t.Errorf("Status is %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+	if events := findAudit(t, database.AuditFilter{OwnerId: "team"}); len(events) != 0 {
+		t.Errorf("Audit events are %+v", events)
+	}
+}
@@ -0,0 +1,356 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Alias given to an account linked without one, which is also how accounts linked before aliases
+// existed are named.
+const DefaultAccountAlias = "default"
+
+// An AWS account linked to a team. A team can link several, each under its own alias. The default
+// account is used for add-ons that don't pick one.
+type Account struct {
+	Id                 int64  `json:"id"`
+	OwnerId            string `json:"owner_id"`
+	Alias              string `json:"alias"`
+	IsDefault          bool   `json:"is_default"`
+	AWSAccessKeyId     string `json:"aws_access_key_id"`
+	AWSSecretAccessKey string `json:"aws_secret_access_key"`
+}
+
+// An access key that was replaced by updating an account's credentials.
+type AccountKeyChange struct {
+	AccountId      int64
+	AWSAccessKeyId string
+	ReplacedBy     string
+	ReplacedAt     time.Time
+}
+
+// Looks up one of the owner's accounts with its decrypted secret.
+// Detached accounts are never found.
+func (c *DbController) FindAccount(ownerId string, accountId int64) (Account, error) {
+	return c.findAccount(`WHERE owner_uuid = $1 AND id = $2 AND detached_at IS NULL`, ownerId, accountId)
+}
+
+func (c *DbController) FindDefaultAccount(ownerId string) (Account, error) {
+	return c.findAccount(`WHERE owner_uuid = $1 AND is_default AND detached_at IS NULL`, ownerId)
+}
+
+// found is false if the owner has no account with that alias.
+func (c *DbController) FindAccountByAlias(ownerId string, alias string) (account Account, found bool, err error) {
+	account, err = c.findAccount(`WHERE owner_uuid = $1 AND alias = $2 AND detached_at IS NULL`, ownerId, alias)
+	if err == errAccountNotFound {
+		return account, false, nil
+	}
+	return account, err == nil, err
+}
+
+var errAccountNotFound = errors.New("Account not found")
+
+func (c *DbController) findAccount(where string, args ...interface{}) (account Account, err error) {
+	var backend string
+	var encryptedSecret []byte
+	err = c.db.QueryRow(`
+		 SELECT id, owner_uuid, alias, is_default, aws_access_key_id, secret_backend, aws_secret_access_key_token
+		 FROM   accounts `+where, args...).Scan(
+		&account.Id, &account.OwnerId, &account.Alias, &account.IsDefault, &account.AWSAccessKeyId, &backend, &encryptedSecret)
+	if err == sql.ErrNoRows {
+		logger.Print("Account for ", args, " not found in database")
+		return account, errAccountNotFound
+	}
+	if err != nil {
+		logger.Print("Error querying database for account: ", err)
+		return account, err
+	}
+	account.AWSSecretAccessKey, err = c.decrypt(backend, encryptedSecret)
+	if err != nil {
+		logger.Print("Error decrypting secret for account ", account.Id, ": ", err)
+		return Account{}, err
+	}
+	return account, nil
+}
+
+// Linked accounts keyed by owner id, default first and then by alias. Owners without an account
+// are left out, and so are detached accounts. Secrets are not decrypted.
+func (c *DbController) FindAccounts(ownerIds []string) (map[string][]Account, error) {
+	owners, args := inList(ownerIds, 1)
+	rows, err := c.db.Query(`
+		 SELECT id, owner_uuid, alias, is_default, aws_access_key_id
+		 FROM   accounts
+		 WHERE  owner_uuid IN `+owners+`
+		   AND  detached_at IS NULL
+		 ORDER  BY is_default DESC, alias
+		`, args...)
+	if err != nil {
+		logger.Print("Error querying database for accounts: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]Account)
+	for rows.Next() {
+		var a Account
+		if err := rows.Scan(&a.Id, &a.OwnerId, &a.Alias, &a.IsDefault, &a.AWSAccessKeyId); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		result[a.OwnerId] = append(result[a.OwnerId], a)
+	}
+	return result, rows.Err()
+}
+
+// The resource and the account it was provisioned with.
+func (c *DbController) FindAccountForAddon(providerId string) (account Account, addon AddonResource, err error) {
+	rows, err := c.db.Query(`
+		 SELECT a.id, a.owner_uuid, a.alias, a.is_default, a.aws_access_key_id, a.secret_backend, a.aws_secret_access_key_token,
+		        `+addonResourceColumns+`
+		 FROM   accounts a, addon_resources ar
+		 WHERE  a.id = ar.account_id
+		   AND  ar.provider_resource_id = $1
+		`,
+		providerId)
+	if err != nil {
+		logger.Print("Error querying database for account: ", err)
+		return account, addon, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		logger.Print("Account for provider id ", providerId+" not found in database")
+		return account, addon, errAccountNotFound
+	}
+	var backend string
+	var encryptedSecret []byte
+	if err := rows.Scan(append(
+		[]interface{}{&account.Id, &account.OwnerId, &account.Alias, &account.IsDefault, &account.AWSAccessKeyId, &backend, &encryptedSecret},
+		addon.scanFields()...)...); err != nil {
+		logger.Print("Error reading database row: ", err)
+		return account, addon, err
+	}
+	account.AWSSecretAccessKey, err = c.decrypt(backend, encryptedSecret)
+	if err != nil {
+		logger.Print("Error decrypting secret for account ", account.Id, ": ", err)
+		return account, addon, err
+	}
+	return account, addon, nil
+}
+
+// Saves a newly linked account and sets its Id. An empty alias becomes DefaultAccountAlias. The
+// owner's first account becomes their default.
+func (c *DbController) SaveAccount(newAccount *Account) error {
+	if newAccount.Alias == "" {
+		newAccount.Alias = DefaultAccountAlias
+	}
+	backend, encrypted, err := c.encrypt(newAccount.AWSSecretAccessKey)
+	if err != nil {
+		logger.Print("Error encrypting secret access key: ", err)
+		return err
+	}
+	err = c.db.QueryRow(
+		`INSERT INTO accounts (owner_uuid, alias, is_default, aws_access_key_id, secret_backend, aws_secret_access_key_token)
+		 VALUES ($1, $2, NOT EXISTS (SELECT 1 FROM accounts WHERE owner_uuid = $1 AND detached_at IS NULL), $3, $4, $5)
+		 RETURNING id, is_default`,
+		newAccount.OwnerId, newAccount.Alias, newAccount.AWSAccessKeyId, backend, encrypted).Scan(&newAccount.Id, &newAccount.IsDefault)
+	if err != nil {
+		logger.Print("Error saving account: ", err)
+		return err
+	}
+	return nil
+}
+
+func (c *DbController) SetDefaultAccount(ownerId string, accountId int64) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Clear the old default first. At most one default per owner is enforced row by row.
+	if _, err := tx.Exec(`UPDATE accounts SET is_default = false WHERE owner_uuid = $1 AND is_default`, ownerId); err != nil {
+		logger.Print("Error clearing default account: ", err)
+		return err
+	}
+	result, err := tx.Exec(`UPDATE accounts SET is_default = true WHERE owner_uuid = $1 AND id = $2 AND detached_at IS NULL`,
+		ownerId, accountId)
+	if err != nil {
+		logger.Print("Error setting default account: ", err)
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
+		return errAccountNotFound
+	}
+	return tx.Commit()
+}
+
+// Deletes the account along with the buckets registered in it and its shared bucket record.
+// Callers must make sure no resources still need it. Deleting the default account makes the
+// owner's oldest remaining account the default.
+func (c *DbController) DeleteAccount(ownerId string, accountId int64) error {
+	return c.removeAccount(ownerId, accountId,
+		`DELETE FROM accounts WHERE owner_uuid = $1 AND id = $2`)
+}
+
+// Unlinks the account but keeps its credentials so the resources still using it can be
+// deprovisioned later. PurgeDetachedAccount deletes it once they are gone.
+func (c *DbController) DetachAccount(ownerId string, accountId int64) error {
+	return c.removeAccount(ownerId, accountId,
+		`UPDATE accounts SET detached_at = CURRENT_TIMESTAMP, is_default = false WHERE owner_uuid = $1 AND id = $2 AND detached_at IS NULL`)
+}
+
+func (c *DbController) removeAccount(ownerId string, accountId int64, statement string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(statement, ownerId, accountId)
+	if err != nil {
+		logger.Print("Error removing account: ", err)
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
+		logger.Print("While removing account ", accountId, " for owner id ", ownerId, ", ", rowsAffected, " was affected. 1 row was expected.")
+	}
+	// New resources can't use the account any more, so neither can buckets registered in it.
+	if _, err := tx.Exec(`DELETE FROM registered_buckets WHERE account_id = $1`, accountId); err != nil {
+		logger.Print("Error deleting registered buckets: ", err)
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM shared_buckets WHERE account_id = $1`, accountId); err != nil {
+		logger.Print("Error deleting shared bucket: ", err)
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE accounts SET is_default = true
+		WHERE  id = (SELECT min(id) FROM accounts WHERE owner_uuid = $1 AND detached_at IS NULL)
+		  AND  NOT EXISTS (SELECT 1 FROM accounts WHERE owner_uuid = $1 AND is_default)`, ownerId)
+	if err != nil {
+		logger.Print("Error choosing new default account: ", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Print("Error committing account removal: ", err)
+		return err
+	}
+	return nil
+}
+
+// Deletes a detached account once none of its resources are left. Does nothing for linked
+// accounts or while resources remain.
+func (c *DbController) PurgeDetachedAccount(accountId int64) error {
+	_, err := c.db.Exec(`
+		DELETE FROM accounts
+		WHERE  id = $1
+		  AND  detached_at IS NOT NULL
+		  AND  NOT EXISTS (SELECT 1 FROM addon_resources WHERE account_id = $1 AND deleted_at IS NULL)`, accountId)
+	if err != nil {
+		logger.Print("Error purging detached account: ", err)
+		return err
+	}
+	return nil
+}
+
+// Moves the resources, registered buckets and shared bucket of one linked account to another.
+// Both must be the owner's and belong to the same AWS account. If the target already has a shared
+// bucket, resources keep using the old one but new ones go to the target's.
+func (c *DbController) TransferAccountResources(ownerId string, fromAccountId int64, toAccountId int64) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	err = tx.QueryRow(`SELECT count(*) FROM accounts WHERE owner_uuid = $1 AND id IN ($2, $3) AND detached_at IS NULL`,
+		ownerId, fromAccountId, toAccountId).Scan(&count)
+	if err != nil {
+		logger.Print("Error querying database for accounts: ", err)
+		return err
+	}
+	if count != 2 || fromAccountId == toAccountId {
+		return errAccountNotFound
+	}
+	for _, statement := range []string{
+		`UPDATE addon_resources SET account_id = $2 WHERE account_id = $1 AND deleted_at IS NULL`,
+		`UPDATE registered_buckets SET account_id = $2 WHERE account_id = $1`,
+		`UPDATE shared_buckets SET account_id = $2 WHERE account_id = $1
+		   AND NOT EXISTS (SELECT 1 FROM shared_buckets WHERE account_id = $2)`,
+		`DELETE FROM shared_buckets WHERE account_id = $1`,
+	} {
+		if _, err := tx.Exec(statement, fromAccountId, toAccountId); err != nil {
+			logger.Print("Error transferring resources: ", err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Print("Error committing resource transfer: ", err)
+		return err
+	}
+	return nil
+}
+
+// Replaces the access key of an existing account in place and records the key it replaced.
+// account must have Id, OwnerId and the new key set.
+func (c *DbController) UpdateAccountCredentials(account *Account, replacedBy string) error {
+	backend, encrypted, err := c.encrypt(account.AWSSecretAccessKey)
+	if err != nil {
+		logger.Print("Error encrypting secret access key: ", err)
+		return err
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var oldKeyId string
+	err = tx.QueryRow(`SELECT aws_access_key_id FROM accounts WHERE owner_uuid = $1 AND id = $2 AND detached_at IS NULL`+c.dialect.forUpdate,
+		account.OwnerId, account.Id).Scan(&oldKeyId)
+	if err == sql.ErrNoRows {
+		return errAccountNotFound
+	}
+	if err != nil {
+		logger.Print("Error querying database for account: ", err)
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO account_key_history (account_id, aws_access_key_id, replaced_by) VALUES ($1,$2,$3)`,
+		account.Id, oldKeyId, replacedBy)
+	if err != nil {
+		logger.Print("Error saving account key history: ", err)
+		return err
+	}
+	_, err = tx.Exec(`UPDATE accounts SET aws_access_key_id = $2, secret_backend = $3, aws_secret_access_key_token = $4 WHERE id = $1`,
+		account.Id, account.AWSAccessKeyId, backend, encrypted)
+	if err != nil {
+		logger.Print("Error updating account credentials: ", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Print("Error committing account credentials: ", err)
+		return err
+	}
+	return nil
+}
+
+// Keys the account used before, most recently replaced first.
+func (c *DbController) FindAccountKeyHistory(accountId int64) ([]AccountKeyChange, error) {
+	rows, err := c.db.Query(`
+		 SELECT account_id, aws_access_key_id, replaced_by, replaced_at
+		 FROM   account_key_history
+		 WHERE  account_id = $1
+		 ORDER  BY replaced_at DESC, id DESC
+		`, accountId)
+	if err != nil {
+		logger.Print("Error querying database for account key history: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]AccountKeyChange, 0)
+	for rows.Next() {
+		var ch AccountKeyChange
+		if err := rows.Scan(&ch.AccountId, &ch.AWSAccessKeyId, &ch.ReplacedBy, &ch.ReplacedAt); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		result = append(result, ch)
+	}
+	return result, rows.Err()
+}
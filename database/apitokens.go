@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// What an operator API token may do.
+const (
+	ScopeAccountsRead  = "accounts:read"
+	ScopeAccountsWrite = "accounts:write"
+)
+
+var APITokenScopes = []string{ScopeAccountsRead, ScopeAccountsWrite}
+
+// A token for the operator API. Only a hash of the token is stored. It's shown once when created.
+type APIToken struct {
+	Id        int64
+	Name      string
+	TokenHash string
+	Scopes    []string
+	CreatedAt time.Time
+	// Zero if the token was never used.
+	LastUsedAt time.Time
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DbController) SaveAPIToken(token *APIToken) error {
+	token.CreatedAt = time.Now().UTC()
+	err := c.db.QueryRow(
+		`INSERT INTO api_tokens (name, token_hash, scopes, created_at) VALUES ($1, $2, $3, $4) RETURNING id`,
+		token.Name, token.TokenHash, strings.Join(token.Scopes, " "), token.CreatedAt).Scan(&token.Id)
+	if err != nil {
+		logger.Print("Error saving API token: ", err)
+	}
+	return err
+}
+
+func (c *DbController) FindAPIToken(tokenHash string) (token APIToken, found bool, err error) {
+	tokens, err := c.findAPITokens(`WHERE token_hash = $1`, tokenHash)
+	if err != nil || len(tokens) == 0 {
+		return token, false, err
+	}
+	return tokens[0], true, nil
+}
+
+// All tokens, by name.
+func (c *DbController) FindAPITokens() ([]APIToken, error) {
+	return c.findAPITokens(`ORDER BY name`)
+}
+
+func (c *DbController) findAPITokens(where string, args ...interface{}) ([]APIToken, error) {
+	rows, err := c.db.Query(`SELECT id, name, token_hash, scopes, created_at, last_used_at FROM api_tokens `+where, args...)
+	if err != nil {
+		logger.Print("Error querying database for API tokens: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&t.Id, &t.Name, &t.TokenHash, &scopes, &t.CreatedAt, &lastUsed); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		t.Scopes, t.LastUsedAt = strings.Fields(scopes), lastUsed.Time
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (c *DbController) TouchAPIToken(id int64, lastUsedAt time.Time) error {
+	_, err := c.db.Exec(`UPDATE api_tokens SET last_used_at = $2 WHERE id = $1`, id, lastUsedAt.UTC())
+	if err != nil {
+		logger.Print("Error updating API token: ", err)
+	}
+	return err
+}
+
+// Revokes the token with the name. found is false if there's no such token.
+func (c *DbController) DeleteAPIToken(name string) (found bool, err error) {
+	res, err := c.db.Exec(`DELETE FROM api_tokens WHERE name = $1`, name)
+	if err != nil {
+		logger.Print("Error deleting API token: ", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
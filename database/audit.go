@@ -0,0 +1,89 @@
+package database
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+type AuditEvent struct {
+	Id         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// Email of the Heroku user, or "heroku-platform" for add-on API calls.
+	Actor string `json:"actor"`
+	// Team the event concerns. Empty if it wasn't known, e.g. provisioning that failed early.
+	OwnerId    string `json:"owner_id"`
+	ResourceId string `json:"resource_id"`
+	Action     string `json:"action"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Empty fields match everything.
+type AuditFilter struct {
+	OwnerId    string
+	ResourceId string
+	Action     string
+	Outcome    string
+	Limit      int
+}
+
+func (c *DbController) SaveAuditEvent(event *AuditEvent) error {
+	_, err := c.db.Exec(
+		`INSERT INTO audit_events (actor, owner_uuid, resource_id, action, outcome, error)
+		 VALUES ($1,$2,$3,$4,$5,$6)`,
+		event.Actor, event.OwnerId, event.ResourceId, event.Action, event.Outcome, event.Error)
+	if err != nil {
+		logger.Print("Error saving audit event: ", err)
+		return err
+	}
+	return nil
+}
+
+// Newest first.
+func (c *DbController) FindAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	query := `
+		 SELECT id, occurred_at, actor, coalesce(owner_uuid, ''), coalesce(resource_id, ''),
+		        action, outcome, coalesce(error, '')
+		 FROM   audit_events
+		 WHERE  true`
+	args := make([]interface{}, 0)
+	for _, f := range []struct{ column, value string }{
+		{"owner_uuid", filter.OwnerId},
+		{"resource_id", filter.ResourceId},
+		{"action", filter.Action},
+		{"outcome", filter.Outcome},
+	} {
+		if f.value != "" {
+			args = append(args, f.value)
+			query += " AND " + f.column + " = $" + strconv.Itoa(len(args))
+		}
+	}
+	query += " ORDER BY occurred_at DESC, id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		logger.Print("Error querying database for audit events: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]AuditEvent, 0)
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.Id, &e.OccurredAt, &e.Actor, &e.OwnerId, &e.ResourceId,
+			&e.Action, &e.Outcome, &e.Error); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
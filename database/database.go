@@ -4,40 +4,108 @@ import (
 	"errors"
 	"log"
 	"os"
+	"time"
 
 	"database/sql"
-	// Need to import pq as "pq" because we're using a pq specific feature below
-	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 
-	fernet "github.com/fernet/fernet-go"
+	"github.com/jesperfj/byodemo/secrets"
 )
 
 type DbController struct {
-	db        *sql.DB
-	fernetKey *fernet.Key
-}
-
-type Account struct {
-	OwnerId            string `json:"owner_id"`
-	AWSAccessKeyId     string `json:"aws_access_key_id"`
-	AWSSecretAccessKey string `json:"aws_secret_access_key"`
+	db      *sql.DB
+	dialect dialect
+	// Encrypts new secrets.
+	secrets secrets.SecretStore
+	// Decrypt stored secrets, keyed by name. Includes secrets.
+	secretStores map[string]secrets.SecretStore
 }
 
 type AddonResource struct {
 	OwnerId        string
 	ProviderId     string
 	AddonId        string
+	AppId          string
+	AppName        string
 	AWSAccessKeyId string
+	// Empty for resources created before bucket names were recorded.
+	BucketName string
+	// Adopted buckets were registered by the team, not created by the add-on, and are
+	// never deleted by it.
+	Adopted bool
+	// Set for resources on the shared plan. They only own the objects under this prefix.
+	BucketPrefix string
+	Plan         string
+	// The linked account the resource was provisioned with. Deprovisioning uses its credentials.
+	AccountId int64
+	// Heroku has deprovisioned the add-on but its AWS resources may not be deleted yet.
+	MarkedForDeletion bool
+	// Team or user the resource's app moved to while the resource stayed with OwnerId.
+	MovedToOwnerId string
+}
+
+// A bucket that already existed in a team's AWS account and which the team has registered so
+// developers can adopt it as an add-on resource.
+type RegisteredBucket struct {
+	OwnerId    string
+	AccountId  int64
+	BucketName string
+	// Alias of the account the bucket is in, for display. Empty if the account has been unlinked.
+	AccountAlias string
+	RegisteredBy string
+	RegisteredAt time.Time
+}
+
+// One usage sample for a resource, as collected by the usage collector.
+type BucketUsage struct {
+	ProviderId  string
+	ObjectCount int64
+	TotalBytes  int64
+	CollectedAt time.Time
+}
+
+// A change made to a bucket's settings through the management UI or API. Document is the JSON
+// of the new settings as submitted.
+type SettingsChange struct {
+	ProviderId string
+	Actor      string
+	Setting    string
+	Document   string
+	ChangedAt  time.Time
 }
 
+// Usage sample joined with the resource it belongs to. Used for the usage pages and CSV export.
+type ResourceUsage struct {
+	OwnerId      string
+	AddonId      string
+	AppId        string
+	AppName      string
+	BucketName   string
+	BucketPrefix string
+	// Set if the app moved to another team while the resource stayed.
+	MovedToOwnerId string
+	BucketUsage
+}
+
+const (
+	// Columns read into an AddonResource by scanFields. Expects addon_resources to be aliased ar.
+	addonResourceColumns = `ar.owner_uuid, ar.provider_resource_id, ar.heroku_resource_id,
+		coalesce(ar.app_id, ''), coalesce(ar.app_name, ''), ar.aws_access_key_id,
+		coalesce(ar.bucket_name, ''), coalesce(ar.adopted, false),
+		coalesce(ar.bucket_prefix, ''), coalesce(ar.plan, ''), coalesce(ar.account_id, 0),
+		coalesce(ar.mark_for_deletion, false), coalesce(ar.moved_to_owner_uuid, '')`
+)
+
 var (
 	logger = log.New(os.Stderr, "[db] ", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
-func NewController(creds string, secret string) (DbController, error) {
+// Connects to the Postgres or SQLite database named by url. See openDatabase. New secrets are
+// encrypted with current. Stored secrets can be decrypted with current or any of previous, which
+// lets secrets move from one store to another. See keys.go.
+func NewController(url string, current secrets.SecretStore, previous ...secrets.SecretStore) (DbController, error) {
 	c := DbController{}
-	db, err := sql.Open("postgres", creds)
+	db, dialect, err := openDatabase(url)
 	if err != nil {
 		return c, err
 	}
@@ -46,165 +114,391 @@ func NewController(creds string, secret string) (DbController, error) {
 		return c, err
 	}
 	c.db = db
+	c.dialect = dialect
 
-	key, err := fernet.DecodeKey(secret)
-	if err != nil {
-		logger.Print("Couldn't parse secret key. Is it a correctly formatted fernet key? Error: ", err)
-		return c, err
+	c.secrets = current
+	c.secretStores = map[string]secrets.SecretStore{current.Name(): current}
+	for _, s := range previous {
+		if _, ok := c.secretStores[s.Name()]; !ok {
+			c.secretStores[s.Name()] = s
+		}
 	}
-	c.fernetKey = key
 
-	logger.Print("Successfully connected to database")
+	logger.Print("Successfully connected to ", dialect.name, " database. Encrypting secrets with ", current.Name())
 	return c, nil
 }
 
-func GenerateEncodedKey() string {
-	key := fernet.Key{}
-	key.Generate()
-	return key.Encode()
+func (r *AddonResource) scanFields() []interface{} {
+	return []interface{}{&r.OwnerId, &r.ProviderId, &r.AddonId, &r.AppId, &r.AppName,
+		&r.AWSAccessKeyId, &r.BucketName, &r.Adopted, &r.BucketPrefix, &r.Plan, &r.AccountId,
+		&r.MarkedForDeletion, &r.MovedToOwnerId}
+}
+
+// Looks up a resource that hasn't been deleted by its Heroku add-on id.
+func (c *DbController) FindAddonResource(addonId string) (addon AddonResource, err error) {
+	err = c.db.QueryRow(`
+		 SELECT `+addonResourceColumns+`
+		 FROM   addon_resources ar
+		 WHERE  ar.heroku_resource_id = $1
+		   AND  ar.deleted_at IS NULL
+		`, addonId).Scan(addon.scanFields()...)
+	if err == sql.ErrNoRows {
+		logger.Print("Resource for add-on ", addonId, " not found in database")
+		return addon, errors.New("Resource not found")
+	}
+	if err != nil {
+		logger.Print("Error querying database for resource: ", err)
+		return addon, err
+	}
+	return addon, nil
+}
+
+func (c *DbController) SaveAddonResource(newAddonResource *AddonResource) error {
+	_, err := c.db.Exec(
+		`INSERT INTO addon_resources (owner_uuid, provider_resource_id, heroku_resource_id, app_id, app_name,
+		                              aws_access_key_id, bucket_name, adopted, bucket_prefix, plan, account_id)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`,
+		newAddonResource.OwnerId, newAddonResource.ProviderId, newAddonResource.AddonId,
+		newAddonResource.AppId, newAddonResource.AppName, newAddonResource.AWSAccessKeyId,
+		newAddonResource.BucketName, newAddonResource.Adopted, newAddonResource.BucketPrefix,
+		newAddonResource.Plan, newAddonResource.AccountId)
+	if err != nil {
+		logger.Print("Error saving addon resource: ", err)
+		return err
+	}
+	return nil
+}
+
+func (c *DbController) MarkResourceForDeletion(providerId string) error {
+	result, err := c.db.Exec(
+		"UPDATE addon_resources SET mark_for_deletion=true WHERE provider_resource_id = $1",
+		providerId)
+	if err != nil {
+		logger.Print("Error marking resource deleted : ", err)
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
+		logger.Print("While marking resource ", providerId, " for deletion, ", rowsAffected, " was affected. 1 row was expected.")
+	}
+	return nil
+}
+
+func (c *DbController) SetDeleted(providerId string) error {
+	result, err := c.db.Exec(
+		"UPDATE addon_resources SET deleted_at=CURRENT_TIMESTAMP WHERE provider_resource_id = $1",
+		providerId)
+	if err != nil {
+		logger.Print("Error updating resource as deleted : ", err)
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
+		logger.Print("While updating resource ", providerId, " as deleted, ", rowsAffected, " was affected. 1 row was expected.")
+	}
+	return nil
+}
+
+// Resources that are provisioned and not on their way out.
+func (c *DbController) FindActiveAddonResources() ([]AddonResource, error) {
+	return c.findAddonResources(`
+		 SELECT ` + addonResourceColumns + `
+		 FROM   addon_resources ar
+		 WHERE  ar.deleted_at IS NULL
+		   AND  NOT ar.mark_for_deletion
+		`)
 }
 
-// TODO: This and function below needs to be deduped a bit
-func (c *DbController) FindAccount(ownerUuid string) (Account, error) {
-	rows, err := c.db.Query("SELECT owner_uuid, aws_access_key_id, aws_secret_access_key_token FROM accounts WHERE owner_uuid = $1", ownerUuid)
+func (c *DbController) findAddonResources(query string, args ...interface{}) ([]AddonResource, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
-		logger.Print("Error querying database for account: ", err)
-		return Account{}, err
+		logger.Print("Error querying database for active resources: ", err)
+		return nil, err
 	}
 	defer rows.Close()
-	if !rows.Next() {
-		logger.Print("Account for ", ownerUuid+" not found in database")
-		return Account{}, errors.New("Account not found")
-	}
-	var uuid string
-	var key string
-	var encryptedSecret []byte
-	if err := rows.Scan(&uuid, &key, &encryptedSecret); err != nil {
-		log.Print("Error reading database row: ", err)
-		return Account{}, err
-	}
-	decryptedSecret := fernet.VerifyAndDecrypt(encryptedSecret, -1, []*fernet.Key{c.fernetKey})
-	return Account{
-		OwnerId:            uuid,
-		AWSAccessKeyId:     key,
-		AWSSecretAccessKey: string(decryptedSecret),
-	}, nil
-}
-
-func (c *DbController) FindAccounts(ownerIds []string) map[string]string {
-	rows, _ := c.db.Query(`
-		 SELECT owner_uuid, aws_access_key_id
-		 FROM   accounts
-		 WHERE  owner_uuid = ANY($1)
-		`, pq.Array(ownerIds))
+	result := make([]AddonResource, 0)
+	for rows.Next() {
+		var r AddonResource
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// Resources provisioned with the account that haven't been deleted, including any that are being
+// deprovisioned. All of them need the account's credentials.
+func (c *DbController) FindAccountResources(accountId int64) ([]AddonResource, error) {
+	return c.findAddonResources(`
+		 SELECT `+addonResourceColumns+`
+		 FROM   addon_resources ar
+		 WHERE  ar.account_id = $1
+		   AND  ar.deleted_at IS NULL
+		 ORDER  BY ar.app_name
+		`, accountId)
+}
+
+func (c *DbController) SaveBucketUsage(usage *BucketUsage) error {
+	_, err := c.db.Exec(
+		`INSERT INTO bucket_usage (provider_resource_id, object_count, total_bytes, collected_at)
+		 VALUES ($1,$2,$3,$4)`,
+		usage.ProviderId, usage.ObjectCount, usage.TotalBytes, usage.CollectedAt)
+	if err != nil {
+		logger.Print("Error saving bucket usage: ", err)
+		return err
+	}
+	return nil
+}
+
+// Claims the usage collection run starting now unless another process started one within
+// interval. The upsert only changes the row when the last run is old enough, so at most one
+// process claims each run.
+func (c *DbController) ClaimUsageCollection(now time.Time, interval time.Duration) (claimed bool, err error) {
+	res, err := c.db.Exec(`
+		INSERT INTO usage_collection_runs (id, started_at) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE
+		SET    started_at = excluded.started_at
+		WHERE  usage_collection_runs.started_at <= $2`,
+		now.UTC(), now.UTC().Add(-interval))
+	if err != nil {
+		logger.Print("Error claiming usage collection: ", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Most recent usage sample for every active resource owned by one of ownerIds. Resources that
+// haven't been measured yet are included with zero usage and a zero CollectedAt.
+func (c *DbController) FindLatestUsage(ownerIds []string) ([]ResourceUsage, error) {
+	owners, args := inList(ownerIds, 1)
+	return c.findUsage(`
+		 SELECT ar.owner_uuid, ar.heroku_resource_id, coalesce(ar.app_id, ''), coalesce(ar.app_name, ''),
+		        coalesce(ar.bucket_name, ''), coalesce(ar.bucket_prefix, ''), coalesce(ar.moved_to_owner_uuid, ''),
+		        ar.provider_resource_id, coalesce(bu.object_count, 0), coalesce(bu.total_bytes, 0), bu.collected_at
+		 FROM   addon_resources ar
+		 LEFT   JOIN bucket_usage bu
+		        ON bu.id = (SELECT   id
+		                    FROM     bucket_usage
+		                    WHERE    provider_resource_id = ar.provider_resource_id
+		                    ORDER BY collected_at DESC, id DESC
+		                    LIMIT    1)
+		 WHERE  ar.deleted_at IS NULL
+		   AND  NOT ar.mark_for_deletion
+		   AND  ar.owner_uuid IN `+owners+`
+		 ORDER  BY ar.app_name
+		`, args...)
+}
+
+// All usage samples collected since the given time for resources owned by ownerId, oldest first.
+// Includes samples for resources that have since been deleted so chargeback covers the whole period.
+func (c *DbController) FindUsageHistory(ownerId string, since time.Time) ([]ResourceUsage, error) {
+	return c.findUsage(`
+		 SELECT ar.owner_uuid, ar.heroku_resource_id, coalesce(ar.app_id, ''), coalesce(ar.app_name, ''),
+		        coalesce(ar.bucket_name, ''), coalesce(ar.bucket_prefix, ''), coalesce(ar.moved_to_owner_uuid, ''),
+		        bu.provider_resource_id, bu.object_count, bu.total_bytes, bu.collected_at
+		 FROM   bucket_usage bu, addon_resources ar
+		 WHERE  bu.provider_resource_id = ar.provider_resource_id
+		   AND  ar.owner_uuid = $1
+		   AND  bu.collected_at >= $2
+		 ORDER  BY bu.collected_at, ar.app_name
+		`, ownerId, since)
+}
+
+func (c *DbController) findUsage(query string, args ...interface{}) ([]ResourceUsage, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		logger.Print("Error querying database for bucket usage: ", err)
+		return nil, err
+	}
 	defer rows.Close()
-	result := make(map[string]string)
+	result := make([]ResourceUsage, 0)
 	for rows.Next() {
-		var owner string
-		var key string
-		rows.Scan(&owner, &key)
-		result[owner] = key
+		var u ResourceUsage
+		var collectedAt *time.Time
+		if err := rows.Scan(&u.OwnerId, &u.AddonId, &u.AppId, &u.AppName, &u.BucketName, &u.BucketPrefix,
+			&u.MovedToOwnerId, &u.ProviderId, &u.ObjectCount, &u.TotalBytes, &collectedAt); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		if collectedAt != nil {
+			u.CollectedAt = *collectedAt
+		}
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+func (c *DbController) SaveSettingsChange(change *SettingsChange) error {
+	_, err := c.db.Exec(
+		`INSERT INTO bucket_settings_changes (provider_resource_id, actor, setting, document)
+		 VALUES ($1,$2,$3,$4)`,
+		change.ProviderId, change.Actor, change.Setting, change.Document)
+	if err != nil {
+		logger.Print("Error saving settings change: ", err)
+		return err
 	}
-	return result
+	return nil
 }
 
-func (c *DbController) FindAccountForAddon(providerId string) (account Account, addon AddonResource, err error) {
+// Most recent settings changes for a resource, newest first.
+func (c *DbController) FindSettingsChanges(providerId string, limit int) ([]SettingsChange, error) {
 	rows, err := c.db.Query(`
-		 SELECT a.owner_uuid, a.aws_access_key_id, a.aws_secret_access_key_token,
-		        ar.owner_uuid, ar.provider_resource_id, ar.heroku_resource_id, ar.aws_access_key_id
-		 FROM   accounts a, addon_resources ar 
-		 WHERE  a.owner_uuid = ar.owner_uuid
-		   AND  ar.provider_resource_id = $1
-		`,
-		providerId)
+		 SELECT provider_resource_id, actor, setting, document, changed_at
+		 FROM   bucket_settings_changes
+		 WHERE  provider_resource_id = $1
+		 ORDER  BY changed_at DESC
+		 LIMIT  $2
+		`, providerId, limit)
 	if err != nil {
-		logger.Print("Error querying database for account: ", err)
-		return account, addon, err
+		logger.Print("Error querying database for settings changes: ", err)
+		return nil, err
 	}
 	defer rows.Close()
-	if !rows.Next() {
-		logger.Print("Account for provider id ", providerId+" not found in database")
-		return account, addon, errors.New("Account not found")
-	}
-	//var uuid string
-	//var key string
-	var encryptedSecret []byte
-	if err := rows.Scan(
-		&account.OwnerId, &account.AWSAccessKeyId, &encryptedSecret,
-		&addon.OwnerId, &addon.ProviderId, &addon.AddonId, &addon.AWSAccessKeyId); err != nil {
-		log.Print("Error reading database row: ", err)
-		return account, addon, err
+	result := make([]SettingsChange, 0)
+	for rows.Next() {
+		var ch SettingsChange
+		if err := rows.Scan(&ch.ProviderId, &ch.Actor, &ch.Setting, &ch.Document, &ch.ChangedAt); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		result = append(result, ch)
 	}
-	account.AWSSecretAccessKey = string(fernet.VerifyAndDecrypt(encryptedSecret, -1, []*fernet.Key{c.fernetKey}))
-	return account, addon, nil
+	return result, rows.Err()
 }
 
-func (c *DbController) SaveAddonResource(newAddonResource *AddonResource) error {
+func (c *DbController) SaveRegisteredBucket(registered *RegisteredBucket) error {
 	_, err := c.db.Exec(
-		`INSERT INTO addon_resources (owner_uuid, provider_resource_id, heroku_resource_id, aws_access_key_id) 
+		`INSERT INTO registered_buckets (owner_uuid, account_id, bucket_name, registered_by)
 		 VALUES ($1,$2,$3,$4)`,
-		newAddonResource.OwnerId, newAddonResource.ProviderId, newAddonResource.AddonId, newAddonResource.AWSAccessKeyId)
+		registered.OwnerId, registered.AccountId, registered.BucketName, registered.RegisteredBy)
 	if err != nil {
-		logger.Print("Error saving addon resource: ", err)
+		logger.Print("Error saving registered bucket: ", err)
 		return err
 	}
 	return nil
 }
 
-func (c *DbController) SaveAccount(newAccount *Account) error {
-	encrypted, err := fernet.EncryptAndSign([]byte(newAccount.AWSSecretAccessKey), c.fernetKey)
+func (c *DbController) FindRegisteredBuckets(ownerId string) ([]RegisteredBucket, error) {
+	rows, err := c.db.Query(`
+		 SELECT rb.owner_uuid, coalesce(rb.account_id, 0), rb.bucket_name, coalesce(a.alias, ''),
+		        rb.registered_by, rb.registered_at
+		 FROM   registered_buckets rb
+		 LEFT   JOIN accounts a ON a.id = rb.account_id
+		 WHERE  rb.owner_uuid = $1
+		 ORDER  BY rb.bucket_name
+		`, ownerId)
 	if err != nil {
-		logger.Print("Error encrypting secret access key: ", err)
-		return err
+		logger.Print("Error querying database for registered buckets: ", err)
+		return nil, err
 	}
-	_, err = c.db.Exec(
-		`INSERT INTO accounts (owner_uuid, aws_access_key_id, aws_secret_access_key_token)
-		 VALUES ($1,$2,$3)`,
-		newAccount.OwnerId, newAccount.AWSAccessKeyId, encrypted)
+	defer rows.Close()
+	result := make([]RegisteredBucket, 0)
+	for rows.Next() {
+		var r RegisteredBucket
+		if err := rows.Scan(&r.OwnerId, &r.AccountId, &r.BucketName, &r.AccountAlias,
+			&r.RegisteredBy, &r.RegisteredAt); err != nil {
+			logger.Print("Error reading database row: ", err)
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// found is false if the owner hasn't registered the bucket.
+func (c *DbController) FindRegisteredBucket(ownerId string, bucketName string) (registered RegisteredBucket, found bool, err error) {
+	err = c.db.QueryRow(`
+		 SELECT owner_uuid, coalesce(account_id, 0), bucket_name, registered_by, registered_at
+		 FROM   registered_buckets
+		 WHERE  owner_uuid = $1 AND bucket_name = $2
+		`, ownerId, bucketName).Scan(
+		&registered.OwnerId, &registered.AccountId, &registered.BucketName, &registered.RegisteredBy, &registered.RegisteredAt)
+	if err == sql.ErrNoRows {
+		return registered, false, nil
+	}
+	if err != nil {
+		logger.Print("Error querying database for registered bucket: ", err)
+		return registered, false, err
+	}
+	return registered, true, nil
+}
+
+// The bucket shared by all resources on the shared plan that use the account. found is false until
+// the first such resource has been provisioned.
+func (c *DbController) FindSharedBucket(accountId int64) (bucketName string, found bool, err error) {
+	err = c.db.QueryRow(
+		`SELECT bucket_name FROM shared_buckets WHERE account_id = $1`, accountId).Scan(&bucketName)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		logger.Print("Error querying database for shared bucket: ", err)
+		return "", false, err
+	}
+	return bucketName, true, nil
+}
+
+func (c *DbController) SaveSharedBucket(ownerId string, accountId int64, bucketName string) error {
+	_, err := c.db.Exec(
+		`INSERT INTO shared_buckets (owner_uuid, account_id, bucket_name) VALUES ($1,$2,$3)`,
+		ownerId, accountId, bucketName)
 	if err != nil {
-		logger.Print("Error saving account: ", err)
+		logger.Print("Error saving shared bucket: ", err)
 		return err
 	}
 	return nil
 }
 
-func (c *DbController) DeleteAccount(ownerId string) error {
-	result, err := c.db.Exec(
-		`DELETE FROM accounts WHERE owner_uuid = $1`, ownerId)
+// True if an add-on resource that hasn't been deleted yet owns the prefix in a shared bucket.
+func (c *DbController) IsPrefixInUse(bucketName string, prefix string) (bool, error) {
+	var count int
+	err := c.db.QueryRow(
+		`SELECT count(*) FROM addon_resources WHERE bucket_name = $1 AND bucket_prefix = $2 AND deleted_at IS NULL`,
+		bucketName, prefix).Scan(&count)
 	if err != nil {
-		logger.Print("Error deleting account: ", err)
-		return err
+		logger.Print("Error querying database for prefix use: ", err)
+		return false, err
 	}
-	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
-		logger.Print("While deleting account for owner id ", ownerId, ", ", rowsAffected, " was affected. 1 row was expected.")
+	return count > 0, nil
+}
+
+// True if an add-on resource that hasn't been deleted yet uses the bucket.
+func (c *DbController) IsBucketInUse(bucketName string) (bool, error) {
+	var count int
+	err := c.db.QueryRow(
+		`SELECT count(*) FROM addon_resources WHERE bucket_name = $1 AND deleted_at IS NULL`,
+		bucketName).Scan(&count)
+	if err != nil {
+		logger.Print("Error querying database for bucket use: ", err)
+		return false, err
 	}
-	return nil
+	return count > 0, nil
 }
 
-func (c *DbController) MarkResourceForDeletion(providerId string) error {
+func (c *DbController) DeleteRegisteredBucket(ownerId string, bucketName string) error {
 	result, err := c.db.Exec(
-		"UPDATE addon_resources SET mark_for_deletion=true WHERE provider_resource_id = $1",
-		providerId)
+		`DELETE FROM registered_buckets WHERE owner_uuid = $1 AND bucket_name = $2`, ownerId, bucketName)
 	if err != nil {
-		logger.Print("Error marking resource deleted : ", err)
+		logger.Print("Error deleting registered bucket: ", err)
 		return err
 	}
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
-		logger.Print("While marking resource ", providerId, " for deletion, ", rowsAffected, " was affected. 1 row was expected.")
+		logger.Print("While deleting registered bucket ", bucketName, ", ", rowsAffected, " was affected. 1 row was expected.")
 	}
 	return nil
 }
 
-func (c *DbController) SetDeleted(providerId string) error {
+func (c *DbController) SetPlan(providerId string, plan string) error {
 	result, err := c.db.Exec(
-		"UPDATE addon_resources SET deleted_at=now() WHERE provider_resource_id = $1",
-		providerId)
+		"UPDATE addon_resources SET plan = $2 WHERE provider_resource_id = $1",
+		providerId, plan)
 	if err != nil {
-		logger.Print("Error updating resource as deleted : ", err)
+		logger.Print("Error updating resource plan : ", err)
 		return err
 	}
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
-		logger.Print("While updating resource ", providerId, " as deleted, ", rowsAffected, " was affected. 1 row was expected.")
+		logger.Print("While updating plan for resource ", providerId, ", ", rowsAffected, " was affected. 1 row was expected.")
 	}
 	return nil
 }
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Queries are written with Postgres style $1 parameters and otherwise stick to SQL that Postgres
+// and SQLite both understand. The few differences that can't be avoided live here.
+type dialect struct {
+	name string
+	// Ends a SELECT that locks the rows it reads until the transaction ends.
+	forUpdate string
+	// Keeps two processes from migrating at the same time. Called first thing in the migration
+	// transaction.
+	lockMigrations func(tx *sql.Tx) error
+}
+
+var (
+	postgresDialect = dialect{
+		name:      "postgres",
+		forUpdate: " FOR UPDATE",
+		lockMigrations: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockKey)
+			return err
+		},
+	}
+	// SQLite has a single writer at a time, which is all the locking it needs.
+	sqliteDialect = dialect{
+		name:           "sqlite",
+		forUpdate:      "",
+		lockMigrations: func(tx *sql.Tx) error { return nil },
+	}
+)
+
+// Registered by sqlite.go when built with -tags sqlite.
+const sqliteDriver = "byodemo-sqlite3"
+
+var errNoSQLite = errors.New("SQLite support is not compiled in. Build with -tags sqlite")
+
+// Opens the database named by a DATABASE_URL. postgres:// and postgresql:// URLs are handed to
+// lib/pq. sqlite:<path> opens a SQLite file, or an in-memory database for sqlite::memory:.
+func openDatabase(url string) (*sql.DB, dialect, error) {
+	if !strings.HasPrefix(url, "sqlite:") {
+		db, err := sql.Open("postgres", url)
+		return db, postgresDialect, err
+	}
+	if !sqliteAvailable {
+		return nil, sqliteDialect, errNoSQLite
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(url, "sqlite:"), "//")
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, sqliteDialect, err
+	}
+	// One connection keeps writers from running into each other's locks and gives an in-memory
+	// database a single lifetime.
+	db.SetMaxOpenConns(1)
+	return db, sqliteDialect, nil
+}
+
+// Placeholders and arguments for an IN list of values, numbered from first. An empty list
+// matches nothing.
+func inList(values []string, first int) (string, []interface{}) {
+	if len(values) == 0 {
+		return "(NULL)", nil
+	}
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		placeholders[i] = "$" + strconv.Itoa(first+i)
+		args[i] = v
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")", args
+}
+
+var numberedParameter = regexp.MustCompile(`\$([0-9]+)`)
+
+// SQLite reads $1 as a parameter named "1" and numbers parameters in the order they first
+// appear. ?1 is its syntax for the first argument wherever it appears.
+func rebind(query string) string {
+	return numberedParameter.ReplaceAllString(query, "?$1")
+}
+
+// Wraps a SQLite driver so the queries written for Postgres run unchanged.
+type rebindDriver struct {
+	driver.Driver
+}
+
+func (d rebindDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{conn}, nil
+}
+
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// Exec runs every statement in a migration, where Prepare would only run the first.
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, rebind(query), args)
+	}
+	return nil, driver.ErrSkip
+}
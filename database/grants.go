@@ -0,0 +1,80 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// The OAuth tokens of the grant Heroku gave the add-on when it provisioned a resource. They let
+// the add-on call the Platform API for the resource long after provisioning.
+type AddonGrant struct {
+	ProviderId   string
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// Both tokens are encrypted together as one secret.
+type grantTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Saves the grant, replacing the resource's previous tokens.
+func (c *DbController) SaveAddonGrant(grant *AddonGrant) error {
+	plaintext, err := json.Marshal(grantTokens{grant.AccessToken, grant.RefreshToken})
+	if err != nil {
+		return err
+	}
+	backend, encrypted, err := c.encrypt(string(plaintext))
+	if err != nil {
+		logger.Print("Error encrypting add-on grant: ", err)
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT INTO addon_grants (provider_resource_id, secret_backend, token, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider_resource_id) DO UPDATE
+		SET    secret_backend = excluded.secret_backend, token = excluded.token,
+		       expires_at = excluded.expires_at, updated_at = CURRENT_TIMESTAMP`,
+		grant.ProviderId, backend, encrypted, grant.ExpiresAt.UTC())
+	if err != nil {
+		logger.Print("Error saving add-on grant: ", err)
+		return err
+	}
+	return nil
+}
+
+func (c *DbController) FindAddonGrant(providerId string) (grant AddonGrant, found bool, err error) {
+	var backend string
+	var encrypted []byte
+	err = c.db.QueryRow(`SELECT secret_backend, token, expires_at FROM addon_grants WHERE provider_resource_id = $1`,
+		providerId).Scan(&backend, &encrypted, &grant.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return grant, false, nil
+	}
+	if err != nil {
+		logger.Print("Error querying database for add-on grant: ", err)
+		return grant, false, err
+	}
+	plaintext, err := c.decrypt(backend, encrypted)
+	if err != nil {
+		logger.Print("Error decrypting add-on grant for ", providerId, ": ", err)
+		return grant, false, err
+	}
+	var tokens grantTokens
+	if err := json.Unmarshal([]byte(plaintext), &tokens); err != nil {
+		return grant, false, err
+	}
+	grant.ProviderId, grant.AccessToken, grant.RefreshToken = providerId, tokens.AccessToken, tokens.RefreshToken
+	return grant, true, nil
+}
+
+func (c *DbController) DeleteAddonGrant(providerId string) error {
+	if _, err := c.db.Exec(`DELETE FROM addon_grants WHERE provider_resource_id = $1`, providerId); err != nil {
+		logger.Print("Error deleting add-on grant: ", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+)
+
+// Moving secrets to another store, or rotating the key of the current one:
+//
+//   1. Configure the new store as the current one while keeping the old one configured, so new
+//      secrets use the new store and existing ones still decrypt with the old. For Fernet key
+//      rotation, prepend a new key to DATABASE_SECRET, e.g. "new,old".
+//   2. Run `byodemo migrate-secrets` to re-encrypt every stored secret with the current store.
+//   3. Remove the old store or key from configuration.
+
+const reencryptBatchSize = 100
+
+// Every encrypted column. Each table has an id and a secret_backend column saying which store
+// encrypted the secret.
+var encryptedColumns = []struct{ table, column string }{
+	{"accounts", "aws_secret_access_key_token"},
+	{"addon_grants", "token"},
+	{"user_sessions", "token"},
+}
+
+func (c *DbController) encrypt(plaintext string) (backend string, token []byte, err error) {
+	token, err = c.secrets.Encrypt(plaintext)
+	return c.secrets.Name(), token, err
+}
+
+func (c *DbController) decrypt(backend string, token []byte) (string, error) {
+	store, ok := c.secretStores[backend]
+	if !ok {
+		return "", errors.New("Secret was encrypted with " + backend + ", which isn't configured")
+	}
+	return store.Decrypt(token)
+}
+
+// True if the secret isn't encrypted the way the current store would encrypt it now.
+func (c *DbController) isStale(backend string, token []byte) bool {
+	return backend != c.secrets.Name() || c.secrets.IsStale(token)
+}
+
+// Re-encrypts every stored secret that isn't already encrypted with the current store and key.
+// Works in batches of reencryptBatchSize rows, each in its own transaction, so it can be stopped
+// and rerun.
+func (c *DbController) ReencryptSecrets() (rewritten int, err error) {
+	for _, e := range encryptedColumns {
+		var lastId int64
+		for {
+			n, last, done, err := c.reencryptBatch(e.table, e.column, lastId)
+			rewritten += n
+			if err != nil {
+				return rewritten, err
+			}
+			if done {
+				break
+			}
+			lastId = last
+			logger.Print("Re-encrypted ", rewritten, " secrets so far")
+		}
+	}
+	return rewritten, nil
+}
+
+func (c *DbController) reencryptBatch(table string, column string, afterId int64) (rewritten int, lastId int64, done bool, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, afterId, false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		 SELECT id, secret_backend, `+column+`
+		 FROM   `+table+`
+		 WHERE  id > $1
+		 ORDER  BY id
+		 LIMIT  $2
+		`+c.dialect.forUpdate, afterId, reencryptBatchSize)
+	if err != nil {
+		logger.Print("Error querying database for secrets: ", err)
+		return 0, afterId, false, err
+	}
+	backends := make(map[int64]string)
+	tokens := make(map[int64][]byte)
+	ids := make([]int64, 0, reencryptBatchSize)
+	for rows.Next() {
+		var id int64
+		var backend string
+		var token []byte
+		if err := rows.Scan(&id, &backend, &token); err != nil {
+			rows.Close()
+			logger.Print("Error reading database row: ", err)
+			return 0, afterId, false, err
+		}
+		backends[id], tokens[id] = backend, token
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, afterId, false, err
+	}
+	if len(ids) == 0 {
+		return 0, afterId, true, nil
+	}
+
+	for _, id := range ids {
+		if !c.isStale(backends[id], tokens[id]) {
+			continue
+		}
+		plaintext, err := c.decrypt(backends[id], tokens[id])
+		if err != nil {
+			logger.Print("Row ", id, " of ", table, ": ", err)
+			return 0, afterId, false, err
+		}
+		backend, encrypted, err := c.encrypt(plaintext)
+		if err != nil {
+			return 0, afterId, false, err
+		}
+		_, err = tx.Exec(`UPDATE `+table+` SET secret_backend = $2, `+column+` = $3 WHERE id = $1`,
+			id, backend, encrypted)
+		if err != nil {
+			logger.Print("Error updating secret for row ", id, " of ", table, ": ", err)
+			return 0, afterId, false, err
+		}
+		rewritten++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, afterId, false, err
+	}
+	return rewritten, ids[len(ids)-1], len(ids) < reencryptBatchSize, nil
+}
@@ -0,0 +1,759 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// In-memory Store for tests and for running the app without Postgres. Nothing is encrypted and
+// nothing survives a restart. Enforces the same uniqueness rules as the Postgres schema.
+type MemoryStore struct {
+	mu              sync.Mutex
+	accounts        map[int64]Account
+	detached        map[int64]Account
+	lastAccountId   int64
+	resources       map[string]*memoryResource
+	usage           []BucketUsage
+	usageClaimedAt  time.Time
+	settingsChanges []SettingsChange
+	registered      map[string]RegisteredBucket
+	shared          map[int64]string
+	auditEvents     []AuditEvent
+	keyHistory      []AccountKeyChange
+	grants          map[string]AddonGrant
+	policies        map[string]TeamPolicy
+	sessions        map[string]UserSession
+	apiTokens       []APIToken
+	lastAPITokenId  int64
+}
+
+type memoryResource struct {
+	AddonResource
+	deleted bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:   make(map[int64]Account),
+		detached:   make(map[int64]Account),
+		resources:  make(map[string]*memoryResource),
+		registered: make(map[string]RegisteredBucket),
+		shared:     make(map[int64]string),
+		grants:     make(map[string]AddonGrant),
+		policies:   make(map[string]TeamPolicy),
+		sessions:   make(map[string]UserSession),
+	}
+}
+
+func (s *MemoryStore) FindAccount(ownerId string, accountId int64) (Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[accountId]
+	if !ok || account.OwnerId != ownerId {
+		return Account{}, errAccountNotFound
+	}
+	return account, nil
+}
+
+func (s *MemoryStore) FindDefaultAccount(ownerId string) (Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.accounts {
+		if a.OwnerId == ownerId && a.IsDefault {
+			return a, nil
+		}
+	}
+	return Account{}, errAccountNotFound
+}
+
+func (s *MemoryStore) FindAccountByAlias(ownerId string, alias string) (account Account, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.accounts {
+		if a.OwnerId == ownerId && a.Alias == alias {
+			return a, true, nil
+		}
+	}
+	return account, false, nil
+}
+
+func (s *MemoryStore) FindAccounts(ownerIds []string) (map[string][]Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owners := make(map[string]bool)
+	for _, id := range ownerIds {
+		owners[id] = true
+	}
+	result := make(map[string][]Account)
+	for _, a := range s.accounts {
+		if owners[a.OwnerId] {
+			a.AWSSecretAccessKey = ""
+			result[a.OwnerId] = append(result[a.OwnerId], a)
+		}
+	}
+	for _, accounts := range result {
+		sort.Slice(accounts, func(i, j int) bool {
+			if accounts[i].IsDefault != accounts[j].IsDefault {
+				return accounts[i].IsDefault
+			}
+			return accounts[i].Alias < accounts[j].Alias
+		})
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) FindAccountForAddon(providerId string) (account Account, addon AddonResource, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.resources[providerId]
+	if !ok {
+		return account, addon, errAccountNotFound
+	}
+	account, ok = s.accounts[r.AccountId]
+	if !ok {
+		account, ok = s.detached[r.AccountId]
+	}
+	if !ok {
+		return account, addon, errAccountNotFound
+	}
+	return account, r.AddonResource, nil
+}
+
+func (s *MemoryStore) SaveAccount(newAccount *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if newAccount.Alias == "" {
+		newAccount.Alias = DefaultAccountAlias
+	}
+	newAccount.IsDefault = true
+	for _, a := range s.accounts {
+		if a.OwnerId != newAccount.OwnerId {
+			continue
+		}
+		if a.Alias == newAccount.Alias {
+			return errors.New("Owner " + newAccount.OwnerId + " already has an account named " + a.Alias)
+		}
+		newAccount.IsDefault = false
+	}
+	s.lastAccountId++
+	newAccount.Id = s.lastAccountId
+	s.accounts[newAccount.Id] = *newAccount
+	return nil
+}
+
+func (s *MemoryStore) SetDefaultAccount(ownerId string, accountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.accounts[accountId]; !ok || a.OwnerId != ownerId {
+		return errAccountNotFound
+	}
+	for id, a := range s.accounts {
+		if a.OwnerId == ownerId {
+			a.IsDefault = id == accountId
+			s.accounts[id] = a
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateAccountCredentials(account *Account, replacedBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.accounts[account.Id]
+	if !ok || old.OwnerId != account.OwnerId {
+		return errAccountNotFound
+	}
+	s.keyHistory = append(s.keyHistory, AccountKeyChange{
+		AccountId:      old.Id,
+		AWSAccessKeyId: old.AWSAccessKeyId,
+		ReplacedBy:     replacedBy,
+		ReplacedAt:     time.Now().UTC(),
+	})
+	old.AWSAccessKeyId, old.AWSSecretAccessKey = account.AWSAccessKeyId, account.AWSSecretAccessKey
+	s.accounts[old.Id] = old
+	return nil
+}
+
+func (s *MemoryStore) FindAccountKeyHistory(accountId int64) ([]AccountKeyChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]AccountKeyChange, 0)
+	for i := len(s.keyHistory) - 1; i >= 0; i-- {
+		if s.keyHistory[i].AccountId == accountId {
+			result = append(result, s.keyHistory[i])
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) DeleteAccount(ownerId string, accountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeAccount(ownerId, accountId)
+	return nil
+}
+
+func (s *MemoryStore) DetachAccount(ownerId string, accountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.removeAccount(ownerId, accountId); ok {
+		a.IsDefault = false
+		s.detached[accountId] = a
+	}
+	return nil
+}
+
+// Takes the account out of the linked accounts like DbController.removeAccount. Callers must hold
+// the lock.
+func (s *MemoryStore) removeAccount(ownerId string, accountId int64) (Account, bool) {
+	a, ok := s.accounts[accountId]
+	if !ok || a.OwnerId != ownerId {
+		return a, false
+	}
+	delete(s.accounts, accountId)
+	delete(s.shared, accountId)
+	for key, r := range s.registered {
+		if r.AccountId == accountId {
+			delete(s.registered, key)
+		}
+	}
+	if !a.IsDefault {
+		return a, true
+	}
+	var oldest int64
+	for id, other := range s.accounts {
+		if other.OwnerId == ownerId && (oldest == 0 || id < oldest) {
+			oldest = id
+		}
+	}
+	if oldest != 0 {
+		other := s.accounts[oldest]
+		other.IsDefault = true
+		s.accounts[oldest] = other
+	}
+	return a, true
+}
+
+func (s *MemoryStore) PurgeDetachedAccount(accountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.resources {
+		if r.AccountId == accountId && !r.deleted {
+			return nil
+		}
+	}
+	delete(s.detached, accountId)
+	return nil
+}
+
+func (s *MemoryStore) TransferAccountResources(ownerId string, fromAccountId int64, toAccountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, fromOk := s.accounts[fromAccountId]
+	to, toOk := s.accounts[toAccountId]
+	if !fromOk || !toOk || from.OwnerId != ownerId || to.OwnerId != ownerId || fromAccountId == toAccountId {
+		return errAccountNotFound
+	}
+	for _, r := range s.resources {
+		if r.AccountId == fromAccountId && !r.deleted {
+			r.AccountId = toAccountId
+		}
+	}
+	for key, r := range s.registered {
+		if r.AccountId == fromAccountId {
+			r.AccountId = toAccountId
+			s.registered[key] = r
+		}
+	}
+	if name, ok := s.shared[fromAccountId]; ok {
+		if _, exists := s.shared[toAccountId]; !exists {
+			s.shared[toAccountId] = name
+		}
+		delete(s.shared, fromAccountId)
+	}
+	return nil
+}
+
+func (s *MemoryStore) FindAddonResource(addonId string) (AddonResource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.resources {
+		if r.AddonId == addonId && !r.deleted {
+			return r.AddonResource, nil
+		}
+	}
+	return AddonResource{}, errors.New("Resource not found")
+}
+
+func (s *MemoryStore) FindActiveAddonResources() ([]AddonResource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]AddonResource, 0)
+	for _, r := range s.activeResources() {
+		result = append(result, r.AddonResource)
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) FindAccountResources(accountId int64) ([]AddonResource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]AddonResource, 0)
+	for _, r := range s.resources {
+		if r.AccountId == accountId && !r.deleted {
+			result = append(result, r.AddonResource)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].AppName < result[j].AppName })
+	return result, nil
+}
+
+// Sorted by app name like the Postgres queries. Callers must hold the lock.
+func (s *MemoryStore) activeResources() []*memoryResource {
+	result := make([]*memoryResource, 0)
+	for _, r := range s.resources {
+		if !r.deleted && !r.MarkedForDeletion {
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AppName != result[j].AppName {
+			return result[i].AppName < result[j].AppName
+		}
+		return result[i].ProviderId < result[j].ProviderId
+	})
+	return result
+}
+
+func (s *MemoryStore) SaveAddonResource(newAddonResource *AddonResource) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.resources[newAddonResource.ProviderId]; ok {
+		return errors.New("Resource " + newAddonResource.ProviderId + " already exists")
+	}
+	bucketName := newAddonResource.BucketName
+	if bucketName == "" {
+		bucketName = "bucket-" + newAddonResource.ProviderId
+	}
+	for _, r := range s.resources {
+		if !r.deleted && r.BucketName == bucketName && r.BucketPrefix == newAddonResource.BucketPrefix {
+			return errors.New("Bucket " + bucketName + " is already used by resource " + r.ProviderId)
+		}
+	}
+	s.resources[newAddonResource.ProviderId] = &memoryResource{AddonResource: *newAddonResource}
+	return nil
+}
+
+func (s *MemoryStore) MarkResourceForDeletion(providerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[providerId]; ok {
+		r.MarkedForDeletion = true
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetDeleted(providerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[providerId]; ok {
+		r.deleted = true
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetPlan(providerId string, plan string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[providerId]; ok {
+		r.Plan = plan
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveBucketUsage(usage *BucketUsage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage = append(s.usage, *usage)
+	return nil
+}
+
+func (s *MemoryStore) ClaimUsageCollection(now time.Time, interval time.Duration) (claimed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.usageClaimedAt.IsZero() && s.usageClaimedAt.After(now.Add(-interval)) {
+		return false, nil
+	}
+	s.usageClaimedAt = now
+	return true, nil
+}
+
+func (s *MemoryStore) FindLatestUsage(ownerIds []string) ([]ResourceUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owners := make(map[string]bool)
+	for _, id := range ownerIds {
+		owners[id] = true
+	}
+	latest := make(map[string]BucketUsage)
+	for _, u := range s.usage {
+		if u.CollectedAt.After(latest[u.ProviderId].CollectedAt) {
+			latest[u.ProviderId] = u
+		}
+	}
+	result := make([]ResourceUsage, 0)
+	for _, r := range s.activeResources() {
+		if !owners[r.OwnerId] {
+			continue
+		}
+		u := latest[r.ProviderId]
+		u.ProviderId = r.ProviderId
+		result = append(result, resourceUsage(r.AddonResource, u))
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) FindUsageHistory(ownerId string, since time.Time) ([]ResourceUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]ResourceUsage, 0)
+	for _, u := range s.usage {
+		r, ok := s.resources[u.ProviderId]
+		if !ok || r.OwnerId != ownerId || u.CollectedAt.Before(since) {
+			continue
+		}
+		result = append(result, resourceUsage(r.AddonResource, u))
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].CollectedAt.Equal(result[j].CollectedAt) {
+			return result[i].CollectedAt.Before(result[j].CollectedAt)
+		}
+		return result[i].AppName < result[j].AppName
+	})
+	return result, nil
+}
+
+func resourceUsage(r AddonResource, u BucketUsage) ResourceUsage {
+	return ResourceUsage{
+		OwnerId:        r.OwnerId,
+		AddonId:        r.AddonId,
+		AppId:          r.AppId,
+		AppName:        r.AppName,
+		BucketName:     r.BucketName,
+		BucketPrefix:   r.BucketPrefix,
+		MovedToOwnerId: r.MovedToOwnerId,
+		BucketUsage:    u,
+	}
+}
+
+func (s *MemoryStore) SaveSettingsChange(change *SettingsChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *change
+	saved.ChangedAt = time.Now().UTC()
+	s.settingsChanges = append(s.settingsChanges, saved)
+	return nil
+}
+
+func (s *MemoryStore) FindSettingsChanges(providerId string, limit int) ([]SettingsChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]SettingsChange, 0)
+	for i := len(s.settingsChanges) - 1; i >= 0 && len(result) < limit; i-- {
+		if s.settingsChanges[i].ProviderId == providerId {
+			result = append(result, s.settingsChanges[i])
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) SaveRegisteredBucket(registered *RegisteredBucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := registered.OwnerId + "/" + registered.BucketName
+	if _, ok := s.registered[key]; ok {
+		return errors.New("Bucket " + registered.BucketName + " is already registered")
+	}
+	saved := *registered
+	saved.AccountAlias = ""
+	saved.RegisteredAt = time.Now().UTC()
+	s.registered[key] = saved
+	return nil
+}
+
+func (s *MemoryStore) FindRegisteredBuckets(ownerId string) ([]RegisteredBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]RegisteredBucket, 0)
+	for _, r := range s.registered {
+		if r.OwnerId == ownerId {
+			r.AccountAlias = s.accounts[r.AccountId].Alias
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].BucketName < result[j].BucketName })
+	return result, nil
+}
+
+func (s *MemoryStore) FindRegisteredBucket(ownerId string, bucketName string) (registered RegisteredBucket, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registered, found = s.registered[ownerId+"/"+bucketName]
+	return registered, found, nil
+}
+
+func (s *MemoryStore) DeleteRegisteredBucket(ownerId string, bucketName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.registered, ownerId+"/"+bucketName)
+	return nil
+}
+
+func (s *MemoryStore) FindSharedBucket(accountId int64) (bucketName string, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucketName, found = s.shared[accountId]
+	return bucketName, found, nil
+}
+
+func (s *MemoryStore) SaveSharedBucket(ownerId string, accountId int64, bucketName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.shared[accountId]; ok {
+		return errors.New("Account " + strconv.FormatInt(accountId, 10) + " already has a shared bucket")
+	}
+	s.shared[accountId] = bucketName
+	return nil
+}
+
+func (s *MemoryStore) IsPrefixInUse(bucketName string, prefix string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.resources {
+		if !r.deleted && r.BucketName == bucketName && r.BucketPrefix == prefix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) IsBucketInUse(bucketName string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.resources {
+		if !r.deleted && r.BucketName == bucketName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) SaveAddonGrant(grant *AddonGrant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants[grant.ProviderId] = *grant
+	return nil
+}
+
+func (s *MemoryStore) FindAddonGrant(providerId string) (grant AddonGrant, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant, found = s.grants[providerId]
+	return grant, found, nil
+}
+
+func (s *MemoryStore) DeleteAddonGrant(providerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.grants, providerId)
+	return nil
+}
+
+func (s *MemoryStore) SaveUserSession(session *UserSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[session.IdHash]; exists {
+		return errors.New("Session already exists")
+	}
+	s.sessions[session.IdHash] = *session
+	return nil
+}
+
+func (s *MemoryStore) FindUserSession(idHash string) (session UserSession, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, found = s.sessions[idHash]
+	return session, found, nil
+}
+
+func (s *MemoryStore) UpdateUserSessionTokens(idHash string, accessToken string, refreshToken string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[idHash]; ok {
+		session.AccessToken, session.RefreshToken, session.ExpiresAt = accessToken, refreshToken, expiresAt
+		s.sessions[idHash] = session
+	}
+	return nil
+}
+
+func (s *MemoryStore) TouchUserSession(idHash string, lastSeenAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[idHash]; ok {
+		session.LastSeenAt = lastSeenAt
+		s.sessions[idHash] = session
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserSession(idHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, idHash)
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredUserSessions(lastSeenBefore time.Time, createdBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for idHash, session := range s.sessions {
+		if session.LastSeenAt.Before(lastSeenBefore) || session.CreatedAt.Before(createdBefore) {
+			delete(s.sessions, idHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) SaveAPIToken(token *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.apiTokens {
+		if t.Name == token.Name || t.TokenHash == token.TokenHash {
+			return errors.New("API token already exists")
+		}
+	}
+	s.lastAPITokenId++
+	token.Id, token.CreatedAt = s.lastAPITokenId, time.Now().UTC()
+	s.apiTokens = append(s.apiTokens, *token)
+	return nil
+}
+
+func (s *MemoryStore) FindAPIToken(tokenHash string) (token APIToken, found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.apiTokens {
+		if t.TokenHash == tokenHash {
+			return t, true, nil
+		}
+	}
+	return token, false, nil
+}
+
+func (s *MemoryStore) FindAPITokens() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := append([]APIToken{}, s.apiTokens...)
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens, nil
+}
+
+func (s *MemoryStore) TouchAPIToken(id int64, lastUsedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.apiTokens {
+		if s.apiTokens[i].Id == id {
+			s.apiTokens[i].LastUsedAt = lastUsedAt
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteAPIToken(name string) (found bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.apiTokens {
+		if t.Name == name {
+			s.apiTokens = append(s.apiTokens[:i], s.apiTokens[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) FindTeamPolicy(ownerId string) (TeamPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if policy, ok := s.policies[ownerId]; ok {
+		return policy, nil
+	}
+	return TeamPolicy{OwnerId: ownerId, AppTransfer: AppTransferFlag}, nil
+}
+
+func (s *MemoryStore) SaveTeamPolicy(policy *TeamPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[policy.OwnerId] = *policy
+	return nil
+}
+
+func (s *MemoryStore) SetAppName(providerId string, appName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[providerId]; ok {
+		r.AppName = appName
+	}
+	return nil
+}
+
+func (s *MemoryStore) MoveResource(providerId string, ownerId string, accountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[providerId]; ok {
+		r.OwnerId, r.AccountId, r.MovedToOwnerId = ownerId, accountId, ""
+	}
+	return nil
+}
+
+func (s *MemoryStore) FlagResourceMoved(providerId string, ownerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[providerId]; ok {
+		r.MovedToOwnerId = ownerId
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveAuditEvent(event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *event
+	saved.Id = int64(len(s.auditEvents) + 1)
+	saved.OccurredAt = time.Now().UTC()
+	s.auditEvents = append(s.auditEvents, saved)
+	return nil
+}
+
+func (s *MemoryStore) FindAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]AuditEvent, 0)
+	for i := len(s.auditEvents) - 1; i >= 0; i-- {
+		e := s.auditEvents[i]
+		if (filter.OwnerId != "" && e.OwnerId != filter.OwnerId) ||
+			(filter.ResourceId != "" && e.ResourceId != filter.ResourceId) ||
+			(filter.Action != "" && e.Action != filter.Action) ||
+			(filter.Outcome != "" && e.Outcome != filter.Outcome) {
+			continue
+		}
+		result = append(result, e)
+		if filter.Limit > 0 && len(result) == filter.Limit {
+			break
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,445 @@
+package database
+
+import (
+	"database/sql"
+)
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+	// The same change for SQLite, where sql doesn't work there. SQLite databases only exist for
+	// local development and always start out empty.
+	sqlite string
+}
+
+func (m migration) sqlFor(d dialect) string {
+	if d.name == sqliteDialect.name && m.sqlite != "" {
+		return m.sqlite
+	}
+	return m.sql
+}
+
+// Arbitrary key for the Postgres advisory lock that keeps dynos starting at the same time from
+// migrating concurrently.
+const migrationLockKey = 20170101
+
+// Schema migrations, applied in order. Never edit or reorder a migration that has been released.
+// Add a new one at the end instead.
+var migrations = []migration{
+	{1, "initial schema", `
+		-- Matches the hand-applied db.sql this replaces, so it's a no-op on existing databases
+		-- apart from adding any columns they are missing.
+		CREATE TABLE IF NOT EXISTS accounts (
+		    owner_uuid uuid,
+		    aws_access_key_id character varying,
+		    aws_secret_access_key_token bytea
+		);
+
+		CREATE TABLE IF NOT EXISTS addon_resources (
+		    owner_uuid uuid,
+		    provider_resource_id character varying,
+		    heroku_resource_id character varying,
+		    deleted_at timestamp without time zone,
+		    mark_for_deletion boolean DEFAULT false,
+		    aws_access_key_id character varying
+		);
+		ALTER TABLE addon_resources ADD COLUMN IF NOT EXISTS app_id character varying;
+		ALTER TABLE addon_resources ADD COLUMN IF NOT EXISTS app_name character varying;
+		ALTER TABLE addon_resources ADD COLUMN IF NOT EXISTS bucket_name character varying;
+		ALTER TABLE addon_resources ADD COLUMN IF NOT EXISTS adopted boolean DEFAULT false;
+		ALTER TABLE addon_resources ADD COLUMN IF NOT EXISTS bucket_prefix character varying;
+		ALTER TABLE addon_resources ADD COLUMN IF NOT EXISTS plan character varying;
+
+		CREATE TABLE IF NOT EXISTS shared_buckets (
+		    owner_uuid uuid,
+		    bucket_name character varying,
+		    created_at timestamp without time zone DEFAULT now()
+		);
+
+		CREATE TABLE IF NOT EXISTS registered_buckets (
+		    owner_uuid uuid,
+		    bucket_name character varying,
+		    registered_by character varying,
+		    registered_at timestamp without time zone DEFAULT now()
+		);
+
+		CREATE TABLE IF NOT EXISTS bucket_usage (
+		    provider_resource_id character varying,
+		    object_count bigint,
+		    total_bytes bigint,
+		    collected_at timestamp without time zone DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS bucket_usage_resource_collected_idx ON bucket_usage (provider_resource_id, collected_at);
+
+		CREATE TABLE IF NOT EXISTS bucket_settings_changes (
+		    provider_resource_id character varying,
+		    actor character varying,
+		    setting character varying,
+		    document text,
+		    changed_at timestamp without time zone DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS bucket_settings_changes_resource_idx ON bucket_settings_changes (provider_resource_id, changed_at);
+	`, `
+		-- SQLite can't add a primary key to an existing table, so the ones Postgres gets in
+		-- migration 2 are declared here.
+		CREATE TABLE accounts (
+		    id integer PRIMARY KEY,
+		    owner_uuid text NOT NULL,
+		    aws_access_key_id text,
+		    aws_secret_access_key_token blob
+		);
+
+		CREATE TABLE addon_resources (
+		    owner_uuid text NOT NULL,
+		    provider_resource_id text PRIMARY KEY,
+		    heroku_resource_id text,
+		    deleted_at timestamp,
+		    mark_for_deletion boolean DEFAULT false,
+		    aws_access_key_id text,
+		    app_id text,
+		    app_name text,
+		    bucket_name text,
+		    adopted boolean DEFAULT false,
+		    bucket_prefix text,
+		    plan text
+		);
+
+		CREATE TABLE shared_buckets (
+		    owner_uuid text,
+		    bucket_name text,
+		    created_at timestamp DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE registered_buckets (
+		    owner_uuid text,
+		    bucket_name text,
+		    registered_by text,
+		    registered_at timestamp DEFAULT CURRENT_TIMESTAMP,
+		    PRIMARY KEY (owner_uuid, bucket_name)
+		);
+
+		CREATE TABLE bucket_usage (
+		    id integer PRIMARY KEY,
+		    provider_resource_id text,
+		    object_count bigint,
+		    total_bytes bigint,
+		    collected_at timestamp DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX bucket_usage_resource_collected_idx ON bucket_usage (provider_resource_id, collected_at);
+
+		CREATE TABLE bucket_settings_changes (
+		    id integer PRIMARY KEY,
+		    provider_resource_id text,
+		    actor text,
+		    setting text,
+		    document text,
+		    changed_at timestamp DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX bucket_settings_changes_resource_idx ON bucket_settings_changes (provider_resource_id, changed_at);
+	`},
+	{2, "primary keys, constraints and indexes", `
+		-- Relinking used to insert a second row for the same owner. Nothing records which row was
+		-- written last, so keep the one with the greatest access key id. Rows with the same key id
+		-- only differ in how the secret was encrypted, and an arbitrary one of those is kept.
+		DELETE FROM accounts a USING accounts b
+		 WHERE a.owner_uuid = b.owner_uuid
+		   AND (coalesce(a.aws_access_key_id, '') < coalesce(b.aws_access_key_id, '')
+		        OR coalesce(a.aws_access_key_id, '') = coalesce(b.aws_access_key_id, '') AND a.ctid < b.ctid);
+		DELETE FROM accounts WHERE owner_uuid IS NULL;
+		ALTER TABLE accounts ADD COLUMN id bigserial PRIMARY KEY;
+		ALTER TABLE accounts ALTER COLUMN owner_uuid SET NOT NULL;
+		ALTER TABLE accounts ADD CONSTRAINT accounts_owner_uuid_key UNIQUE (owner_uuid);
+
+		ALTER TABLE addon_resources ADD PRIMARY KEY (provider_resource_id);
+		ALTER TABLE addon_resources ALTER COLUMN owner_uuid SET NOT NULL;
+		CREATE INDEX addon_resources_heroku_resource_id_idx ON addon_resources (heroku_resource_id);
+		CREATE INDEX addon_resources_owner_uuid_idx ON addon_resources (owner_uuid);
+		-- A bucket, or a prefix in a shared bucket, belongs to at most one live resource.
+		UPDATE addon_resources SET bucket_name = 'bucket-' || provider_resource_id WHERE bucket_name IS NULL;
+		CREATE UNIQUE INDEX addon_resources_live_bucket_idx ON addon_resources (bucket_name, coalesce(bucket_prefix, ''))
+		 WHERE deleted_at IS NULL;
+
+		ALTER TABLE shared_buckets ADD PRIMARY KEY (owner_uuid);
+		ALTER TABLE registered_buckets ADD PRIMARY KEY (owner_uuid, bucket_name);
+		ALTER TABLE bucket_usage ADD COLUMN id bigserial PRIMARY KEY;
+		ALTER TABLE bucket_settings_changes ADD COLUMN id bigserial PRIMARY KEY;
+	`, `
+		CREATE UNIQUE INDEX accounts_owner_uuid_key ON accounts (owner_uuid);
+		CREATE INDEX addon_resources_heroku_resource_id_idx ON addon_resources (heroku_resource_id);
+		CREATE INDEX addon_resources_owner_uuid_idx ON addon_resources (owner_uuid);
+		CREATE UNIQUE INDEX addon_resources_live_bucket_idx ON addon_resources (bucket_name, coalesce(bucket_prefix, ''))
+		 WHERE deleted_at IS NULL;
+		CREATE UNIQUE INDEX shared_buckets_pkey ON shared_buckets (owner_uuid);
+	`},
+	{3, "audit events", `
+		CREATE TABLE audit_events (
+		    id bigserial PRIMARY KEY,
+		    occurred_at timestamp without time zone NOT NULL DEFAULT now(),
+		    actor character varying NOT NULL,
+		    owner_uuid character varying,
+		    resource_id character varying,
+		    action character varying NOT NULL,
+		    outcome character varying NOT NULL,
+		    error text
+		);
+		CREATE INDEX audit_events_owner_occurred_idx ON audit_events (owner_uuid, occurred_at);
+
+		-- Audit events are append-only.
+		CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+		    RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+		    FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+	`, `
+		CREATE TABLE audit_events (
+		    id integer PRIMARY KEY,
+		    occurred_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    actor text NOT NULL,
+		    owner_uuid text,
+		    resource_id text,
+		    action text NOT NULL,
+		    outcome text NOT NULL,
+		    error text
+		);
+		CREATE INDEX audit_events_owner_occurred_idx ON audit_events (owner_uuid, occurred_at);
+
+		CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN
+		    SELECT RAISE(ABORT, 'audit_events is append-only');
+		END;
+		CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN
+		    SELECT RAISE(ABORT, 'audit_events is append-only');
+		END;
+	`},
+	{4, "multiple accounts per team", `
+		-- Every team had at most one account. It keeps working as the team's default.
+		ALTER TABLE accounts ADD COLUMN alias character varying NOT NULL DEFAULT 'default';
+		ALTER TABLE accounts ADD COLUMN is_default boolean NOT NULL DEFAULT false;
+		UPDATE accounts SET is_default = true;
+		ALTER TABLE accounts DROP CONSTRAINT accounts_owner_uuid_key;
+		ALTER TABLE accounts ADD CONSTRAINT accounts_owner_uuid_alias_key UNIQUE (owner_uuid, alias);
+		CREATE UNIQUE INDEX accounts_owner_default_idx ON accounts (owner_uuid) WHERE is_default;
+
+		ALTER TABLE addon_resources ADD COLUMN account_id bigint;
+		UPDATE addon_resources ar SET account_id = a.id FROM accounts a WHERE a.owner_uuid = ar.owner_uuid;
+		CREATE INDEX addon_resources_account_id_idx ON addon_resources (account_id);
+
+		ALTER TABLE registered_buckets ADD COLUMN account_id bigint;
+		UPDATE registered_buckets rb SET account_id = a.id FROM accounts a WHERE a.owner_uuid = rb.owner_uuid;
+
+		-- Shared buckets are per account now. Those of teams that have since unlinked are
+		-- forgotten. Their resources keep working and a new shared bucket is created on relink.
+		ALTER TABLE shared_buckets ADD COLUMN account_id bigint;
+		UPDATE shared_buckets sb SET account_id = a.id FROM accounts a WHERE a.owner_uuid = sb.owner_uuid;
+		DELETE FROM shared_buckets WHERE account_id IS NULL;
+		ALTER TABLE shared_buckets DROP CONSTRAINT shared_buckets_pkey;
+		ALTER TABLE shared_buckets ADD PRIMARY KEY (account_id);
+	`, `
+		ALTER TABLE accounts ADD COLUMN alias text NOT NULL DEFAULT 'default';
+		ALTER TABLE accounts ADD COLUMN is_default boolean NOT NULL DEFAULT false;
+		UPDATE accounts SET is_default = true;
+		DROP INDEX accounts_owner_uuid_key;
+		CREATE UNIQUE INDEX accounts_owner_uuid_alias_key ON accounts (owner_uuid, alias);
+		CREATE UNIQUE INDEX accounts_owner_default_idx ON accounts (owner_uuid) WHERE is_default;
+
+		ALTER TABLE addon_resources ADD COLUMN account_id bigint;
+		CREATE INDEX addon_resources_account_id_idx ON addon_resources (account_id);
+
+		ALTER TABLE registered_buckets ADD COLUMN account_id bigint;
+
+		ALTER TABLE shared_buckets ADD COLUMN account_id bigint;
+		DROP INDEX shared_buckets_pkey;
+		CREATE UNIQUE INDEX shared_buckets_pkey ON shared_buckets (account_id);
+	`},
+	{5, "account key history", `
+		CREATE TABLE account_key_history (
+		    id bigserial PRIMARY KEY,
+		    account_id bigint NOT NULL,
+		    aws_access_key_id character varying NOT NULL,
+		    replaced_by character varying NOT NULL,
+		    replaced_at timestamp without time zone NOT NULL DEFAULT now()
+		);
+		CREATE INDEX account_key_history_account_idx ON account_key_history (account_id, replaced_at);
+	`, `
+		CREATE TABLE account_key_history (
+		    id integer PRIMARY KEY,
+		    account_id bigint NOT NULL,
+		    aws_access_key_id text NOT NULL,
+		    replaced_by text NOT NULL,
+		    replaced_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX account_key_history_account_idx ON account_key_history (account_id, replaced_at);
+	`},
+	{6, "detached accounts", `
+		-- Detached accounts are unlinked but kept until their last resource has been deprovisioned.
+		-- Their alias can be reused right away.
+		ALTER TABLE accounts ADD COLUMN detached_at timestamp without time zone;
+		ALTER TABLE accounts DROP CONSTRAINT accounts_owner_uuid_alias_key;
+		CREATE UNIQUE INDEX accounts_owner_alias_idx ON accounts (owner_uuid, alias) WHERE detached_at IS NULL;
+	`, `
+		ALTER TABLE accounts ADD COLUMN detached_at timestamp;
+		DROP INDEX accounts_owner_uuid_alias_key;
+		CREATE UNIQUE INDEX accounts_owner_alias_idx ON accounts (owner_uuid, alias) WHERE detached_at IS NULL;
+	`},
+	{7, "secret backends", `
+		-- Name of the secret store that encrypted aws_secret_access_key_token. Everything stored
+		-- so far was encrypted with Fernet.
+		ALTER TABLE accounts ADD COLUMN secret_backend character varying NOT NULL DEFAULT 'fernet';
+	`, ""},
+	{8, "add-on grants", `
+		CREATE TABLE addon_grants (
+		    id bigserial PRIMARY KEY,
+		    provider_resource_id character varying NOT NULL UNIQUE,
+		    secret_backend character varying NOT NULL,
+		    token bytea NOT NULL,
+		    expires_at timestamp without time zone NOT NULL,
+		    updated_at timestamp without time zone NOT NULL DEFAULT now()
+		);
+	`, `
+		CREATE TABLE addon_grants (
+		    id integer PRIMARY KEY,
+		    provider_resource_id text NOT NULL UNIQUE,
+		    secret_backend text NOT NULL,
+		    token blob NOT NULL,
+		    expires_at timestamp NOT NULL,
+		    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`},
+	{9, "app transfers", `
+		-- Set when the resource's app moved to another team and the resource stayed behind.
+		ALTER TABLE addon_resources ADD COLUMN moved_to_owner_uuid character varying;
+		CREATE TABLE team_policies (
+		    owner_uuid character varying PRIMARY KEY,
+		    app_transfer character varying NOT NULL,
+		    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`, ""},
+	{10, "user sessions", `
+		CREATE TABLE user_sessions (
+		    id bigserial PRIMARY KEY,
+		    -- SHA-256 of the session id in the user's cookie.
+		    id_hash character varying NOT NULL UNIQUE,
+		    user_uuid character varying NOT NULL,
+		    email character varying NOT NULL,
+		    name character varying NOT NULL,
+		    secret_backend character varying NOT NULL,
+		    token bytea NOT NULL,
+		    expires_at timestamp without time zone NOT NULL,
+		    created_at timestamp without time zone NOT NULL,
+		    last_seen_at timestamp without time zone NOT NULL
+		);
+		CREATE INDEX user_sessions_last_seen_at ON user_sessions (last_seen_at);
+	`, `
+		CREATE TABLE user_sessions (
+		    id integer PRIMARY KEY,
+		    id_hash text NOT NULL UNIQUE,
+		    user_uuid text NOT NULL,
+		    email text NOT NULL,
+		    name text NOT NULL,
+		    secret_backend text NOT NULL,
+		    token blob NOT NULL,
+		    expires_at timestamp NOT NULL,
+		    created_at timestamp NOT NULL,
+		    last_seen_at timestamp NOT NULL
+		);
+		CREATE INDEX user_sessions_last_seen_at ON user_sessions (last_seen_at);
+	`},
+	{11, "api tokens", `
+		CREATE TABLE api_tokens (
+		    id bigserial PRIMARY KEY,
+		    name character varying NOT NULL UNIQUE,
+		    -- SHA-256 of the token.
+		    token_hash character varying NOT NULL UNIQUE,
+		    -- Space separated.
+		    scopes character varying NOT NULL,
+		    created_at timestamp without time zone NOT NULL,
+		    last_used_at timestamp without time zone
+		);
+	`, `
+		CREATE TABLE api_tokens (
+		    id integer PRIMARY KEY,
+		    name text NOT NULL UNIQUE,
+		    token_hash text NOT NULL UNIQUE,
+		    scopes text NOT NULL,
+		    created_at timestamp NOT NULL,
+		    last_used_at timestamp
+		);
+	`},
+	{12, "usage collection runs", `
+		-- A single row with the time a process last started collecting usage. Every web dyno
+		-- collects, so they claim each run here first.
+		CREATE TABLE usage_collection_runs (
+		    id integer PRIMARY KEY,
+		    started_at timestamp without time zone NOT NULL
+		);
+	`, ""},
+}
+
+// Applies all pending migrations in a single transaction. On Postgres the transaction holds an
+// advisory lock, so a second process waits and then finds nothing left to do.
+func (c *DbController) Migrate() error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := c.dialect.lockMigrations(tx); err != nil {
+		logger.Print("Error acquiring migration lock: ", err)
+		return err
+	}
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+		    version integer PRIMARY KEY,
+		    name character varying NOT NULL,
+		    applied_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		logger.Print("Error creating schema_migrations: ", err)
+		return err
+	}
+	var current int
+	if err := tx.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		logger.Print("Error reading schema version: ", err)
+		return err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(tx, m, c.dialect); err != nil {
+			return err
+		}
+		applied++
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Print("Error committing migrations: ", err)
+		return err
+	}
+	if applied > 0 {
+		logger.Print("Applied ", applied, " migrations. Schema is at version ", migrations[len(migrations)-1].version)
+	} else {
+		logger.Print("Schema is up to date at version ", current)
+	}
+	return nil
+}
+
+func applyMigration(tx *sql.Tx, m migration, d dialect) error {
+	logger.Print("Applying migration ", m.version, ": ", m.name)
+	if _, err := tx.Exec(m.sqlFor(d)); err != nil {
+		logger.Print("Migration ", m.version, " failed: ", err)
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name)
+	if err != nil {
+		logger.Print("Error recording migration ", m.version, ": ", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+//go:build !sqlite
+// +build !sqlite
+
+package database
+
+const sqliteAvailable = false
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// A user signed in to the management pages. Sessions are looked up by a hash of the id in the
+// user's cookie, so the table alone can't be used to take one over.
+type UserSession struct {
+	IdHash       string
+	UserId       string
+	Email        string
+	Name         string
+	AccessToken  string
+	RefreshToken string
+	// When the access token expires. Zero if unknown.
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+func (c *DbController) SaveUserSession(session *UserSession) error {
+	plaintext, err := json.Marshal(grantTokens{session.AccessToken, session.RefreshToken})
+	if err != nil {
+		return err
+	}
+	backend, encrypted, err := c.encrypt(string(plaintext))
+	if err != nil {
+		logger.Print("Error encrypting session tokens: ", err)
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT INTO user_sessions (id_hash, user_uuid, email, name, secret_backend, token, expires_at, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		session.IdHash, session.UserId, session.Email, session.Name, backend, encrypted,
+		session.ExpiresAt.UTC(), session.CreatedAt.UTC(), session.LastSeenAt.UTC())
+	if err != nil {
+		logger.Print("Error saving session: ", err)
+	}
+	return err
+}
+
+func (c *DbController) FindUserSession(idHash string) (session UserSession, found bool, err error) {
+	var backend string
+	var encrypted []byte
+	err = c.db.QueryRow(`
+		SELECT user_uuid, email, name, secret_backend, token, expires_at, created_at, last_seen_at
+		FROM   user_sessions
+		WHERE  id_hash = $1`, idHash).Scan(&session.UserId, &session.Email, &session.Name,
+		&backend, &encrypted, &session.ExpiresAt, &session.CreatedAt, &session.LastSeenAt)
+	if err == sql.ErrNoRows {
+		return session, false, nil
+	}
+	if err != nil {
+		logger.Print("Error querying database for session: ", err)
+		return session, false, err
+	}
+	plaintext, err := c.decrypt(backend, encrypted)
+	if err != nil {
+		logger.Print("Error decrypting session tokens: ", err)
+		return session, false, err
+	}
+	var tokens grantTokens
+	if err := json.Unmarshal([]byte(plaintext), &tokens); err != nil {
+		return session, false, err
+	}
+	session.IdHash, session.AccessToken, session.RefreshToken = idHash, tokens.AccessToken, tokens.RefreshToken
+	return session, true, nil
+}
+
+// Replaces the session's tokens after they were refreshed.
+func (c *DbController) UpdateUserSessionTokens(idHash string, accessToken string, refreshToken string, expiresAt time.Time) error {
+	plaintext, err := json.Marshal(grantTokens{accessToken, refreshToken})
+	if err != nil {
+		return err
+	}
+	backend, encrypted, err := c.encrypt(string(plaintext))
+	if err != nil {
+		logger.Print("Error encrypting session tokens: ", err)
+		return err
+	}
+	_, err = c.db.Exec(`
+		UPDATE user_sessions SET secret_backend = $2, token = $3, expires_at = $4 WHERE id_hash = $1`,
+		idHash, backend, encrypted, expiresAt.UTC())
+	if err != nil {
+		logger.Print("Error updating session tokens: ", err)
+	}
+	return err
+}
+
+func (c *DbController) TouchUserSession(idHash string, lastSeenAt time.Time) error {
+	_, err := c.db.Exec(`UPDATE user_sessions SET last_seen_at = $2 WHERE id_hash = $1`, idHash, lastSeenAt.UTC())
+	if err != nil {
+		logger.Print("Error updating session: ", err)
+	}
+	return err
+}
+
+func (c *DbController) DeleteUserSession(idHash string) error {
+	if _, err := c.db.Exec(`DELETE FROM user_sessions WHERE id_hash = $1`, idHash); err != nil {
+		logger.Print("Error deleting session: ", err)
+		return err
+	}
+	return nil
+}
+
+// Deletes sessions idle since before lastSeenBefore or started before createdBefore.
+func (c *DbController) DeleteExpiredUserSessions(lastSeenBefore time.Time, createdBefore time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM user_sessions WHERE last_seen_at < $1 OR created_at < $2`,
+		lastSeenBefore.UTC(), createdBefore.UTC())
+	if err != nil {
+		logger.Print("Error deleting expired sessions: ", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,17 @@
+//go:build sqlite
+// +build sqlite
+
+package database
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLite needs cgo and github.com/mattn/go-sqlite3, so it's only built with -tags sqlite.
+const sqliteAvailable = true
+
+func init() {
+	sql.Register(sqliteDriver, rebindDriver{&sqlite3.SQLiteDriver{}})
+}
@@ -0,0 +1,183 @@
+//go:build sqlite
+// +build sqlite
+
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jesperfj/byodemo/secrets"
+	"github.com/jesperfj/byodemo/secrets/secretstest"
+)
+
+// A migrated in-memory SQLite database that encrypts with a fresh Fernet key.
+func newSQLiteController(t *testing.T) *DbController {
+	t.Helper()
+	store, err := secrets.NewFernetStore(secrets.GenerateFernetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewController("sqlite::memory:", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	if err := c.Migrate(); err != nil {
+		t.Fatal("Migrating: ", err)
+	}
+	return &c
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	c := newSQLiteController(t)
+	// Migrating again has nothing to do.
+	if err := c.Migrate(); err != nil {
+		t.Fatal("Migrating again: ", err)
+	}
+	var applied, latest int
+	if err := c.db.QueryRow(`SELECT count(*), max(version) FROM schema_migrations`).Scan(&applied, &latest); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) || latest != migrations[len(migrations)-1].version {
+		t.Errorf("Applied %d migrations up to version %d, want %d up to %d",
+			applied, latest, len(migrations), migrations[len(migrations)-1].version)
+	}
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	c := newSQLiteController(t)
+
+	account := &Account{OwnerId: "team", Alias: "prod", AWSAccessKeyId: "AKIAPROD", AWSSecretAccessKey: "prod-secret"}
+	if err := c.SaveAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Id == 0 || !account.IsDefault {
+		t.Errorf("First account saved as %+v, want an id and default", account)
+	}
+	found, err := c.FindAccount("team", account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.AWSSecretAccessKey != "prod-secret" {
+		t.Errorf("Secret decrypted to %q", found.AWSSecretAccessKey)
+	}
+	if _, err := c.FindAccount("other-team", account.Id); err == nil {
+		t.Error("Found the account for another owner")
+	}
+	accounts, err := c.FindAccounts([]string{"team", "other-team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts["team"]) != 1 || len(accounts["other-team"]) != 0 {
+		t.Errorf("FindAccounts returned %+v", accounts)
+	}
+
+	resource := &AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1", AppId: "app1", AppName: "app",
+		AWSAccessKeyId: "AKIAUSER", BucketName: "bucket", Plan: "basic", AccountId: account.Id}
+	if err := c.SaveAddonResource(resource); err != nil {
+		t.Fatal(err)
+	}
+	forAddon, saved, err := c.FindAccountForAddon("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forAddon.Id != account.Id || saved != *resource {
+		t.Errorf("FindAccountForAddon returned %+v and %+v", forAddon, saved)
+	}
+
+	// Saving a grant again replaces it.
+	for _, token := range []string{"first", "second"} {
+		if err := c.SaveAddonGrant(&AddonGrant{ProviderId: "p1", AccessToken: token, RefreshToken: "refresh"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grant, ok, err := c.FindAddonGrant("p1")
+	if err != nil || !ok || grant.AccessToken != "second" {
+		t.Errorf("FindAddonGrant returned %+v, %v, %v", grant, ok, err)
+	}
+
+	rewritten, err := c.ReencryptSecrets()
+	if err != nil || rewritten != 0 {
+		t.Errorf("Re-encrypting current secrets rewrote %d: %v", rewritten, err)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return newSQLiteController(t) })
+}
+
+// Opens and migrates the SQLite file at path, closing it when the test ends.
+func openSQLiteFile(t *testing.T, path string, current secrets.SecretStore, previous ...secrets.SecretStore) *DbController {
+	t.Helper()
+	c, err := NewController("sqlite:"+path, current, previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	if err := c.Migrate(); err != nil {
+		t.Fatal("Migrating: ", err)
+	}
+	return &c
+}
+
+// Moves the secrets from Fernet to Vault the way the migrate-secrets command does.
+func TestSQLiteMigrateSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "byodemo.db")
+	fernet, err := secrets.NewFernetStore(secrets.GenerateFernetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := secretstest.NewVault("vault-token", "byodemo")
+	defer server.Close()
+	vault := secrets.NewVaultStore(server.URL, "vault-token", "byodemo")
+
+	before := openSQLiteFile(t, path, fernet)
+	account := &Account{OwnerId: "team", Alias: "prod", AWSAccessKeyId: "AKIAPROD", AWSSecretAccessKey: "prod-secret"}
+	if err := before.SaveAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.SaveAddonGrant(&AddonGrant{ProviderId: "p1", AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.SaveUserSession(&UserSession{IdHash: "session", UserId: "user", AccessToken: "user-access"}); err != nil {
+		t.Fatal(err)
+	}
+	// Secrets read the same whichever store they're in.
+	check := func(c *DbController, when string) {
+		t.Helper()
+		if found, err := c.FindAccount("team", account.Id); err != nil || found.AWSSecretAccessKey != "prod-secret" {
+			t.Errorf("%s, the account is %+v: %v", when, found, err)
+		}
+		if grant, _, err := c.FindAddonGrant("p1"); err != nil || grant.AccessToken != "access" || grant.RefreshToken != "refresh" {
+			t.Errorf("%s, the grant is %+v: %v", when, grant, err)
+		}
+		if session, _, err := c.FindUserSession("session"); err != nil || session.AccessToken != "user-access" {
+			t.Errorf("%s, the session is %+v: %v", when, session, err)
+		}
+	}
+	before.db.Close()
+
+	migrating := openSQLiteFile(t, path, vault, fernet)
+	check(migrating, "Before migrating")
+	if rewritten, err := migrating.ReencryptSecrets(); err != nil || rewritten != 3 {
+		t.Fatalf("Migrating rewrote %d secrets: %v", rewritten, err)
+	}
+	if rewritten, err := migrating.ReencryptSecrets(); err != nil || rewritten != 0 {
+		t.Errorf("Migrating again rewrote %d secrets: %v", rewritten, err)
+	}
+	for _, e := range encryptedColumns {
+		var left int
+		migrating.db.QueryRow(`SELECT count(*) FROM `+e.table+` WHERE secret_backend <> $1`, secrets.VaultName).Scan(&left)
+		if left != 0 {
+			t.Errorf("%d secrets in %s aren't in Vault", left, e.table)
+		}
+	}
+	migrating.db.Close()
+
+	// The Fernet key can go now.
+	check(openSQLiteFile(t, path, vault), "After migrating")
+	if _, err := openSQLiteFile(t, path, fernet).FindAccount("team", account.Id); err == nil {
+		t.Error("Read a Vault secret without Vault")
+	}
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"time"
+)
+
+// Everything the web app and background jobs read and write. DbController is the SQL
+// implementation, on Postgres or SQLite. MemoryStore keeps everything in memory for tests and
+// local experiments. Schema migrations and key rotation only make sense for SQL and are not part of it.
+type Store interface {
+	// Accounts
+	FindAccount(ownerId string, accountId int64) (Account, error)
+	FindDefaultAccount(ownerId string) (Account, error)
+	FindAccountByAlias(ownerId string, alias string) (account Account, found bool, err error)
+	FindAccounts(ownerIds []string) (map[string][]Account, error)
+	FindAccountForAddon(providerId string) (Account, AddonResource, error)
+	SaveAccount(newAccount *Account) error
+	SetDefaultAccount(ownerId string, accountId int64) error
+	UpdateAccountCredentials(account *Account, replacedBy string) error
+	FindAccountKeyHistory(accountId int64) ([]AccountKeyChange, error)
+	DeleteAccount(ownerId string, accountId int64) error
+	DetachAccount(ownerId string, accountId int64) error
+	PurgeDetachedAccount(accountId int64) error
+	TransferAccountResources(ownerId string, fromAccountId int64, toAccountId int64) error
+
+	// Add-on resources
+	FindAddonResource(addonId string) (AddonResource, error)
+	FindActiveAddonResources() ([]AddonResource, error)
+	FindAccountResources(accountId int64) ([]AddonResource, error)
+	SaveAddonResource(newAddonResource *AddonResource) error
+	MarkResourceForDeletion(providerId string) error
+	SetDeleted(providerId string) error
+	SetPlan(providerId string, plan string) error
+
+	// Apps that are renamed or move to another team
+	SetAppName(providerId string, appName string) error
+	MoveResource(providerId string, ownerId string, accountId int64) error
+	FlagResourceMoved(providerId string, ownerId string) error
+	FindTeamPolicy(ownerId string) (TeamPolicy, error)
+	SaveTeamPolicy(policy *TeamPolicy) error
+
+	// Usage
+	SaveBucketUsage(usage *BucketUsage) error
+	FindLatestUsage(ownerIds []string) ([]ResourceUsage, error)
+	FindUsageHistory(ownerId string, since time.Time) ([]ResourceUsage, error)
+	// True if no process started collecting usage within interval before now, in which case the
+	// caller should collect.
+	ClaimUsageCollection(now time.Time, interval time.Duration) (claimed bool, err error)
+
+	// Bucket settings history
+	SaveSettingsChange(change *SettingsChange) error
+	FindSettingsChanges(providerId string, limit int) ([]SettingsChange, error)
+
+	// Registered and shared buckets
+	SaveRegisteredBucket(registered *RegisteredBucket) error
+	FindRegisteredBuckets(ownerId string) ([]RegisteredBucket, error)
+	FindRegisteredBucket(ownerId string, bucketName string) (registered RegisteredBucket, found bool, err error)
+	DeleteRegisteredBucket(ownerId string, bucketName string) error
+	FindSharedBucket(accountId int64) (bucketName string, found bool, err error)
+	SaveSharedBucket(ownerId string, accountId int64, bucketName string) error
+	IsPrefixInUse(bucketName string, prefix string) (bool, error)
+	IsBucketInUse(bucketName string) (bool, error)
+
+	// OAuth grants of add-on resources
+	SaveAddonGrant(grant *AddonGrant) error
+	FindAddonGrant(providerId string) (grant AddonGrant, found bool, err error)
+	DeleteAddonGrant(providerId string) error
+
+	// Signed in users
+	SaveUserSession(session *UserSession) error
+	FindUserSession(idHash string) (session UserSession, found bool, err error)
+	UpdateUserSessionTokens(idHash string, accessToken string, refreshToken string, expiresAt time.Time) error
+	TouchUserSession(idHash string, lastSeenAt time.Time) error
+	DeleteUserSession(idHash string) error
+	DeleteExpiredUserSessions(lastSeenBefore time.Time, createdBefore time.Time) (int64, error)
+
+	// Operator API tokens
+	SaveAPIToken(token *APIToken) error
+	FindAPIToken(tokenHash string) (token APIToken, found bool, err error)
+	FindAPITokens() ([]APIToken, error)
+	TouchAPIToken(id int64, lastUsedAt time.Time) error
+	DeleteAPIToken(name string) (found bool, err error)
+
+	// Audit log
+	SaveAuditEvent(event *AuditEvent) error
+	FindAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+}
+
+var _ Store = &DbController{}
+var _ Store = &MemoryStore{}
@@ -0,0 +1,498 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// Behaviour every Store shares, so handlers tested over MemoryStore see what they'd see on
+// Postgres. Runs against MemoryStore here and against DbController on SQLite in sqlite_test.go.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"accounts", testAccounts},
+		{"detached accounts", testDetachedAccounts},
+		{"resources", testResources},
+		{"transferring account resources", testTransferAccountResources},
+		{"app transfers", testAppTransfers},
+		{"usage", testUsage},
+		{"usage collection claims", testUsageCollectionClaims},
+		{"settings changes", testSettingsChanges},
+		{"registered and shared buckets", testRegisteredAndSharedBuckets},
+		{"add-on grants", testAddonGrants},
+		{"user sessions", testUserSessions},
+		{"API tokens", testAPITokens},
+		{"audit events", testAuditEvents},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) { test.run(t, newStore(t)) })
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(*testing.T) Store { return NewMemoryStore() })
+}
+
+func mustSaveAccount(t *testing.T, s Store, ownerId string, alias string) Account {
+	t.Helper()
+	account := &Account{OwnerId: ownerId, Alias: alias, AWSAccessKeyId: "AKIA" + alias, AWSSecretAccessKey: alias + "-secret"}
+	if err := s.SaveAccount(account); err != nil {
+		t.Fatal("Saving account: ", err)
+	}
+	return *account
+}
+
+func mustSaveResource(t *testing.T, s Store, resource AddonResource) AddonResource {
+	t.Helper()
+	if err := s.SaveAddonResource(&resource); err != nil {
+		t.Fatal("Saving resource: ", err)
+	}
+	return resource
+}
+
+func aliases(accounts []Account) []string {
+	result := make([]string, len(accounts))
+	for i, a := range accounts {
+		result[i] = a.Alias
+		if a.IsDefault {
+			result[i] += "*"
+		}
+	}
+	return result
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testAccounts(t *testing.T, s Store) {
+	prod := mustSaveAccount(t, s, "team", "prod")
+	sandbox := mustSaveAccount(t, s, "team", "sandbox")
+	mustSaveAccount(t, s, "other", "prod")
+	if !prod.IsDefault || sandbox.IsDefault {
+		t.Errorf("Only the first account should be default: %+v %+v", prod, sandbox)
+	}
+	if err := s.SaveAccount(&Account{OwnerId: "team", Alias: "sandbox"}); err == nil {
+		t.Error("Saved a second account named sandbox")
+	}
+	empty := Account{OwnerId: "blank"}
+	if err := s.SaveAccount(&empty); err != nil || empty.Alias != DefaultAccountAlias {
+		t.Errorf("Saving without an alias gave %q: %v", empty.Alias, err)
+	}
+
+	found, err := s.FindAccount("team", prod.Id)
+	if err != nil || found.AWSSecretAccessKey != "prod-secret" {
+		t.Errorf("FindAccount returned %+v, %v", found, err)
+	}
+	if _, err := s.FindAccount("other", prod.Id); err == nil {
+		t.Error("Found an account for another owner")
+	}
+	if a, ok, err := s.FindAccountByAlias("team", "sandbox"); err != nil || !ok || a.Id != sandbox.Id {
+		t.Errorf("FindAccountByAlias returned %+v, %v, %v", a, ok, err)
+	}
+	if _, ok, err := s.FindAccountByAlias("team", "missing"); err != nil || ok {
+		t.Errorf("FindAccountByAlias found a missing alias: %v", err)
+	}
+
+	if err := s.SetDefaultAccount("team", sandbox.Id); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := s.FindDefaultAccount("team"); err != nil || a.Id != sandbox.Id {
+		t.Errorf("Default after SetDefaultAccount is %+v, %v", a, err)
+	}
+	accounts, err := s.FindAccounts([]string{"team", "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aliases(accounts["team"]); !equalStrings(got, []string{"sandbox*", "prod"}) {
+		t.Errorf("FindAccounts returned %v, want the default first", got)
+	}
+	if _, ok := accounts["nobody"]; ok || len(accounts) != 1 {
+		t.Errorf("FindAccounts returned owners that weren't asked for or have no accounts: %v", accounts)
+	}
+
+	updated := prod
+	updated.AWSAccessKeyId, updated.AWSSecretAccessKey = "AKIANEW", "new-secret"
+	if err := s.UpdateAccountCredentials(&updated, "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.FindAccount("team", prod.Id); a.AWSAccessKeyId != "AKIANEW" || a.AWSSecretAccessKey != "new-secret" {
+		t.Errorf("Credentials after update are %+v", a)
+	}
+	history, err := s.FindAccountKeyHistory(prod.Id)
+	if err != nil || len(history) != 1 || history[0].AWSAccessKeyId != "AKIAprod" || history[0].ReplacedBy != "admin@example.com" {
+		t.Errorf("Key history is %+v, %v", history, err)
+	}
+
+	// Deleting the default makes the oldest remaining account default.
+	if err := s.DeleteAccount("team", sandbox.Id); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := s.FindDefaultAccount("team"); err != nil || a.Id != prod.Id {
+		t.Errorf("Default after deleting the old one is %+v, %v", a, err)
+	}
+}
+
+func testDetachedAccounts(t *testing.T, s Store) {
+	account := mustSaveAccount(t, s, "team", "prod")
+	mustSaveResource(t, s, AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1", BucketName: "b1", AccountId: account.Id})
+	if err := s.DetachAccount("team", account.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindAccount("team", account.Id); err == nil {
+		t.Error("Found a detached account")
+	}
+	if accounts, _ := s.FindAccounts([]string{"team"}); len(accounts["team"]) != 0 {
+		t.Errorf("FindAccounts returned detached accounts: %+v", accounts)
+	}
+	// Deprovisioning still needs the detached account's credentials.
+	if a, _, err := s.FindAccountForAddon("p1"); err != nil || a.AWSSecretAccessKey != "prod-secret" {
+		t.Errorf("FindAccountForAddon after detaching returned %+v, %v", a, err)
+	}
+	if err := s.PurgeDetachedAccount(account.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.FindAccountForAddon("p1"); err != nil {
+		t.Error("Purged a detached account that a resource still uses")
+	}
+	s.SetDeleted("p1")
+	if err := s.PurgeDetachedAccount(account.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.FindAccountForAddon("p1"); err == nil {
+		t.Error("Detached account wasn't purged after its last resource was deleted")
+	}
+}
+
+func testResources(t *testing.T, s Store) {
+	account := mustSaveAccount(t, s, "team", "prod")
+	beta := mustSaveResource(t, s, AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1", AppId: "app1",
+		AppName: "beta", AWSAccessKeyId: "AKIAUSER", BucketName: "b1", Plan: "basic", AccountId: account.Id})
+	mustSaveResource(t, s, AddonResource{OwnerId: "team", ProviderId: "p2", AddonId: "a2", AppName: "alpha",
+		BucketName: "shared", BucketPrefix: "p2/", Plan: "shared", AccountId: account.Id})
+	if err := s.SaveAddonResource(&AddonResource{OwnerId: "team", ProviderId: "p3", AddonId: "a3",
+		BucketName: "b1", AccountId: account.Id}); err == nil {
+		t.Error("Saved a second resource for bucket b1")
+	}
+
+	if r, err := s.FindAddonResource("a1"); err != nil || r != beta {
+		t.Errorf("FindAddonResource returned %+v, %v", r, err)
+	}
+	resources, err := s.FindAccountResources(account.Id)
+	if err != nil || len(resources) != 2 || resources[0].AppName != "alpha" {
+		t.Errorf("FindAccountResources returned %+v, %v", resources, err)
+	}
+	if used, _ := s.IsPrefixInUse("shared", "p2/"); !used {
+		t.Error("Prefix p2/ isn't in use")
+	}
+	if used, _ := s.IsBucketInUse("b1"); !used {
+		t.Error("Bucket b1 isn't in use")
+	}
+
+	if err := s.SetPlan("p1", "premium"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkResourceForDeletion("p1"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.FindAddonResource("a1")
+	if err != nil || !r.MarkedForDeletion || r.Plan != "premium" {
+		t.Errorf("Resource marked for deletion is %+v, %v", r, err)
+	}
+	if active, _ := s.FindActiveAddonResources(); len(active) != 1 || active[0].ProviderId != "p2" {
+		t.Errorf("Active resources are %+v", active)
+	}
+	if err := s.SetDeleted("p1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindAddonResource("a1"); err == nil {
+		t.Error("Found a deleted resource")
+	}
+	if used, _ := s.IsBucketInUse("b1"); used {
+		t.Error("Bucket of a deleted resource is still in use")
+	}
+}
+
+func testTransferAccountResources(t *testing.T, s Store) {
+	from := mustSaveAccount(t, s, "team", "old")
+	to := mustSaveAccount(t, s, "team", "new")
+	other := mustSaveAccount(t, s, "other", "prod")
+	mustSaveResource(t, s, AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1", BucketName: "b1", AccountId: from.Id})
+	if err := s.SaveSharedBucket("team", from.Id, "shared"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferAccountResources("team", from.Id, other.Id); err == nil {
+		t.Error("Transferred resources to another owner's account")
+	}
+	if err := s.TransferAccountResources("team", from.Id, to.Id); err != nil {
+		t.Fatal(err)
+	}
+	if a, _, err := s.FindAccountForAddon("p1"); err != nil || a.Id != to.Id {
+		t.Errorf("Resource is on account %+v after the transfer: %v", a, err)
+	}
+	if name, found, _ := s.FindSharedBucket(to.Id); !found || name != "shared" {
+		t.Errorf("Shared bucket of the target is %q, %v", name, found)
+	}
+	if _, found, _ := s.FindSharedBucket(from.Id); found {
+		t.Error("Old account still has a shared bucket")
+	}
+}
+
+func testAppTransfers(t *testing.T, s Store) {
+	account := mustSaveAccount(t, s, "team", "prod")
+	target := mustSaveAccount(t, s, "new-team", "prod")
+	mustSaveResource(t, s, AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1", AppName: "app",
+		BucketName: "b1", AccountId: account.Id})
+
+	if policy, err := s.FindTeamPolicy("team"); err != nil || policy.AppTransfer != AppTransferFlag {
+		t.Errorf("Default policy is %+v, %v", policy, err)
+	}
+	for _, appTransfer := range []string{AppTransferMigrate, AppTransferFlag, AppTransferMigrate} {
+		if err := s.SaveTeamPolicy(&TeamPolicy{OwnerId: "team", AppTransfer: appTransfer}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if policy, _ := s.FindTeamPolicy("team"); policy.AppTransfer != AppTransferMigrate {
+		t.Errorf("Policy after saving migrate last is %+v", policy)
+	}
+
+	s.SetAppName("p1", "renamed")
+	s.FlagResourceMoved("p1", "new-team")
+	if r, _ := s.FindAddonResource("a1"); r.AppName != "renamed" || r.MovedToOwnerId != "new-team" {
+		t.Errorf("Renamed and flagged resource is %+v", r)
+	}
+	s.MoveResource("p1", "new-team", target.Id)
+	r, _ := s.FindAddonResource("a1")
+	if r.OwnerId != "new-team" || r.AccountId != target.Id || r.MovedToOwnerId != "" {
+		t.Errorf("Moved resource is %+v", r)
+	}
+}
+
+func testUsage(t *testing.T, s Store) {
+	account := mustSaveAccount(t, s, "team", "prod")
+	mustSaveResource(t, s, AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1", AppName: "app",
+		BucketName: "b1", AccountId: account.Id})
+	mustSaveResource(t, s, AddonResource{OwnerId: "other", ProviderId: "p2", AddonId: "a2", AppName: "app",
+		BucketName: "b2", AccountId: account.Id})
+	earlier := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	later := earlier.Add(time.Hour)
+	for _, u := range []BucketUsage{
+		{ProviderId: "p1", ObjectCount: 1, TotalBytes: 10, CollectedAt: earlier},
+		{ProviderId: "p1", ObjectCount: 2, TotalBytes: 20, CollectedAt: later},
+		{ProviderId: "p2", ObjectCount: 5, TotalBytes: 50, CollectedAt: later},
+	} {
+		if err := s.SaveBucketUsage(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest, err := s.FindLatestUsage([]string{"team"})
+	if err != nil || len(latest) != 1 || latest[0].TotalBytes != 20 || latest[0].AppName != "app" {
+		t.Errorf("Latest usage is %+v, %v", latest, err)
+	}
+	history, err := s.FindUsageHistory("team", earlier.Add(time.Minute))
+	if err != nil || len(history) != 1 || !history[0].CollectedAt.Equal(later) {
+		t.Errorf("Usage history is %+v, %v", history, err)
+	}
+}
+
+func testUsageCollectionClaims(t *testing.T, s Store) {
+	start := time.Now().UTC().Truncate(time.Second)
+	for _, test := range []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, true},
+		// Another process, just after.
+		{time.Second, false},
+		{time.Hour - time.Second, false},
+		{time.Hour, true},
+		{time.Hour + time.Minute, false},
+	} {
+		if claimed, err := s.ClaimUsageCollection(start.Add(test.after), time.Hour); err != nil || claimed != test.want {
+			t.Errorf("Claim %v after the first is %v, %v, want %v", test.after, claimed, err, test.want)
+		}
+	}
+}
+
+func testSettingsChanges(t *testing.T, s Store) {
+	for _, setting := range []string{"cors", "lifecycle", "website"} {
+		if err := s.SaveSettingsChange(&SettingsChange{ProviderId: "p1", Actor: "dev", Setting: setting, Document: "{}"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, err := s.FindSettingsChanges("p1", 2)
+	if err != nil || len(changes) != 2 || changes[0].Setting != "website" || changes[1].Setting != "lifecycle" {
+		t.Errorf("Settings changes are %+v, %v", changes, err)
+	}
+}
+
+func testRegisteredAndSharedBuckets(t *testing.T, s Store) {
+	account := mustSaveAccount(t, s, "team", "prod")
+	registered := &RegisteredBucket{OwnerId: "team", AccountId: account.Id, BucketName: "existing", RegisteredBy: "admin"}
+	if err := s.SaveRegisteredBucket(registered); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveRegisteredBucket(registered); err == nil {
+		t.Error("Registered the same bucket twice")
+	}
+	buckets, err := s.FindRegisteredBuckets("team")
+	if err != nil || len(buckets) != 1 || buckets[0].AccountAlias != "prod" || buckets[0].RegisteredBy != "admin" {
+		t.Errorf("Registered buckets are %+v, %v", buckets, err)
+	}
+	if _, found, _ := s.FindRegisteredBucket("other", "existing"); found {
+		t.Error("Found another team's registered bucket")
+	}
+	s.DeleteRegisteredBucket("team", "existing")
+	if _, found, _ := s.FindRegisteredBucket("team", "existing"); found {
+		t.Error("Found an unregistered bucket")
+	}
+
+	if _, found, _ := s.FindSharedBucket(account.Id); found {
+		t.Error("Found a shared bucket before saving one")
+	}
+	if err := s.SaveSharedBucket("team", account.Id, "shared-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveSharedBucket("team", account.Id, "shared-2"); err == nil {
+		t.Error("Saved a second shared bucket for the account")
+	}
+	if name, found, _ := s.FindSharedBucket(account.Id); !found || name != "shared-1" {
+		t.Errorf("Shared bucket is %q, %v", name, found)
+	}
+}
+
+func testAddonGrants(t *testing.T, s Store) {
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	for _, token := range []string{"first", "second"} {
+		if err := s.SaveAddonGrant(&AddonGrant{ProviderId: "p1", AccessToken: token, RefreshToken: "refresh", ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grant, found, err := s.FindAddonGrant("p1")
+	if err != nil || !found || grant.AccessToken != "second" || grant.RefreshToken != "refresh" || !grant.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Grant is %+v, %v, %v", grant, found, err)
+	}
+	s.DeleteAddonGrant("p1")
+	if _, found, _ := s.FindAddonGrant("p1"); found {
+		t.Error("Found a deleted grant")
+	}
+}
+
+func testUserSessions(t *testing.T, s Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, session := range []UserSession{
+		{IdHash: "fresh", UserId: "u1", Email: "dev@example.com", Name: "Dev", AccessToken: "access",
+			RefreshToken: "refresh", ExpiresAt: now.Add(time.Hour), CreatedAt: now, LastSeenAt: now},
+		{IdHash: "idle", UserId: "u1", Email: "dev@example.com", CreatedAt: now.Add(-3 * time.Hour), LastSeenAt: now.Add(-3 * time.Hour)},
+		{IdHash: "old", UserId: "u1", Email: "dev@example.com", CreatedAt: now.Add(-48 * time.Hour), LastSeenAt: now},
+	} {
+		if err := s.SaveUserSession(&session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveUserSession(&UserSession{IdHash: "fresh", CreatedAt: now, LastSeenAt: now}); err == nil {
+		t.Error("Saved a second session with the same id")
+	}
+	session, found, err := s.FindUserSession("fresh")
+	if err != nil || !found || session.Email != "dev@example.com" || session.AccessToken != "access" || !session.CreatedAt.Equal(now) {
+		t.Errorf("Session is %+v, %v, %v", session, found, err)
+	}
+
+	if err := s.UpdateUserSessionTokens("fresh", "new-access", "new-refresh", now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TouchUserSession("fresh", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	session, _, _ = s.FindUserSession("fresh")
+	if session.AccessToken != "new-access" || session.RefreshToken != "new-refresh" ||
+		!session.ExpiresAt.Equal(now.Add(2*time.Hour)) || !session.LastSeenAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("Refreshed and touched session is %+v", session)
+	}
+
+	deleted, err := s.DeleteExpiredUserSessions(now.Add(-2*time.Hour), now.Add(-24*time.Hour))
+	if err != nil || deleted != 2 {
+		t.Errorf("Deleted %d expired sessions: %v", deleted, err)
+	}
+	if _, found, _ := s.FindUserSession("fresh"); !found {
+		t.Error("Deleted a session that hasn't expired")
+	}
+	s.DeleteUserSession("fresh")
+	if _, found, _ := s.FindUserSession("fresh"); found {
+		t.Error("Found a deleted session")
+	}
+}
+
+func testAPITokens(t *testing.T, s Store) {
+	for _, token := range []APIToken{
+		{Name: "writer", TokenHash: "hash-w", Scopes: []string{ScopeAccountsRead, ScopeAccountsWrite}},
+		{Name: "reader", TokenHash: "hash-r", Scopes: []string{ScopeAccountsRead}},
+	} {
+		if err := s.SaveAPIToken(&token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveAPIToken(&APIToken{Name: "reader", TokenHash: "hash-other"}); err == nil {
+		t.Error("Saved a second token named reader")
+	}
+	token, found, err := s.FindAPIToken("hash-r")
+	if err != nil || !found || token.Name != "reader" || !token.HasScope(ScopeAccountsRead) || token.HasScope(ScopeAccountsWrite) {
+		t.Errorf("Token is %+v, %v, %v", token, found, err)
+	}
+	if !token.LastUsedAt.IsZero() {
+		t.Errorf("Unused token was last used at %v", token.LastUsedAt)
+	}
+	usedAt := time.Now().UTC().Truncate(time.Second)
+	s.TouchAPIToken(token.Id, usedAt)
+	if token, _, _ := s.FindAPIToken("hash-r"); !token.LastUsedAt.Equal(usedAt) {
+		t.Errorf("Token was last used at %v, want %v", token.LastUsedAt, usedAt)
+	}
+	tokens, err := s.FindAPITokens()
+	if err != nil || len(tokens) != 2 || tokens[0].Name != "reader" {
+		t.Errorf("Tokens are %+v, %v", tokens, err)
+	}
+	if found, err := s.DeleteAPIToken("reader"); err != nil || !found {
+		t.Errorf("Deleting reader: %v, %v", found, err)
+	}
+	if found, _ := s.DeleteAPIToken("reader"); found {
+		t.Error("Deleted reader twice")
+	}
+	if _, found, _ := s.FindAPIToken("hash-r"); found {
+		t.Error("Found a deleted token")
+	}
+}
+
+func testAuditEvents(t *testing.T, s Store) {
+	for _, e := range []AuditEvent{
+		{Actor: "dev", OwnerId: "team", Action: "link", Outcome: AuditSuccess},
+		{Actor: "dev", OwnerId: "team", ResourceId: "p1", Action: "provision", Outcome: AuditFailure, Error: "boom"},
+		{Actor: "dev", OwnerId: "team", ResourceId: "p1", Action: "provision", Outcome: AuditSuccess},
+		{Actor: "dev", OwnerId: "other", Action: "link", Outcome: AuditSuccess},
+	} {
+		if err := s.SaveAuditEvent(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := s.FindAuditEvents(AuditFilter{OwnerId: "team"})
+	if err != nil || len(events) != 3 || events[0].Action != "provision" || events[0].Outcome != AuditSuccess {
+		t.Errorf("Team's events are %+v, %v, want newest first", events, err)
+	}
+	events, _ = s.FindAuditEvents(AuditFilter{OwnerId: "team", ResourceId: "p1", Outcome: AuditFailure})
+	if len(events) != 1 || events[0].Error != "boom" {
+		t.Errorf("Failed events of p1 are %+v", events)
+	}
+	events, _ = s.FindAuditEvents(AuditFilter{OwnerId: "team", Action: "provision", Limit: 1})
+	if len(events) != 1 {
+		t.Errorf("Limited events are %+v", events)
+	}
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// What happens to a team's resources when their app moves to another team.
+const (
+	// The resource stays with the team and is flagged as moved. The team's admins decide what's next.
+	AppTransferFlag = "flag"
+	// The resource moves with the app if the new team has linked the same AWS account.
+	AppTransferMigrate = "migrate"
+)
+
+type TeamPolicy struct {
+	OwnerId     string
+	AppTransfer string
+}
+
+// Teams that never saved a policy flag moved resources.
+func (c *DbController) FindTeamPolicy(ownerId string) (TeamPolicy, error) {
+	policy := TeamPolicy{OwnerId: ownerId, AppTransfer: AppTransferFlag}
+	err := c.db.QueryRow(
+		"SELECT app_transfer FROM team_policies WHERE owner_uuid = $1", ownerId).Scan(&policy.AppTransfer)
+	if err == sql.ErrNoRows {
+		return policy, nil
+	}
+	if err != nil {
+		logger.Print("Error querying database for team policy: ", err)
+	}
+	return policy, err
+}
+
+func (c *DbController) SaveTeamPolicy(policy *TeamPolicy) error {
+	_, err := c.db.Exec(
+		`INSERT INTO team_policies (owner_uuid, app_transfer)
+		 VALUES ($1,$2)
+		 ON CONFLICT (owner_uuid) DO UPDATE SET app_transfer = $2, updated_at = CURRENT_TIMESTAMP`,
+		policy.OwnerId, policy.AppTransfer)
+	if err != nil {
+		logger.Print("Error saving team policy: ", err)
+	}
+	return err
+}
+
+func (c *DbController) SetAppName(providerId string, appName string) error {
+	_, err := c.db.Exec(
+		"UPDATE addon_resources SET app_name = $2 WHERE provider_resource_id = $1",
+		providerId, appName)
+	if err != nil {
+		logger.Print("Error updating app name of resource: ", err)
+	}
+	return err
+}
+
+// Hands the resource to another owner and the owner's account. Clears any moved flag.
+func (c *DbController) MoveResource(providerId string, ownerId string, accountId int64) error {
+	_, err := c.db.Exec(
+		`UPDATE addon_resources SET owner_uuid = $2, account_id = $3, moved_to_owner_uuid = NULL
+		 WHERE provider_resource_id = $1`,
+		providerId, ownerId, accountId)
+	if err != nil {
+		logger.Print("Error moving resource: ", err)
+	}
+	return err
+}
+
+// Records that the resource's app now belongs to ownerId while the resource stays where it is.
+func (c *DbController) FlagResourceMoved(providerId string, ownerId string) error {
+	_, err := c.db.Exec(
+		"UPDATE addon_resources SET moved_to_owner_uuid = $2 WHERE provider_resource_id = $1",
+		providerId, ownerId)
+	if err != nil {
+		logger.Print("Error flagging resource as moved: ", err)
+	}
+	return err
+}
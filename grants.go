@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// Saves the tokens a resource's Platform API client is authorized with, encrypted.
+func saveAddonGrant(providerId string, auth *heroku.Authorization) {
+	err := db.SaveAddonGrant(&database.AddonGrant{
+		ProviderId:   providerId,
+		AccessToken:  auth.AccessToken,
+		RefreshToken: auth.RefreshToken,
+		ExpiresAt:    auth.ExpiresAt,
+	})
+	if err != nil {
+		logger.Print("Couldn't save OAuth grant for ", providerId, ". Later Platform API calls for it will fail: ", err)
+	}
+}
+
+// Keeps saving the grant whenever client refreshes it.
+func persistAddonGrant(providerId string, client *heroku.Client) {
+	client.OnRefresh = func(auth *heroku.Authorization) { saveAddonGrant(providerId, auth) }
+}
+
+// A Platform API client for a resource, authorized with the grant it was provisioned with.
+// The access token is refreshed as needed.
+func addonClient(providerId string) (*heroku.Client, error) {
+	grant, found, err := db.FindAddonGrant(providerId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("No OAuth grant is stored for resource " + providerId)
+	}
+	client := herokuPlatform().WithAuthorization(&heroku.Authorization{
+		AccessToken:  grant.AccessToken,
+		RefreshToken: grant.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    grant.ExpiresAt,
+	})
+	client.ClientSecret = config.clientSecret
+	persistAddonGrant(providerId, client)
+	return client, nil
+}
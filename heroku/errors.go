@@ -0,0 +1,53 @@
+package heroku
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// An error response from the Platform API or Heroku Identity. ID is Heroku's error id, such as
+// "not_found" or "rate_limit". It's empty if the response wasn't Heroku's error JSON.
+type Error struct {
+	StatusCode int    `json:"-"`
+	ID         string `json:"id"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("Heroku API error (%d): %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("Heroku API error (%d %s): %s", e.StatusCode, e.ID, e.Message)
+}
+
+// True if err is an *Error with the given status code.
+func IsStatus(err error, statusCode int) bool {
+	herr, ok := err.(*Error)
+	return ok && herr.StatusCode == statusCode
+}
+
+// How much of an unexpected response body ends up in an Error.
+const maxErrorBody = 1024
+
+// Returns an *Error unless the response has one of the expected status codes.
+func checkResponse(res *http.Response, expectedCodes ...int) error {
+	for _, code := range expectedCodes {
+		if res.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	herr := &Error{}
+	if err := json.Unmarshal(body, herr); err != nil {
+		herr = &Error{Message: strings.TrimSpace(string(body))}
+	}
+	herr.StatusCode = res.StatusCode
+	if herr.Message == "" {
+		herr.Message = http.StatusText(res.StatusCode)
+	}
+	return herr
+}
@@ -0,0 +1,70 @@
+package heroku
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   *Error
+	}{
+		{"expected status", 201, `{"id":"ignored"}`, nil},
+		{"Heroku error", 404, `{"id":"not_found","message":"Couldn't find that add-on."}`,
+			&Error{StatusCode: 404, ID: "not_found", Message: "Couldn't find that add-on."}},
+		{"not JSON", 502, "<html>Bad gateway</html>\n", &Error{StatusCode: 502, Message: "<html>Bad gateway</html>"}},
+		{"empty body", 503, "", &Error{StatusCode: 503, Message: "Service Unavailable"}},
+		{"JSON without a message", 429, `{"id":"rate_limit"}`, &Error{StatusCode: 429, ID: "rate_limit", Message: "Too Many Requests"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			res, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			err = checkResponse(res, 200, 201)
+			if test.want == nil {
+				if err != nil {
+					t.Errorf("Got %v for an expected status", err)
+				}
+				return
+			}
+			herr, ok := err.(*Error)
+			if !ok || *herr != *test.want {
+				t.Errorf("Got %#v, want %#v", err, test.want)
+			}
+			if !IsStatus(err, test.status) {
+				t.Errorf("IsStatus(%v, %d) is false", err, test.status)
+			}
+		})
+	}
+}
+
+func TestCheckResponseTruncatesBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		for i := 0; i < 100; i++ {
+			w.Write([]byte("0123456789012345678901234567890123456789"))
+		}
+	}))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if herr := checkResponse(res, 200).(*Error); len(herr.Message) != maxErrorBody {
+		t.Errorf("Message has %d bytes, want %d", len(herr.Message), maxErrorBody)
+	}
+}
@@ -0,0 +1,142 @@
+package fakeheroku
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// Posts the single sign-on form as soon as it loads, like the Heroku Dashboard does.
+var ssoPage = template.Must(template.New("sso").Parse(`<html>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{ .Action }}">
+{{ range $name, $values := .Form }}<input type="hidden" name="{{ $name }}" value="{{ index $values 0 }}">
+{{ end }}<noscript><button type="submit">Open add-on</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// What `heroku addons:create` would send, for the control API.
+type ProvisionRequest struct {
+	App     string            `json:"app"`
+	Plan    string            `json:"plan"`
+	Options map[string]string `json:"options"`
+}
+
+// Unauthenticated endpoints that play the part of a developer using the Heroku CLI, so a
+// Server running in its own process can be driven with curl:
+//
+//	GET    /fake/addons            lists add-ons
+//	POST   /fake/addons            provisions, with a ProvisionRequest
+//	PUT    /fake/addons/:id        changes plan, with {"plan": "..."}
+//	DELETE /fake/addons/:id        deprovisions
+//	GET    /fake/addons/:id/open   signs on to the add-on's dashboard, in a browser
+//	PATCH  /fake/apps/:id          renames or transfers, with {"name": "...", "team": "..."}
+//	POST   /fake/tokens/expire     expires every access token, to exercise refreshing
+func (s *Server) control(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case r.Method == "GET" && len(path) == 1 && path[0] == "addons":
+		writeJSON(w, 200, s.Addons())
+	case r.Method == "POST" && len(path) == 1 && path[0] == "addons":
+		request := ProvisionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, 400, "bad_request", err.Error())
+			return
+		}
+		app, ok := s.FindApp(request.App)
+		if !ok {
+			writeError(w, 404, "not_found", "Couldn't find that app.")
+			return
+		}
+		addon, err := s.Provision(app, request.Plan, request.Options)
+		if err != nil {
+			writeError(w, 502, "addon_error", err.Error())
+			return
+		}
+		writeJSON(w, 202, addon)
+	case r.Method == "PUT" && len(path) == 2 && path[0] == "addons":
+		request := struct {
+			Plan string `json:"plan"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, 400, "bad_request", err.Error())
+			return
+		}
+		if err := s.ChangePlan(path[1], request.Plan); err != nil {
+			writeError(w, 502, "addon_error", err.Error())
+			return
+		}
+		addon, _ := s.FindAddon(path[1])
+		writeJSON(w, 200, addon)
+	case r.Method == "DELETE" && len(path) == 2 && path[0] == "addons":
+		if err := s.Deprovision(path[1]); err != nil {
+			writeError(w, 502, "addon_error", err.Error())
+			return
+		}
+		addon, _ := s.FindAddon(path[1])
+		writeJSON(w, 200, addon)
+	case r.Method == "GET" && len(path) == 3 && path[0] == "addons" && path[2] == "open":
+		form, err := s.SSOForm(path[1])
+		if err != nil {
+			writeError(w, 404, "not_found", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		ssoPage.Execute(w, struct {
+			Action string
+			Form   url.Values
+		}{s.AddonURL + "/heroku/sso", form})
+	case r.Method == "POST" && len(path) == 2 && path[0] == "tokens" && path[1] == "expire":
+		s.ExpireTokens()
+		w.WriteHeader(204)
+	case r.Method == "PATCH" && len(path) == 2 && path[0] == "apps":
+		request := struct {
+			Name string `json:"name"`
+			Team string `json:"team"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, 400, "bad_request", err.Error())
+			return
+		}
+		var team *heroku.Team
+		if request.Team != "" {
+			var ok bool
+			if team, ok = s.FindTeam(request.Team); !ok {
+				writeError(w, 404, "not_found", "Couldn't find that team.")
+				return
+			}
+		}
+		app, err := s.UpdateApp(path[1], request.Name, team)
+		if err != nil {
+			writeError(w, 404, "not_found", err.Error())
+			return
+		}
+		writeJSON(w, 200, app)
+	default:
+		writeError(w, 404, "not_found", "The requested API endpoint was not found.")
+	}
+}
+
+// The form Heroku posts to the add-on when the logged in user opens the add-on.
+func (s *Server) SSOForm(addonId string) (url.Values, error) {
+	addon, ok := s.FindAddon(addonId)
+	if !ok || addon.State != StateProvisioned {
+		return nil, errors.New("No provisioned add-on with id " + addonId)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return url.Values{
+		"resource_id":    {addon.Id},
+		"timestamp":      {timestamp},
+		"resource_token": {heroku.SSOToken(s.SSOSalt, addon.Id, timestamp)},
+		"email":          {s.Account.Email},
+		"user_id":        {s.Account.Id},
+		"context_app":    {addon.App.Name},
+	}, nil
+}
@@ -0,0 +1,562 @@
+// Package fakeheroku stands in for the parts of Heroku Identity, the Platform API and the add-on
+// provisioning flow that the add-on uses, so the whole add-on can be run and driven locally.
+// Point heroku.Client's APIURL and IdURL at a Server. It keeps everything in memory.
+package fakeheroku
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+var (
+	logger = log.New(os.Stderr, "[fakeheroku] ", log.Ldate|log.Ltime|log.Lshortfile)
+)
+
+// Add-on states, as reported by the Platform API.
+const (
+	StateProvisioning  = "provisioning"
+	StateProvisioned   = "provisioned"
+	StateDeprovisioned = "deprovisioned"
+)
+
+// Seconds, like Heroku's.
+const accessTokenLifetime = 8 * 60 * 60
+
+type Server struct {
+	// Where /oauth/authorize sends the browser back to with a code, like the redirect URL of a
+	// Heroku OAuth client.
+	OAuthCallbackURL string
+	// Base URL of the add-on API, e.g. http://localhost:5000/addon, and the password Heroku
+	// uses with it, like in the add-on manifest.
+	AddonURL      string
+	AddonPassword string
+	// Signs single sign-on requests to the add-on's dashboard.
+	SSOSalt string
+	// The user that logs in through /oauth/authorize.
+	Account heroku.Account
+	// Sends requests to the add-on. Empty means http.DefaultClient.
+	HTTPClient *http.Client
+	// Lists are returned in pages of this many, with Next-Range headers. Zero means all at once.
+	PageSize int
+
+	mu     sync.Mutex
+	teams  []*heroku.Team
+	apps   map[string]*App
+	addons map[string]*Addon
+	// Outstanding OAuth codes, issued access tokens with their expiry, and refresh tokens.
+	codes         map[string]bool
+	tokens        map[string]time.Time
+	refreshTokens map[string]bool
+}
+
+type App struct {
+	heroku.App
+}
+
+type Addon struct {
+	heroku.Addon
+	Plan  string `json:"plan"`
+	State string `json:"state"`
+	// The id the add-on returned when it was provisioned.
+	ProviderId string            `json:"provider_id"`
+	Config     map[string]string `json:"config"`
+	// App webhooks the add-on created.
+	Webhooks []heroku.AddonWebhookRequest `json:"-"`
+}
+
+func New() *Server {
+	return &Server{
+		Account:       heroku.Account{Id: newId(), Email: "developer@heroku.com", Name: "Local Developer"},
+		apps:          make(map[string]*App),
+		addons:        make(map[string]*Addon),
+		codes:         make(map[string]bool),
+		tokens:        make(map[string]time.Time),
+		refreshTokens: make(map[string]bool),
+	}
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Adds a team that the logged in user administers, in enterprise if it isn't nil.
+func (s *Server) AddTeam(name string, enterprise *heroku.EnterpriseAccount) *heroku.Team {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	team := &heroku.Team{Id: newId(), Name: name, Role: "admin", Type: "team", EnterpriseAccount: enterprise}
+	s.teams = append(s.teams, team)
+	return team
+}
+
+// Adds an app owned by the team, or a personal app of the logged in user if team is nil.
+func (s *Server) AddApp(name string, team *heroku.Team) *App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	app := &App{heroku.App{Id: newId(), Name: name}}
+	if team != nil {
+		app.Team = &heroku.AppTeam{Id: team.Id, Name: team.Name}
+		app.Owner = heroku.AppOwner{Id: team.Id, Email: team.Name + "@herokumanager.com"}
+	} else {
+		app.Owner = heroku.AppOwner{Id: s.Account.Id, Email: s.Account.Email}
+	}
+	s.apps[app.Id] = app
+	return app
+}
+
+// Looks a team up by id or name.
+func (s *Server) FindTeam(idOrName string) (*heroku.Team, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, team := range s.teams {
+		if team.Id == idOrName || team.Name == idOrName {
+			return team, true
+		}
+	}
+	return nil, false
+}
+
+// Renames the app and, if team isn't nil, moves it to the team, like `heroku apps:rename` and
+// `heroku apps:transfer`. An empty name keeps the current one. Add-ons subscribed to app webhooks
+// are sent an api:app update, which is done when UpdateApp returns.
+func (s *Server) UpdateApp(idOrName string, name string, team *heroku.Team) (*App, error) {
+	app, ok := s.FindApp(idOrName)
+	if !ok {
+		return nil, errors.New("No app " + idOrName)
+	}
+	s.mu.Lock()
+	if name != "" {
+		app.Name = name
+	}
+	if team != nil {
+		app.Team = &heroku.AppTeam{Id: team.Id, Name: team.Name}
+		app.Owner = heroku.AppOwner{Id: team.Id, Email: team.Name + "@herokumanager.com"}
+	}
+	event := heroku.AppWebhookEvent{Action: "update", Resource: "app", Data: app.App}
+	var webhooks []heroku.AddonWebhookRequest
+	for _, addon := range s.addons {
+		if addon.App.Id == app.Id && addon.State == StateProvisioned {
+			addon.App.Name = app.Name
+			webhooks = append(webhooks, addon.Webhooks...)
+		}
+	}
+	s.mu.Unlock()
+
+	body, _ := json.Marshal(event)
+	for _, webhook := range webhooks {
+		s.deliver(webhook, body)
+	}
+	return app, nil
+}
+
+// Posts a webhook event signed like Heroku does. Failures are only logged, like notify level
+// deliveries that Heroku gives up on.
+func (s *Server) deliver(webhook heroku.AddonWebhookRequest, body []byte) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		logger.Print("Error delivering webhook to ", webhook.URL, ": ", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(heroku.WebhookSignatureHeader, heroku.WebhookSignature(webhook.Secret, body))
+	res, err := s.httpClient().Do(req)
+	if err != nil {
+		logger.Print("Error delivering webhook to ", webhook.URL, ": ", err)
+		return
+	}
+	res.Body.Close()
+	logger.Print("Delivered webhook to ", webhook.URL, ": ", res.StatusCode)
+}
+
+// Looks an app up by id or name.
+func (s *Server) FindApp(idOrName string) (*App, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, app := range s.apps {
+		if app.Id == idOrName || app.Name == idOrName {
+			return app, true
+		}
+	}
+	return nil, false
+}
+
+// A copy of the add-on, to check its state and config.
+func (s *Server) FindAddon(addonId string) (Addon, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addon, ok := s.addons[addonId]
+	if !ok {
+		return Addon{}, false
+	}
+	copied := *addon
+	copied.Config = make(map[string]string)
+	for k, v := range addon.Config {
+		copied.Config[k] = v
+	}
+	return copied, true
+}
+
+func (s *Server) Addons() []Addon {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.addons))
+	for id := range s.addons {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	result := make([]Addon, 0, len(ids))
+	for _, id := range ids {
+		if addon, ok := s.FindAddon(id); ok {
+			result = append(result, addon)
+		}
+	}
+	return result
+}
+
+// Asks the add-on to provision a resource for the app, like `heroku addons:create`. Provisioning
+// is asynchronous. The add-on reports back through the Platform API, so poll FindAddon for the
+// outcome.
+func (s *Server) Provision(app *App, plan string, options map[string]string) (Addon, error) {
+	s.mu.Lock()
+	addon := &Addon{Plan: plan, State: StateProvisioning, Config: make(map[string]string)}
+	addon.Id = newId()
+	addon.Name = "byodemo-" + addon.Id[:8]
+	addon.App = heroku.AddonApp{Id: app.Id, Name: app.Name}
+	s.addons[addon.Id] = addon
+	code := s.newCode()
+	s.mu.Unlock()
+
+	request := heroku.CreateAddonRequest{
+		HerokuId:   "app" + app.Id + "@heroku.com",
+		Plan:       plan,
+		Region:     "amazon-web-services::us-east-1",
+		OAuthGrant: heroku.AddonOAuthGrant{Code: code, GrantType: "authorization_code"},
+		Uuid:       addon.Id,
+		Options:    options,
+	}
+	response := heroku.AsyncCreateAddonResponse{}
+	if err := s.callAddon("POST", "/heroku/resources", request, 202, &response); err != nil {
+		s.setState(addon.Id, StateDeprovisioned)
+		return Addon{}, err
+	}
+	s.mu.Lock()
+	addon.ProviderId = response.Id
+	s.mu.Unlock()
+	provisioned, _ := s.FindAddon(addon.Id)
+	return provisioned, nil
+}
+
+// Asks the add-on to change the resource's plan, like `heroku addons:upgrade`.
+func (s *Server) ChangePlan(addonId string, plan string) error {
+	addon, ok := s.FindAddon(addonId)
+	if !ok {
+		return errors.New("No add-on " + addonId)
+	}
+	request := heroku.AddonPlanChangeRequest{Plan: plan, AppId: addon.App.Id, Uuid: addon.Id}
+	if err := s.callAddon("PUT", "/heroku/resources/"+addon.ProviderId, request, 200, nil); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.addons[addonId].Plan = plan
+	s.mu.Unlock()
+	return nil
+}
+
+// Asks the add-on to deprovision the resource, like `heroku addons:destroy`.
+func (s *Server) Deprovision(addonId string) error {
+	addon, ok := s.FindAddon(addonId)
+	if !ok {
+		return errors.New("No add-on " + addonId)
+	}
+	if err := s.callAddon("DELETE", "/heroku/resources/"+addon.ProviderId, nil, 200, nil); err != nil {
+		return err
+	}
+	s.setState(addonId, StateDeprovisioned)
+	return nil
+}
+
+func (s *Server) setState(addonId string, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if addon, ok := s.addons[addonId]; ok {
+		addon.State = state
+	}
+}
+
+// Must be called with s.mu held.
+func (s *Server) newCode() string {
+	code := newId()
+	s.codes[code] = true
+	return code
+}
+
+func (s *Server) httpClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (s *Server) callAddon(method string, path string, requestData interface{}, expectedCode int, responseData interface{}) error {
+	var body bytes.Buffer
+	if requestData != nil {
+		if err := json.NewEncoder(&body).Encode(requestData); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(s.AddonURL, "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("byodemo", s.AddonPassword)
+	res, err := s.httpClient().Do(req)
+	if err != nil {
+		logger.Print("Error calling add-on: ", err)
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expectedCode {
+		return fmt.Errorf("Add-on answered %s %s with %d", method, path, res.StatusCode)
+	}
+	if responseData != nil {
+		return json.NewDecoder(res.Body).Decode(responseData)
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/oauth/authorize":
+		s.authorize(w, r)
+	case r.Method == "POST" && r.URL.Path == "/oauth/token":
+		s.token(w, r)
+	case path[0] == "fake":
+		s.control(w, r, path[1:])
+	case !s.authorized(r):
+		writeError(w, 401, "unauthorized", "Invalid credentials provided.")
+	case r.Method == "GET" && r.URL.Path == "/account":
+		writeJSON(w, 200, s.Account)
+	case r.Method == "GET" && r.URL.Path == "/teams":
+		s.listTeams(w, r)
+	case r.Method == "GET" && len(path) == 2 && path[0] == "apps":
+		app, ok := s.FindApp(path[1])
+		if !ok {
+			writeError(w, 404, "not_found", "Couldn't find that app.")
+			return
+		}
+		writeJSON(w, 200, app)
+	case r.Method == "GET" && len(path) == 2 && path[0] == "addons":
+		addon, ok := s.FindAddon(path[1])
+		if !ok {
+			writeError(w, 404, "not_found", "Couldn't find that add-on.")
+			return
+		}
+		writeJSON(w, 200, addon)
+	case r.Method == "DELETE" && len(path) == 4 && path[0] == "apps" && path[2] == "addons":
+		s.deleteAddon(w, path[1], path[3])
+	case r.Method == "PATCH" && len(path) == 3 && path[0] == "addons" && path[2] == "config":
+		s.setConfig(w, r, path[1])
+	case r.Method == "POST" && len(path) == 3 && path[0] == "addons" && path[2] == "webhooks":
+		s.createWebhook(w, r, path[1])
+	case r.Method == "POST" && len(path) == 4 && path[0] == "addons" && path[2] == "actions" &&
+		(path[3] == "provision" || path[3] == "deprovision"):
+		s.finishProvisioning(w, path[1], path[3] == "provision")
+	default:
+		writeError(w, 404, "not_found", "The requested API endpoint was not found.")
+	}
+}
+
+// Pages start after the id in a Range header like "id ]<last id>..; max=<page size>", which is
+// what Next-Range asks for.
+func (s *Server) listTeams(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	teams := append([]*heroku.Team{}, s.teams...)
+	s.mu.Unlock()
+	if after := r.Header.Get("Range"); strings.HasPrefix(after, "id ]") {
+		after = strings.TrimPrefix(after, "id ]")
+		after = after[:strings.Index(after+"..", "..")]
+		for i, team := range teams {
+			if team.Id == after {
+				teams = teams[i+1:]
+				break
+			}
+		}
+	}
+	if s.PageSize == 0 || len(teams) <= s.PageSize {
+		writeJSON(w, 200, teams)
+		return
+	}
+	teams = teams[:s.PageSize]
+	w.Header().Set("Next-Range", fmt.Sprintf("id ]%s..; max=%d", teams[len(teams)-1].Id, s.PageSize))
+	writeJSON(w, 206, teams)
+}
+
+// Logs the user in right away and sends the browser back with a code and the client's state.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	if s.OAuthCallbackURL == "" {
+		writeError(w, 400, "bad_request", "No OAuth callback URL is configured.")
+		return
+	}
+	s.mu.Lock()
+	code := s.newCode()
+	s.mu.Unlock()
+	params := url.Values{"code": {code}}
+	if state := r.URL.Query().Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, s.OAuthCallbackURL+"?"+params.Encode(), 302)
+}
+
+// Exchanges a code or a refresh token for an access token. Codes can only be used once.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		code := r.PostFormValue("code")
+		if !s.codes[code] {
+			writeError(w, 401, "unauthorized", "Invalid grant.")
+			return
+		}
+		delete(s.codes, code)
+	case "refresh_token":
+		if !s.refreshTokens[r.PostFormValue("refresh_token")] {
+			writeError(w, 401, "unauthorized", "Invalid refresh token.")
+			return
+		}
+	default:
+		writeError(w, 400, "bad_request", "Unsupported grant type.")
+		return
+	}
+	auth := heroku.Authorization{
+		AccessToken:  newId(),
+		RefreshToken: newId(),
+		ExpiresIn:    accessTokenLifetime,
+		TokenType:    "Bearer",
+	}
+	s.tokens[auth.AccessToken] = time.Now().Add(accessTokenLifetime * time.Second)
+	s.refreshTokens[auth.RefreshToken] = true
+	writeJSON(w, 200, auth)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.tokens[token]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// Expires every access token issued so far, to exercise refreshing. Refresh tokens keep working.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token := range s.tokens {
+		s.tokens[token] = time.Now()
+	}
+}
+
+// Deprovisions the add-on through the add-on API like Heroku does when an add-on is destroyed.
+func (s *Server) deleteAddon(w http.ResponseWriter, appIdOrName string, addonId string) {
+	addon, ok := s.FindAddon(addonId)
+	app, appOk := s.FindApp(appIdOrName)
+	if !ok || !appOk || addon.App.Id != app.Id || addon.State == StateDeprovisioned {
+		writeError(w, 404, "not_found", "Couldn't find that add-on.")
+		return
+	}
+	if err := s.Deprovision(addonId); err != nil {
+		writeError(w, 422, "invalid_params", "The add-on provider failed to deprovision the add-on: "+err.Error())
+		return
+	}
+	addon, _ = s.FindAddon(addonId)
+	writeJSON(w, 200, addon)
+}
+
+func (s *Server) setConfig(w http.ResponseWriter, r *http.Request, addonId string) {
+	config := heroku.AddonConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, 400, "bad_request", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addon, ok := s.addons[addonId]
+	if !ok {
+		writeError(w, 404, "not_found", "Couldn't find that add-on.")
+		return
+	}
+	for _, v := range config.Config {
+		addon.Config[v.Name] = v.Value
+	}
+	result := make([]heroku.ConfigVar, 0, len(addon.Config))
+	for name, value := range addon.Config {
+		result = append(result, heroku.ConfigVar{Name: name, Value: value})
+	}
+	writeJSON(w, 200, result)
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request, addonId string) {
+	request := heroku.AddonWebhookRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, 400, "bad_request", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addon, ok := s.addons[addonId]
+	if !ok {
+		writeError(w, 404, "not_found", "Couldn't find that add-on.")
+		return
+	}
+	addon.Webhooks = append(addon.Webhooks, request)
+	writeJSON(w, 201, heroku.AddonWebhook{Id: newId(), Include: request.Include, Level: request.Level, URL: request.URL})
+}
+
+func (s *Server) finishProvisioning(w http.ResponseWriter, addonId string, success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addon, ok := s.addons[addonId]
+	if !ok {
+		writeError(w, 404, "not_found", "Couldn't find that add-on.")
+		return
+	}
+	if addon.State != StateProvisioning {
+		writeError(w, 422, "invalid_params", "Add-on is "+addon.State+", not "+StateProvisioning+".")
+		return
+	}
+	if success {
+		addon.State = StateProvisioned
+	} else {
+		addon.State = StateDeprovisioned
+	}
+	logger.Print("Add-on ", addon.Name, " is ", addon.State)
+	writeJSON(w, 200, addon)
+}
+
+// Heroku's rate limit, which the fake never runs out of.
+const rateLimit = "4500"
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("RateLimit-Remaining", rateLimit)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, id string, message string) {
+	writeJSON(w, status, map[string]string{"id": id, "message": message})
+}
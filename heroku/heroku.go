@@ -6,20 +6,41 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	logger = log.New(os.Stderr, "[heroku] ", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
+const (
+	DefaultAPIURL = "https://api.heroku.com"
+	DefaultIdURL  = "https://id.heroku.com"
+)
+
 type Client struct {
 	Authorization *Authorization
+	// Base URLs of the Platform API and of Heroku Identity. Empty means DefaultAPIURL and
+	// DefaultIdURL. Point them at a fakeheroku.Server to run without Heroku.
+	APIURL string
+	IdURL  string
+	// Empty means http.DefaultClient.
+	HTTPClient *http.Client
+	// With a client secret and a refresh token, an expired or rejected access token is refreshed
+	// and the request retried. OnRefresh, if set, is called with the new authorization so it can
+	// be saved.
+	ClientSecret string
+	OnRefresh    func(auth *Authorization)
+
+	// From the RateLimit-Remaining header of the last Platform API response.
+	rateLimitRemaining int
+	rateLimitKnown     bool
 }
 
 type Authorization struct {
@@ -27,6 +48,16 @@ type Authorization struct {
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int    `json:"expires_in"`
 	TokenType    string `json:"token_type"`
+	// Computed from ExpiresIn when the token is issued. Zero if unknown.
+	ExpiresAt time.Time `json:"-"`
+}
+
+// Refresh a little early so a request doesn't race the expiry.
+const expiryMargin = time.Minute
+
+// True if the access token has expired or is about to.
+func (a *Authorization) Expired() bool {
+	return !a.ExpiresAt.IsZero() && time.Now().Add(expiryMargin).After(a.ExpiresAt)
 }
 
 type AddonApp struct {
@@ -35,15 +66,20 @@ type AddonApp struct {
 }
 
 type Addon struct {
-	App AddonApp `json:"app"`
+	Id   string   `json:"id"`
+	Name string   `json:"name"`
+	App  AddonApp `json:"app"`
 }
 
+// Apps owned by a team have the team as their owner. Personal apps have the user.
 type App struct {
-	Organization AppOrganization `json:"organization"`
-	Owner        AppOwner        `json:"owner"`
+	Id    string   `json:"id"`
+	Name  string   `json:"name"`
+	Team  *AppTeam `json:"team"`
+	Owner AppOwner `json:"owner"`
 }
 
-type AppOrganization struct {
+type AppTeam struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
 }
@@ -100,41 +136,99 @@ type AsyncCreateAddonResponse struct {
 	Message string `json:"message"`
 }
 
-type Organization struct {
+type Team struct {
 	Id      string `json:"id"`
 	Name    string `json:"name"`
 	Role    string `json:"role"`
 	Type    string `json:"type"`
 	Default bool   `json:"default"`
+	// Nil for teams that aren't part of an enterprise account.
+	EnterpriseAccount *EnterpriseAccount `json:"enterprise_account"`
+	// Set on the stand-in for a user's personal account. See PersonalTeam.
+	Personal bool `json:"-"`
+}
+
+type EnterpriseAccount struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 type Account struct {
+	Id    string `json:"id"`
 	Email string `json:"email"`
 	Name  string `json:"name"`
 }
 
+// A team standing in for the user's personal account, so the user's personal apps can be managed
+// like a team's. Its id is the user's id, which is the owner id of personal apps.
+func PersonalTeam(account *Account) *Team {
+	return &Team{Id: account.Id, Name: account.Email, Role: "admin", Type: "personal", Personal: true}
+}
+
 func NewAddonId() string {
 	b := make([]byte, 16)
 	rand.Read(b)
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
+// Exchanges an OAuth code with Heroku Identity at DefaultIdURL.
 func NewClientFromCode(clientSecret string, code string) (*Client, error) {
-	logger.Print(clientSecret)
-	res, err := http.PostForm("https://id.heroku.com/oauth/token",
-		url.Values{
-			"grant_type":    {"authorization_code"},
-			"client_secret": {clientSecret},
-			"code":          {code},
-		},
-	)
+	return (&Client{}).ExchangeCode(clientSecret, code)
+}
+
+// Exchanges an OAuth code for a client authorized by it, with the same endpoints and HTTP client as
+// c. The client can refresh its authorization.
+func (c *Client) ExchangeCode(clientSecret string, code string) (*Client, error) {
+	authInfo, err := c.requestToken(url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_secret": {clientSecret},
+		"code":          {code},
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := c.WithAuthorization(authInfo)
+	client.ClientSecret = clientSecret
+	return client, nil
+}
+
+// Replaces the access token using the refresh token and calls OnRefresh.
+func (c *Client) Refresh() error {
+	if !c.canRefresh() {
+		return errors.New("Authorization can't be refreshed without a refresh token and client secret")
+	}
+	authInfo, err := c.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_secret": {c.ClientSecret},
+		"refresh_token": {c.Authorization.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	// Heroku keeps the refresh token the same, but don't count on it.
+	if authInfo.RefreshToken == "" {
+		authInfo.RefreshToken = c.Authorization.RefreshToken
+	}
+	c.Authorization = authInfo
+	if c.OnRefresh != nil {
+		c.OnRefresh(authInfo)
+	}
+	return nil
+}
+
+func (c *Client) canRefresh() bool {
+	return c.Authorization != nil && c.Authorization.RefreshToken != "" && c.ClientSecret != ""
+}
+
+func (c *Client) requestToken(params url.Values) (*Authorization, error) {
+	res, err := c.httpClient().PostForm(c.IdBaseURL()+"/oauth/token", params)
 	if err != nil {
 		logger.Print(err)
 		return nil, err
 	}
 	defer res.Body.Close()
 
-	if err := httpError(200, res); err != nil {
+	if err := checkResponse(res, 200); err != nil {
 		logger.Print(err.Error())
 		return nil, err
 	}
@@ -144,8 +238,38 @@ func NewClientFromCode(clientSecret string, code string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	if authInfo.ExpiresIn > 0 {
+		authInfo.ExpiresAt = time.Now().Add(time.Duration(authInfo.ExpiresIn) * time.Second)
+	}
+	return authInfo, nil
+}
 
-	return &Client{Authorization: authInfo}, nil
+// A copy of c that uses auth.
+func (c *Client) WithAuthorization(auth *Authorization) *Client {
+	client := *c
+	client.Authorization = auth
+	return &client
+}
+
+func (c *Client) APIBaseURL() string {
+	if c.APIURL != "" {
+		return strings.TrimSuffix(c.APIURL, "/")
+	}
+	return DefaultAPIURL
+}
+
+func (c *Client) IdBaseURL() string {
+	if c.IdURL != "" {
+		return strings.TrimSuffix(c.IdURL, "/")
+	}
+	return DefaultIdURL
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
 }
 
 func (c *Client) addHeaders(req *http.Request) {
@@ -154,37 +278,117 @@ func (c *Client) addHeaders(req *http.Request) {
 	req.Header.Add("Authorization", c.Authorization.TokenType+" "+c.Authorization.AccessToken)
 }
 
-// Core get function used by a set of public functions that take care of types
-func (c *Client) get(path string, responseData interface{}) error {
-	req, err := http.NewRequest("GET", "https://api.heroku.com"+path, nil)
-	if err != nil {
-		return err
-	}
-	c.addHeaders(req)
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// Requests left before the Platform API starts refusing them with 429 Too Many Requests, as of
+// the last response. known is false until a response has said.
+func (c *Client) RateLimitRemaining() (remaining int, known bool) {
+	return c.rateLimitRemaining, c.rateLimitKnown
+}
+
+// Heroku refills the rate limit gradually, at roughly one request per second. A variable so
+// tests don't have to wait.
+var rateLimitPause = 2 * time.Second
+
+const maxRateLimitRetries = 3
+
+// Sends a Platform API request and checks its status against expectedCodes. The caller closes the
+// body. An expired authorization is refreshed first, and a request rejected with 401 is retried
+// once after refreshing. When the rate limit is used up, waits for it to refill a little, and
+// retries a request refused with 429 a few times with growing pauses.
+func (c *Client) do(method string, path string, body []byte, header http.Header, expectedCodes ...int) (*http.Response, error) {
+	if c.canRefresh() && c.Authorization.Expired() {
+		if err := c.Refresh(); err != nil {
+			return nil, err
+		}
 	}
-	err = json.NewDecoder(res.Body).Decode(responseData)
-	if err != nil {
-		return err
+	refreshed := false
+	pause := rateLimitPause
+	for retries := 0; ; retries++ {
+		if c.rateLimitKnown && c.rateLimitRemaining == 0 {
+			logger.Print("Heroku API rate limit used up. Waiting ", rateLimitPause, " before ", method, " ", path)
+			time.Sleep(rateLimitPause)
+		}
+		res, err := c.send(method, path, body, header)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusUnauthorized && c.canRefresh() && !refreshed {
+			res.Body.Close()
+			if err := c.Refresh(); err != nil {
+				return nil, err
+			}
+			refreshed = true
+			continue
+		}
+		if res.StatusCode == http.StatusTooManyRequests && retries < maxRateLimitRetries {
+			res.Body.Close()
+			logger.Print("Heroku API rate limit exceeded. Retrying ", method, " ", path, " in ", pause)
+			time.Sleep(pause)
+			pause *= 2
+			continue
+		}
+		if err := checkResponse(res, expectedCodes...); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return res, nil
 	}
-	return nil
 }
 
-func (c *Client) AddonInfo(addonId string) (*Addon, error) {
-	req, err := http.NewRequest("GET", "https://api.heroku.com/addons/"+addonId, nil)
+func (c *Client) send(method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.APIBaseURL()+path, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	c.addHeaders(req)
-	res, err := http.DefaultClient.Do(req)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := c.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
-	addonInfo := &Addon{}
-	err = json.NewDecoder(res.Body).Decode(addonInfo)
+	if remaining, err := strconv.Atoi(res.Header.Get("RateLimit-Remaining")); err == nil {
+		c.rateLimitRemaining, c.rateLimitKnown = remaining, true
+	}
+	return res, nil
+}
+
+// Core get function used by a set of public functions that take care of types
+func (c *Client) get(path string, responseData interface{}) error {
+	res, err := c.do("GET", path, nil, nil, 200)
 	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(responseData)
+}
+
+// Gets every page of a list, passing each to decodePage. Heroku answers a list request with
+// 206 Partial Content and a Next-Range header when there is more, which asks for the next page
+// as the Range header of the next request.
+func (c *Client) getAll(path string, decodePage func(dec *json.Decoder) error) error {
+	var header http.Header
+	for {
+		res, err := c.do("GET", path, nil, header, 200, 206)
+		if err != nil {
+			return err
+		}
+		err = decodePage(json.NewDecoder(res.Body))
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		next := res.Header.Get("Next-Range")
+		if res.StatusCode != 206 || next == "" {
+			return nil
+		}
+		header = http.Header{"Range": {next}}
+	}
+}
+
+func (c *Client) AddonInfo(addonId string) (*Addon, error) {
+	addonInfo := &Addon{}
+	if err := c.get("/addons/"+addonId, addonInfo); err != nil {
 		return nil, err
 	}
 	return addonInfo, nil
@@ -192,24 +396,28 @@ func (c *Client) AddonInfo(addonId string) (*Addon, error) {
 
 func (c *Client) OwnerId(addonId string) (ownerId string, err error) {
 	addonInfo, err := c.AddonInfo(addonId)
-	req, err := http.NewRequest("GET", "https://api.heroku.com/apps/"+addonInfo.App.Id, nil)
-	logError(err)
-	c.addHeaders(req)
-	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return ownerId, err
 	}
 	appInfo := &App{}
-	err = json.NewDecoder(res.Body).Decode(appInfo)
-	logError(err)
-	ownerId = appInfo.Owner.Id
-	return ownerId, nil
+	if err := c.get("/apps/"+addonInfo.App.Id, appInfo); err != nil {
+		return ownerId, err
+	}
+	return appInfo.Owner.Id, nil
 }
 
-func (c *Client) Organizations() ([]*Organization, error) {
-	orgs := make([]*Organization, 0)
-	err := c.get("/organizations", &orgs)
-	return orgs, err
+// Teams the user is a member of.
+func (c *Client) Teams() ([]*Team, error) {
+	teams := make([]*Team, 0)
+	err := c.getAll("/teams", func(dec *json.Decoder) error {
+		page := make([]*Team, 0)
+		if err := dec.Decode(&page); err != nil {
+			return err
+		}
+		teams = append(teams, page...)
+		return nil
+	})
+	return teams, err
 }
 
 func (c *Client) Account() (account *Account, err error) {
@@ -222,18 +430,12 @@ func (c *Client) ProvisionAddon(addonId string, success bool) (err error) {
 	if !success {
 		endpoint = "deprovision"
 	}
-	req, err := http.NewRequest("POST", "https://api.heroku.com/addons/"+addonId+"/actions/"+endpoint, nil)
-	logError(err)
-	c.addHeaders(req)
-	res, err := http.DefaultClient.Do(req)
-	defer res.Body.Close()
+	res, err := c.do("POST", "/addons/"+addonId+"/actions/"+endpoint, nil, nil, 200)
 	if err != nil {
-		return err
-	}
-	if err := httpError(200, res); err != nil {
 		logger.Print(err.Error())
 		return err
 	}
+	res.Body.Close()
 	return nil
 }
 
@@ -245,6 +447,18 @@ func (c *Client) FailProvisioning(addonId string) (err error) {
 	return c.ProvisionAddon(addonId, false)
 }
 
+// Removes an add-on from its app, like `heroku addons:destroy`. Heroku deprovisions it through the
+// add-on API before answering.
+func (c *Client) DeleteAddon(appId string, addonId string) error {
+	res, err := c.do("DELETE", "/apps/"+appId+"/addons/"+addonId, nil, nil, 200)
+	if err != nil {
+		logger.Print(err.Error())
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
 // Example:
 // c.SetAddonConfig("1234", heroku.AddonConfig{
 //    Config: []heroku.ConfigVar{
@@ -259,37 +473,15 @@ func (c *Client) FailProvisioning(addonId string) (err error) {
 //    },
 //  })
 func (c *Client) SetAddonConfig(addonId string, config AddonConfig) error {
-	b := new(bytes.Buffer)
-	err := json.NewEncoder(b).Encode(config)
-	logError(err)
-
-	req, err := http.NewRequest("PATCH", "https://api.heroku.com/addons/"+addonId+"/config", b)
-	logError(err)
-	c.addHeaders(req)
-
-	res, err := http.DefaultClient.Do(req)
-	defer res.Body.Close()
+	b, err := json.Marshal(config)
 	if err != nil {
 		return err
 	}
-	if err := httpError(200, res); err != nil {
+	res, err := c.do("PATCH", "/addons/"+addonId+"/config", b, nil, 200)
+	if err != nil {
 		logger.Print(err.Error())
 		return err
 	}
+	res.Body.Close()
 	return nil
 }
-
-func logError(err error) {
-	if err != nil {
-		logger.Print("WARNING! Ignoring unexpected error: %s", err.Error())
-	}
-}
-
-func httpError(expectedCode int, res *http.Response) error {
-	if expectedCode != res.StatusCode {
-		body, _ := httputil.DumpResponse(res, true)
-		return errors.New(fmt.Sprintf("Unexpected HTTP response (%d): %q", res.StatusCode, body))
-	} else {
-		return nil
-	}
-}
@@ -0,0 +1,292 @@
+package heroku
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves handler as both the Platform API and Heroku Identity, and returns a client for it.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &Client{
+		APIURL:        server.URL,
+		IdURL:         server.URL,
+		Authorization: &Authorization{AccessToken: "old", RefreshToken: "refresh", TokenType: "Bearer"},
+		ClientSecret:  "client-secret",
+	}
+}
+
+// A client whose server is gone, so every request fails in the transport.
+func newClosedClient(t *testing.T) *Client {
+	t.Helper()
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return &Client{APIURL: server.URL, IdURL: server.URL, Authorization: &Authorization{AccessToken: "token", TokenType: "Bearer"}}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestGetAllFollowsNextRange(t *testing.T) {
+	var ranges []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch r.Header.Get("Range") {
+		case "":
+			w.Header().Set("Next-Range", "id ]b..; max=2")
+			writeJSON(w, 206, []Team{{Id: "a"}, {Id: "b"}})
+		case "id ]b..; max=2":
+			w.Header().Set("Next-Range", "id ]d..; max=2")
+			writeJSON(w, 206, []Team{{Id: "c"}, {Id: "d"}})
+		default:
+			// The last page may still be 206, but without a Next-Range.
+			writeJSON(w, 206, []Team{{Id: "e"}})
+		}
+	})
+	teams, err := client.Teams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids string
+	for _, team := range teams {
+		ids += team.Id
+	}
+	if ids != "abcde" {
+		t.Errorf("Got teams %q, want abcde", ids)
+	}
+	if len(ranges) != 3 || ranges[2] != "id ]d..; max=2" {
+		t.Errorf("Requested ranges %q", ranges)
+	}
+}
+
+func TestGetAllSinglePage(t *testing.T) {
+	requests := 0
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// A 200 ends the list even with a Next-Range.
+		w.Header().Set("Next-Range", "id ]a..; max=1")
+		writeJSON(w, 200, []Team{{Id: "a"}})
+	})
+	if teams, err := client.Teams(); err != nil || len(teams) != 1 || requests != 1 {
+		t.Errorf("Got %d teams in %d requests: %v", len(teams), requests, err)
+	}
+}
+
+// Rejects tokens other than "new" and hands out "new" on refresh.
+func refreshingHandler(refreshes *int, apiCalls *int, rejectAll bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			*refreshes++
+			if r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != "refresh" ||
+				r.PostFormValue("client_secret") != "client-secret" {
+				writeJSON(w, 400, Error{ID: "invalid_grant", Message: "Bad refresh request"})
+				return
+			}
+			writeJSON(w, 200, Authorization{AccessToken: "new", ExpiresIn: 3600, TokenType: "Bearer"})
+			return
+		}
+		*apiCalls++
+		if rejectAll || r.Header.Get("Authorization") != "Bearer new" {
+			writeJSON(w, 401, Error{ID: "unauthorized", Message: "Invalid credentials provided."})
+			return
+		}
+		writeJSON(w, 200, Account{Id: "user", Email: "dev@example.com"})
+	}
+}
+
+func TestDoRefreshesOn401(t *testing.T) {
+	refreshes, apiCalls := 0, 0
+	client := newTestClient(t, refreshingHandler(&refreshes, &apiCalls, false))
+	var saved *Authorization
+	client.OnRefresh = func(auth *Authorization) { saved = auth }
+
+	account, err := client.Account()
+	if err != nil || account.Email != "dev@example.com" {
+		t.Fatalf("Got %+v, %v", account, err)
+	}
+	if refreshes != 1 || apiCalls != 2 {
+		t.Errorf("Refreshed %d times for %d API calls, want 1 for 2", refreshes, apiCalls)
+	}
+	if saved == nil || saved.AccessToken != "new" || saved.RefreshToken != "refresh" || saved.ExpiresAt.IsZero() {
+		t.Errorf("OnRefresh got %+v", saved)
+	}
+	if client.Authorization != saved {
+		t.Error("The client didn't keep the new authorization")
+	}
+}
+
+func TestDoRefreshesOnlyOnce(t *testing.T) {
+	refreshes, apiCalls := 0, 0
+	client := newTestClient(t, refreshingHandler(&refreshes, &apiCalls, true))
+	_, err := client.Account()
+	if !IsStatus(err, 401) {
+		t.Errorf("Got %v, want a 401 error", err)
+	}
+	if refreshes != 1 || apiCalls != 2 {
+		t.Errorf("Refreshed %d times for %d API calls, want 1 for 2", refreshes, apiCalls)
+	}
+}
+
+func TestDoDoesNotRefreshWithoutClientSecret(t *testing.T) {
+	refreshes, apiCalls := 0, 0
+	client := newTestClient(t, refreshingHandler(&refreshes, &apiCalls, false))
+	client.ClientSecret = ""
+	if _, err := client.Account(); !IsStatus(err, 401) || refreshes != 0 {
+		t.Errorf("Got %v after %d refreshes, want a 401 error and none", err, refreshes)
+	}
+}
+
+func TestDoRefreshesExpiredAuthorizationFirst(t *testing.T) {
+	refreshes, apiCalls := 0, 0
+	client := newTestClient(t, refreshingHandler(&refreshes, &apiCalls, false))
+	client.Authorization.ExpiresAt = time.Now()
+	if _, err := client.Account(); err != nil || refreshes != 1 || apiCalls != 1 {
+		t.Errorf("Got %v after %d refreshes and %d API calls, want 1 and 1", err, refreshes, apiCalls)
+	}
+}
+
+func shortenRateLimitPause(t *testing.T) {
+	pause := rateLimitPause
+	rateLimitPause = 20 * time.Millisecond
+	t.Cleanup(func() { rateLimitPause = pause })
+}
+
+func TestDoWaitsWhenRateLimitIsUsedUp(t *testing.T) {
+	shortenRateLimitPause(t)
+	var mu sync.Mutex
+	var times []time.Time
+	remaining := []string{"1", "0", "5"}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("RateLimit-Remaining", remaining[len(times)])
+		times = append(times, time.Now())
+		writeJSON(w, 200, Account{Id: "user"})
+	})
+	if _, known := client.RateLimitRemaining(); known {
+		t.Error("Rate limit is known before any request")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Account(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gap := times[1].Sub(times[0]); gap >= rateLimitPause {
+		t.Errorf("Waited %v with requests left", gap)
+	}
+	if gap := times[2].Sub(times[1]); gap < rateLimitPause {
+		t.Errorf("Waited only %v after the rate limit was used up", gap)
+	}
+	if remaining, known := client.RateLimitRemaining(); !known || remaining != 5 {
+		t.Errorf("Rate limit remaining is %d, %v", remaining, known)
+	}
+}
+
+func TestDoRetriesTooManyRequests(t *testing.T) {
+	shortenRateLimitPause(t)
+	tests := []struct {
+		name     string
+		refusals int
+		requests int
+		status   int
+	}{
+		{"refused twice", 2, 3, 0},
+		{"refused every time", 10, maxRateLimitRetries + 1, 429},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= test.refusals {
+					writeJSON(w, 429, Error{ID: "rate_limit", Message: "Your account reached the API rate limit"})
+					return
+				}
+				writeJSON(w, 200, Account{Id: "user"})
+			})
+			_, err := client.Account()
+			if requests != test.requests {
+				t.Errorf("Sent %d requests, want %d", requests, test.requests)
+			}
+			if test.status == 0 && err != nil || test.status != 0 && !IsStatus(err, test.status) {
+				t.Errorf("Got %v", err)
+			}
+		})
+	}
+}
+
+func TestOwnerIdAfterFailedAddonInfo(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 404, Error{ID: "not_found", Message: "Couldn't find that add-on."})
+	})
+	if _, err := client.OwnerId("missing"); !IsStatus(err, 404) {
+		t.Errorf("Got %v, want a 404 error", err)
+	}
+	if _, err := newClosedClient(t).OwnerId("addon"); err == nil {
+		t.Error("Got no error without a server")
+	}
+}
+
+func TestOwnerId(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/addons/addon":
+			writeJSON(w, 200, Addon{Id: "addon", App: AddonApp{Id: "app"}})
+		case "/apps/app":
+			writeJSON(w, 200, App{Id: "app", Owner: AppOwner{Id: "team"}})
+		default:
+			writeJSON(w, 404, Error{ID: "not_found"})
+		}
+	})
+	if owner, err := client.OwnerId("addon"); err != nil || owner != "team" {
+		t.Errorf("Got %q, %v", owner, err)
+	}
+}
+
+func TestAddonActionsWithoutServer(t *testing.T) {
+	client := newClosedClient(t)
+	if err := client.CompleteProvisioning("addon"); err == nil {
+		t.Error("CompleteProvisioning succeeded without a server")
+	}
+	if err := client.FailProvisioning("addon"); err == nil {
+		t.Error("FailProvisioning succeeded without a server")
+	}
+	if err := client.SetAddonConfig("addon", AddonConfig{Config: []ConfigVar{{Name: "BUCKET_NAME", Value: "b"}}}); err == nil {
+		t.Error("SetAddonConfig succeeded without a server")
+	}
+}
+
+func TestAddonActions(t *testing.T) {
+	var paths []string
+	var config AddonConfig
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Method == "PATCH" {
+			json.NewDecoder(r.Body).Decode(&config)
+		}
+		writeJSON(w, 200, struct{}{})
+	})
+	err := client.SetAddonConfig("addon", AddonConfig{Config: []ConfigVar{{Name: "BUCKET_NAME", Value: "b"}}})
+	if err != nil || len(config.Config) != 1 || config.Config[0].Value != "b" {
+		t.Errorf("Set config %+v: %v", config, err)
+	}
+	if err := client.CompleteProvisioning("addon"); err != nil {
+		t.Error(err)
+	}
+	if err := client.FailProvisioning("addon"); err != nil {
+		t.Error(err)
+	}
+	want := []string{"PATCH /addons/addon/config", "POST /addons/addon/actions/provision", "POST /addons/addon/actions/deprovision"}
+	if len(paths) != 3 || paths[0] != want[0] || paths[1] != want[1] || paths[2] != want[2] {
+		t.Errorf("Requested %q, want %q", paths, want)
+	}
+}
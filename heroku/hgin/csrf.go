@@ -0,0 +1,44 @@
+package hgin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Form field POSTs carry the CSRF token in.
+const CSRFField = "csrf_token"
+
+// Derived from the session id, so it changes with every sign-in and can't be known by other
+// sites.
+func csrfToken(cookieSecret string, sessionId string) string {
+	mac := hmac.New(sha256.New, []byte(cookieSecret))
+	mac.Write([]byte("csrf:" + sessionId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Turns away form POSTs without the token of the signed in user. Use after CheckAuth or
+// CheckSSO. Other methods can't be sent by forms on other sites and are let through.
+func CheckCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == "POST" && !hmac.Equal([]byte(c.PostForm(CSRFField)), []byte(CSRFToken(c))) {
+			logger.Print("Rejected POST to ", c.Request.URL.Path, " without a valid CSRF token")
+			c.Abort()
+			c.String(403, "The form expired. Go back, reload the page and try again.")
+			return
+		}
+		c.Next()
+	}
+}
+
+// The token forms must send back in CSRFField.
+func CSRFToken(c *gin.Context) string {
+	val, exists := c.Get("csrf-token")
+	if !exists {
+		logger.Print("WARNING! CSRF token not found in context as expected")
+		return ""
+	}
+	return val.(string)
+}
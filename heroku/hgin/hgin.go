@@ -1,11 +1,15 @@
 package hgin
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
 	"log"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	fernet "github.com/fernet/fernet-go"
 	"github.com/gin-gonic/gin"
@@ -13,25 +17,82 @@ import (
 )
 
 const (
+	// Holds the session id.
 	CookieName = "heroku"
+	// Holds the nonce of the sign-in in progress, to check the OAuth state against.
+	StateCookieName = "heroku-oauth-state"
+	// How long the user has to approve the OAuth authorization.
+	stateLength = 10 * time.Minute
 )
 
+// Sent through Heroku Identity and back to the callback, encrypted.
+type oauthState struct {
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"return_to"`
+}
+
 var (
 	logger = log.New(os.Stderr, "[hgin] ", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
-func redirectToAuth(c *gin.Context, oauthId string) {
+// Sends the user to Heroku to sign in. The state names the page to return to, and ties the
+// callback to this browser through a nonce that's also kept in a cookie.
+func redirectToAuth(c *gin.Context, platform *heroku.Client, oauthId string, fernetKey *fernet.Key) {
 	c.Abort()
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		c.String(500, "Internal error: "+err.Error())
+		return
+	}
+	state := oauthState{Nonce: base64.RawURLEncoding.EncodeToString(nonce)}
+	// Pages can be returned to, forms can't be resubmitted.
+	if c.Request.Method == "GET" {
+		state.ReturnTo = c.Request.URL.RequestURI()
+	}
+	stateJSON, _ := json.Marshal(state)
+	encryptedBytes, err := fernet.EncryptAndSign(stateJSON, fernetKey)
+	if err != nil {
+		c.String(500, "Internal error: "+err.Error())
+		return
+	}
+	c.SetCookie(StateCookieName, state.Nonce, int(stateLength.Seconds()), "/", "", true, true)
 	params := url.Values{
 		"client_id":     {oauthId},
 		"response_type": {"code"},
 		"scope":         {"global"},
-		// "state": "not used",
+		"state":         {base64.RawURLEncoding.EncodeToString(encryptedBytes)},
 	}
-	c.Redirect(302, "https://id.heroku.com/oauth/authorize?"+params.Encode())
+	c.Redirect(302, platform.IdBaseURL()+"/oauth/authorize?"+params.Encode())
 }
 
-func CheckAuth(cookieSecret string, oauthId string) gin.HandlerFunc {
+// Checks the state Heroku passed back against the nonce cookie, which is cleared so the state
+// can't be used again.
+func verifyState(c *gin.Context, fernetKey *fernet.Key) (state oauthState, ok bool) {
+	cookie, err := c.Request.Cookie(StateCookieName)
+	if err != nil {
+		return state, false
+	}
+	c.SetCookie(StateCookieName, "", -1, "/", "", true, true)
+	stateBytes, err := base64.RawURLEncoding.DecodeString(c.Query("state"))
+	if err != nil {
+		return state, false
+	}
+	decrypted := fernet.VerifyAndDecrypt(stateBytes, stateLength, []*fernet.Key{fernetKey})
+	if decrypted == nil || json.Unmarshal(decrypted, &state) != nil {
+		return state, false
+	}
+	return state, subtle.ConstantTimeCompare([]byte(state.Nonce), []byte(cookie.Value)) == 1
+}
+
+// Only paths on this site are returned to.
+func localPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// Lets signed in users through and sends everyone else to Heroku to sign in. The client set on
+// the context uses the endpoints and HTTP client of platform, and refreshes the user's access
+// token when it expires.
+func CheckAuth(platform *heroku.Client, cookieSecret string, oauthId string, oauthSecret string, sessions *Sessions) gin.HandlerFunc {
 
 	fernetKey, err := fernet.DecodeKey(cookieSecret)
 	if err != nil {
@@ -42,32 +103,60 @@ func CheckAuth(cookieSecret string, oauthId string) gin.HandlerFunc {
 		cookie, err := c.Request.Cookie(CookieName)
 		if err != nil {
 			logger.Print("Request received without cookie. Redirecting to auth")
-			redirectToAuth(c, oauthId)
+			redirectToAuth(c, platform, oauthId, fernetKey)
 			return
 		}
-		cookieBytes, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+		idHash := hashSessionId(cookie.Value)
+		session, found, err := sessions.Store.FindSession(idHash)
 		if err != nil {
-			logger.Print("Invalid cookie. Redirecting to auth")
-			redirectToAuth(c, oauthId)
+			c.Abort()
+			c.String(500, "Error finding session: "+err.Error())
+			return
+		}
+		if !found {
+			logger.Print("Session not found. Redirecting to auth")
+			redirectToAuth(c, platform, oauthId, fernetKey)
 			return
 		}
-		accessToken := fernet.VerifyAndDecrypt(cookieBytes, -1, []*fernet.Key{fernetKey})
-		if accessToken == nil {
-			logger.Print("Cookie not valid or expired. Redirecting to auth")
-			redirectToAuth(c, oauthId)
+		now := time.Now()
+		if sessions.expired(session, now) {
+			logger.Print("Session of ", session.Email, " expired. Redirecting to auth")
+			sessions.Store.DeleteSession(idHash)
+			redirectToAuth(c, platform, oauthId, fernetKey)
 			return
 		}
-		c.Set("heroku",
-			&heroku.Client{
-				&heroku.Authorization{
-					AccessToken: string(accessToken),
-					TokenType:   "Bearer",
-				}})
+		if now.Sub(session.LastSeenAt) > touchInterval {
+			sessions.Store.TouchSession(idHash, now)
+		}
+
+		auth := session.Authorization
+		auth.TokenType = "Bearer"
+		client := platform.WithAuthorization(&auth)
+		client.ClientSecret = oauthSecret
+		client.OnRefresh = func(auth *heroku.Authorization) {
+			if err := sessions.Store.UpdateSessionAuthorization(idHash, auth); err != nil {
+				logger.Print("Couldn't save refreshed token of ", session.Email, ": ", err)
+			}
+		}
+		// Refresh up front, so a revoked authorization means signing in again rather than
+		// errors from every API call.
+		if auth.Expired() {
+			if err := client.Refresh(); err != nil {
+				logger.Print("Couldn't refresh token of ", session.Email, ". Redirecting to auth: ", err)
+				sessions.Store.DeleteSession(idHash)
+				redirectToAuth(c, platform, oauthId, fernetKey)
+				return
+			}
+		}
+		c.Set("heroku", client)
+		c.Set("heroku-session", session)
+		c.Set("csrf-token", csrfToken(cookieSecret, cookie.Value))
 		c.Next()
 	}
 }
 
-func HandleCallback(cookieSecret string, oauthSecret string, redirect string) gin.HandlerFunc {
+// Only accounts policy allows are signed in.
+func HandleCallback(platform *heroku.Client, cookieSecret string, oauthSecret string, sessions *Sessions, policy SignInPolicy, redirect string) gin.HandlerFunc {
 
 	fernetKey, err := fernet.DecodeKey(cookieSecret)
 	if err != nil {
@@ -77,9 +166,14 @@ func HandleCallback(cookieSecret string, oauthSecret string, redirect string) gi
 	}
 
 	return func(c *gin.Context) {
+		state, ok := verifyState(c, fernetKey)
+		if !ok {
+			logger.Print("Callback with missing, expired or mismatched OAuth state")
+			c.String(400, "OAuth failure: the sign-in expired or didn't start here. Please try again.")
+			return
+		}
 		code := c.Query("code")
-		//state := c.Query("state")
-		client, err := heroku.NewClientFromCode(oauthSecret, code)
+		client, err := platform.ExchangeCode(oauthSecret, code)
 		if err != nil {
 			c.String(400, "OAuth failure: "+err.Error())
 			return
@@ -89,17 +183,22 @@ func HandleCallback(cookieSecret string, oauthSecret string, redirect string) gi
 			c.String(400, "OAuth failure: "+err.Error())
 			return
 		}
-		if !strings.HasSuffix(account.Email, "@heroku.com") && !strings.HasSuffix(account.Email, "@salesforce.com") {
+		if !policy.Allows(account) {
+			logger.Print("Refused sign-in of ", account.Email)
 			c.String(401, "Your Heroku account is not authorized to use this service.")
 			return
 		}
-		encryptedBytes, err := fernet.EncryptAndSign([]byte(client.Authorization.AccessToken), fernetKey)
+		id, err := sessions.start(account, client.Authorization)
 		if err != nil {
-			c.String(500, "Internal error: "+err.Error())
+			c.String(500, "Error starting session: "+err.Error())
 			return
 		}
-		c.SetCookie(CookieName, base64.RawURLEncoding.EncodeToString(encryptedBytes), 3600, "", "", true, true)
+		c.SetCookie(CookieName, id, int(sessions.MaxAge.Seconds()), "/", "", true, true)
 
+		if localPath(state.ReturnTo) {
+			c.Redirect(302, state.ReturnTo)
+			return
+		}
 		c.Redirect(302, redirect)
 	}
 }
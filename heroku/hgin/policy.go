@@ -0,0 +1,33 @@
+package hgin
+
+import (
+	"strings"
+
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// Decides who may sign in with their Heroku account.
+type SignInPolicy interface {
+	Allows(account *heroku.Account) bool
+}
+
+// Lets in accounts whose email is in one of Domains or is one of Users. Comparisons ignore case.
+type EmailPolicy struct {
+	Domains []string
+	Users   []string
+}
+
+func (p *EmailPolicy) Allows(account *heroku.Account) bool {
+	email := strings.ToLower(account.Email)
+	for _, user := range p.Users {
+		if email == strings.ToLower(user) {
+			return true
+		}
+	}
+	for _, domain := range p.Domains {
+		if strings.HasSuffix(email, "@"+strings.ToLower(strings.TrimPrefix(domain, "@"))) {
+			return true
+		}
+	}
+	return false
+}
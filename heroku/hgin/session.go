@@ -0,0 +1,112 @@
+package hgin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// Last-seen times are only written this often, not on every request.
+const touchInterval = time.Minute
+
+// A signed in user.
+type Session struct {
+	// SHA-256 of the session id in the cookie. Stores only ever see the hash.
+	IdHash        string
+	UserId        string
+	Email         string
+	Name          string
+	Authorization heroku.Authorization
+	CreatedAt     time.Time
+	LastSeenAt    time.Time
+}
+
+// Keeps sessions on the server.
+type SessionStore interface {
+	SaveSession(session *Session) error
+	FindSession(idHash string) (session Session, found bool, err error)
+	// Called when the session's access token was refreshed.
+	UpdateSessionAuthorization(idHash string, auth *heroku.Authorization) error
+	TouchSession(idHash string, lastSeenAt time.Time) error
+	DeleteSession(idHash string) error
+	DeleteExpiredSessions(lastSeenBefore time.Time, createdBefore time.Time) error
+}
+
+// Server-side sessions for CheckAuth, HandleCallback and HandleLogout. A session ends after
+// IdleTimeout without requests, or MaxAge after signing in, whichever comes first.
+type Sessions struct {
+	Store       SessionStore
+	IdleTimeout time.Duration
+	MaxAge      time.Duration
+}
+
+func (s *Sessions) expired(session Session, now time.Time) bool {
+	return now.Sub(session.LastSeenAt) > s.IdleTimeout || now.Sub(session.CreatedAt) > s.MaxAge
+}
+
+// Starts a session and returns the id for the cookie.
+func (s *Sessions) start(account *heroku.Account, auth *heroku.Authorization) (id string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id = base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	// A good moment to clean up after users who never signed out.
+	if err := s.Store.DeleteExpiredSessions(now.Add(-s.IdleTimeout), now.Add(-s.MaxAge)); err != nil {
+		logger.Print("Couldn't delete expired sessions: ", err)
+	}
+	return id, s.Store.SaveSession(&Session{
+		IdHash:        hashSessionId(id),
+		UserId:        account.Id,
+		Email:         account.Email,
+		Name:          account.Name,
+		Authorization: *auth,
+		CreatedAt:     now,
+		LastSeenAt:    now,
+	})
+}
+
+func hashSessionId(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Ends the session in the cookie, if any, and clears the cookie. Meant for a form POST carrying
+// the session's CSRF token, which is checked against the cookie so that expired sessions can be
+// ended too. Meant to be followed by a handler that says the user is signed out.
+func HandleLogout(cookieSecret string, sessions *Sessions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cookie, err := c.Request.Cookie(CookieName); err == nil {
+			if !hmac.Equal([]byte(c.PostForm(CSRFField)), []byte(csrfToken(cookieSecret, cookie.Value))) {
+				logger.Print("Rejected sign out without a valid CSRF token")
+				c.Abort()
+				c.String(403, "The form expired. Go back, reload the page and try again.")
+				return
+			}
+			if err := sessions.Store.DeleteSession(hashSessionId(cookie.Value)); err != nil {
+				c.Abort()
+				c.String(500, "Error signing out: "+err.Error())
+				return
+			}
+		}
+		c.SetCookie(CookieName, "", -1, "/", "", true, true)
+		c.Next()
+	}
+}
+
+// The signed in user. Use after CheckAuth.
+func CurrentSession(c *gin.Context) Session {
+	val, exists := c.Get("heroku-session")
+	if !exists {
+		logger.Print("WARNING! session not found in context as expected")
+		return Session{}
+	}
+	return val.(Session)
+}
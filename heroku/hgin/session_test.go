@@ -0,0 +1,79 @@
+package hgin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Only records which sessions were deleted.
+type deletingStore struct {
+	deleted []string
+}
+
+func (s *deletingStore) SaveSession(session *Session) error { return nil }
+func (s *deletingStore) FindSession(idHash string) (Session, bool, error) {
+	return Session{}, false, nil
+}
+func (s *deletingStore) UpdateSessionAuthorization(idHash string, auth *heroku.Authorization) error {
+	return nil
+}
+func (s *deletingStore) TouchSession(idHash string, lastSeenAt time.Time) error { return nil }
+func (s *deletingStore) DeleteSession(idHash string) error {
+	s.deleted = append(s.deleted, idHash)
+	return nil
+}
+func (s *deletingStore) DeleteExpiredSessions(lastSeenBefore time.Time, createdBefore time.Time) error {
+	return nil
+}
+
+func TestHandleLogout(t *testing.T) {
+	tests := []struct {
+		name    string
+		cookie  string
+		token   string
+		status  int
+		deleted bool
+	}{
+		{"no token", "session", "", 403, false},
+		{"another session's token", "session", csrfToken("cookie-secret", "other"), 403, false},
+		{"the session's token", "session", csrfToken("cookie-secret", "session"), 200, true},
+		{"not signed in", "", "", 200, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &deletingStore{}
+			router := gin.New()
+			router.POST("/logout", HandleLogout("cookie-secret", &Sessions{Store: store}), func(c *gin.Context) {
+				c.String(200, "Signed out")
+			})
+			req := httptest.NewRequest("POST", "/logout", strings.NewReader(url.Values{CSRFField: {test.token}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: CookieName, Value: test.cookie})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("Status is %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if deleted := len(store.deleted) == 1 && store.deleted[0] == hashSessionId("session"); deleted != test.deleted {
+				t.Errorf("Deleted sessions %q", store.deleted)
+			}
+			if cleared := strings.Contains(w.Header().Get("Set-Cookie"), CookieName+"=;"); cleared != (test.status == 200) {
+				t.Errorf("Set-Cookie is %q", w.Header().Get("Set-Cookie"))
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package hgin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	fernet "github.com/fernet/fernet-go"
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+const (
+	SSOCookieName = "heroku-sso"
+	// How long a dashboard stays open after signing on.
+	ssoSessionLength = time.Hour
+)
+
+// A developer who signed on to the dashboard of one add-on resource.
+type SSOSession struct {
+	ResourceId string `json:"resource_id"`
+	Email      string `json:"email"`
+}
+
+// Verifies single sign-on requests from Heroku and starts a session for the resource. The
+// session cookie is only sent to paths under cookiePath. dashboard gives the page to redirect to.
+func HandleSSO(salt string, cookieSecret string, cookiePath string, dashboard func(resourceId string) string) gin.HandlerFunc {
+
+	fernetKey, err := fernet.DecodeKey(cookieSecret)
+	if err != nil {
+		logger.Fatal("Cookie secret is not a valid Fernet key")
+	}
+
+	return func(c *gin.Context) {
+		request := &heroku.SSORequest{}
+		c.Bind(request)
+		if err := request.Verify(salt, time.Now()); err != nil {
+			logger.Print("Rejected single sign-on for resource ", request.ResourceId, ": ", err)
+			c.String(403, "Single sign-on failed: "+err.Error())
+			return
+		}
+		session, _ := json.Marshal(SSOSession{ResourceId: request.ResourceId, Email: request.Email})
+		encryptedBytes, err := fernet.EncryptAndSign(session, fernetKey)
+		if err != nil {
+			c.String(500, "Internal error: "+err.Error())
+			return
+		}
+		c.SetCookie(SSOCookieName, base64.RawURLEncoding.EncodeToString(encryptedBytes),
+			int(ssoSessionLength.Seconds()), cookiePath, "", true, true)
+
+		// Redirecting turns the POST into a page that can be reloaded and linked to.
+		c.Redirect(302, dashboard(request.ResourceId))
+	}
+}
+
+// Lets the request through if the developer signed on to the resource named by the URL
+// parameter param. There's no way to sign on from here, so others are turned away.
+func CheckSSO(cookieSecret string, param string) gin.HandlerFunc {
+
+	fernetKey, err := fernet.DecodeKey(cookieSecret)
+	if err != nil {
+		logger.Fatal("Cookie secret is not a valid Fernet key")
+	}
+
+	return func(c *gin.Context) {
+		session, ok := readSSOCookie(c, fernetKey)
+		if !ok || session.ResourceId != c.Param(param) {
+			c.Abort()
+			c.String(401, "Open the add-on from its app on the Heroku Dashboard or with heroku addons:open.")
+			return
+		}
+		cookie, _ := c.Request.Cookie(SSOCookieName)
+		c.Set("heroku-sso", session)
+		c.Set("csrf-token", csrfToken(cookieSecret, cookie.Value))
+		c.Next()
+	}
+}
+
+func readSSOCookie(c *gin.Context, fernetKey *fernet.Key) (session SSOSession, ok bool) {
+	cookie, err := c.Request.Cookie(SSOCookieName)
+	if err != nil {
+		return session, false
+	}
+	cookieBytes, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return session, false
+	}
+	decrypted := fernet.VerifyAndDecrypt(cookieBytes, ssoSessionLength, []*fernet.Key{fernetKey})
+	if decrypted == nil {
+		return session, false
+	}
+	return session, json.Unmarshal(decrypted, &session) == nil
+}
+
+func CurrentSSOSession(c *gin.Context) SSOSession {
+	val, exists := c.Get("heroku-sso")
+	if !exists {
+		logger.Print("WARNING! single sign-on session not found in context as expected")
+		return SSOSession{}
+	}
+	return val.(SSOSession)
+}
@@ -0,0 +1,98 @@
+package heroku
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+)
+
+// An add-on manifest for version 3 of the Add-on Partner API, as pushed with
+// heroku addons:admin:manifest:push.
+type Manifest struct {
+	Id    string         `json:"id"`
+	Name  string         `json:"name"`
+	API   ManifestAPI    `json:"api"`
+	Plans []ManifestPlan `json:"plans,omitempty"`
+}
+
+type ManifestAPI struct {
+	ConfigVars []string `json:"config_vars"`
+	Regions    []string `json:"regions"`
+	// Heroku authenticates to the add-on with the manifest id and this password.
+	Password   string        `json:"password"`
+	SSOSalt    string        `json:"sso_salt"`
+	Requires   []string      `json:"requires"`
+	Production ManifestURLs  `json:"production"`
+	Test       *ManifestURLs `json:"test,omitempty"`
+	Version    string        `json:"version"`
+}
+
+type ManifestURLs struct {
+	// Heroku provisions with POST base_url and changes plans and deprovisions with PUT and
+	// DELETE base_url/:id.
+	BaseURL string `json:"base_url"`
+	SSOURL  string `json:"sso_url"`
+}
+
+type ManifestPlan struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+var (
+	manifestIdPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{2,}$`)
+	configVarPattern  = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// Checks the manifest against the rules Heroku applies when it's pushed. Returns every problem
+// found, not just the first.
+func (m *Manifest) Validate() []error {
+	var problems []error
+	if !manifestIdPattern.MatchString(m.Id) {
+		problems = append(problems, errors.New("id must be at least 3 lowercase letters, digits and dashes, starting with a letter"))
+	}
+	if m.API.Version != "3" {
+		problems = append(problems, errors.New("api.version must be 3"))
+	}
+	if m.API.Password == "" {
+		problems = append(problems, errors.New("api.password is required"))
+	}
+	if m.API.SSOSalt == "" {
+		problems = append(problems, errors.New("api.sso_salt is required"))
+	}
+	if len(m.API.Regions) == 0 {
+		problems = append(problems, errors.New("api.regions must list at least one region"))
+	}
+	if len(m.API.ConfigVars) == 0 {
+		problems = append(problems, errors.New("api.config_vars must list at least one config var"))
+	}
+	for _, name := range m.API.ConfigVars {
+		if !configVarPattern.MatchString(name) {
+			problems = append(problems, errors.New("api.config_vars: "+name+" must be uppercase letters, digits and underscores"))
+		}
+	}
+	problems = append(problems, validateManifestURLs("api.production", m.API.Production, true)...)
+	if m.API.Test != nil {
+		problems = append(problems, validateManifestURLs("api.test", *m.API.Test, false)...)
+	}
+	for _, p := range m.Plans {
+		if !manifestIdPattern.MatchString(p.Id) {
+			problems = append(problems, errors.New("plans: "+p.Id+" must be lowercase letters, digits and dashes, starting with a letter"))
+		}
+	}
+	return problems
+}
+
+// Production URLs must use https. Test URLs usually point at localhost and may not.
+func validateManifestURLs(prefix string, urls ManifestURLs, requireHTTPS bool) []error {
+	var problems []error
+	for _, field := range []struct{ name, raw string }{{prefix + ".base_url", urls.BaseURL}, {prefix + ".sso_url", urls.SSOURL}} {
+		u, err := url.Parse(field.raw)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			problems = append(problems, errors.New(field.name+" must be an absolute http or https URL"))
+		} else if requireHTTPS && u.Scheme != "https" {
+			problems = append(problems, errors.New(field.name+" must use https"))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,51 @@
+package heroku
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// How far the timestamp of a single sign-on request may be from the current time.
+const SSOMaxAge = 5 * time.Minute
+
+// Sent by Heroku when a developer opens the add-on's dashboard from the Heroku Dashboard or
+// with heroku addons:open.
+type SSORequest struct {
+	// Heroku's id of the add-on, like the uuid of a CreateAddonRequest.
+	ResourceId    string `form:"resource_id"`
+	Timestamp     string `form:"timestamp"`
+	ResourceToken string `form:"resource_token"`
+	Email         string `form:"email"`
+	UserId        string `form:"user_id"`
+	AppName       string `form:"context_app"`
+}
+
+// The resource token is the hex SHA1 of resource_id:salt:timestamp.
+func SSOToken(salt string, resourceId string, timestamp string) string {
+	sum := sha1.Sum([]byte(resourceId + ":" + salt + ":" + timestamp))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks that the request was signed with the add-on's SSO salt and isn't older than SSOMaxAge.
+func (r *SSORequest) Verify(salt string, now time.Time) error {
+	if r.ResourceId == "" || r.ResourceToken == "" {
+		return errors.New("resource_id and resource_token are required")
+	}
+	seconds, err := strconv.ParseInt(r.Timestamp, 10, 64)
+	if err != nil {
+		return errors.New("timestamp must be a number of seconds")
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > SSOMaxAge || age < -SSOMaxAge {
+		return errors.New("timestamp is too old or in the future")
+	}
+	expected := SSOToken(salt, r.ResourceId, r.Timestamp)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(r.ResourceToken)) != 1 {
+		return errors.New("resource_token is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package heroku
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Header carrying the base64 HMAC-SHA256 of a webhook delivery's body, keyed with the secret the
+// webhook was created with.
+const WebhookSignatureHeader = "Heroku-Webhook-Hmac-SHA256"
+
+// Subscribes to events of the app an add-on is attached to.
+type AddonWebhookRequest struct {
+	// Entities to subscribe to, e.g. api:app.
+	Include []string `json:"include"`
+	// notify, or sync to have Heroku retry failed deliveries.
+	Level  string `json:"level"`
+	Secret string `json:"secret,omitempty"`
+	URL    string `json:"url"`
+}
+
+type AddonWebhook struct {
+	Id      string   `json:"id"`
+	Include []string `json:"include"`
+	Level   string   `json:"level"`
+	URL     string   `json:"url"`
+}
+
+// An api:app event. Data is the app after the change.
+type AppWebhookEvent struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Data     App    `json:"data"`
+}
+
+func (c *Client) CreateAddonWebhook(addonId string, request AddonWebhookRequest) (*AddonWebhook, error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do("POST", "/addons/"+addonId+"/webhooks", b, nil, 201)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	webhook := &AddonWebhook{}
+	return webhook, json.NewDecoder(res.Body).Decode(webhook)
+}
+
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the signature Heroku sent with a webhook delivery.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(WebhookSignature(secret, body)), []byte(signature))
+}
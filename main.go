@@ -5,25 +5,40 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
 )
 
 type appConfig struct {
 	clientSecret       string
+	ssoSalt            string
+	addonURL           string
+	webhookSecret      string
 	port               string
-	dbCreds            string
-	dbSecret           string
 	addonProviderToken string
 	cookieSecret       string
 	oauthId            string
 	oauthSecret        string
+	usageInterval      time.Duration
+	copyMaxBytes       int64
+	herokuAPIURL       string
+	herokuIdURL        string
+	// Who may sign in to the management pages.
+	allowedDomains []string
+	allowedUsers   []string
+	// Sessions end after being idle this long, or this long after signing in.
+	sessionIdleTimeout time.Duration
+	sessionMaxAge      time.Duration
 }
 
 var (
 	logger = log.New(os.Stderr, "[Web] ", log.Ldate|log.Ltime|log.Lshortfile)
-	db     database.DbController
+	db     database.Store
 	config appConfig
 )
 
@@ -43,25 +58,85 @@ func getRequiredenv(key string) string {
 	return val
 }
 
+func getenvDefault(key string, defaultValue string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultValue
+}
+
+// An unauthorized client for the configured Heroku endpoints, to exchange OAuth codes with.
+func herokuPlatform() *heroku.Client {
+	return &heroku.Client{APIURL: config.herokuAPIURL, IdURL: config.herokuIdURL}
+}
+
+func getDurationenv(key string, defaultValue time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		logger.Fatal(key, " must be a duration like 6h: ", err)
+	}
+	return d
+}
+
+func getInt64env(key string, defaultValue int64) int64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		logger.Fatal(key, " must be a number: ", err)
+	}
+	return n
+}
+
+// A comma separated list. Blank entries are dropped.
+func getListenv(key string, defaultValue string) []string {
+	var list []string
+	for _, val := range strings.Split(getenvDefault(key, defaultValue), ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			list = append(list, val)
+		}
+	}
+	return list
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+	}
+
 	config = appConfig{
 		port:               getRequiredenv("PORT"),
-		dbCreds:            getRequiredenv("DATABASE_URL"),
-		dbSecret:           getRequiredenv("DATABASE_SECRET"),
 		addonProviderToken: getRequiredenv("ADDON_PROVIDER_TOKEN"),
 		cookieSecret:       getRequiredenv("COOKIE_SECRET"),
 		oauthId:            getRequiredenv("HEROKU_OAUTH_ID"),
 		oauthSecret:        getRequiredenv("HEROKU_OAUTH_SECRET"),
 		clientSecret:       getRequiredenv("ADDON_PROVIDER_CLIENT_SECRET"),
+		ssoSalt:            getRequiredenv("HEROKU_SSO_SALT"),
+		addonURL:           getenvDefault("ADDON_URL", defaultAddonURL),
+		webhookSecret:      os.Getenv("HEROKU_WEBHOOK_SECRET"),
+		usageInterval:      getDurationenv("USAGE_INTERVAL", 6*time.Hour),
+		copyMaxBytes:       getInt64env("COPY_MAX_BYTES", 1<<30),
+		herokuAPIURL:       getenvDefault("HEROKU_API_URL", heroku.DefaultAPIURL),
+		herokuIdURL:        getenvDefault("HEROKU_ID_URL", heroku.DefaultIdURL),
+		allowedDomains:     getListenv("ALLOWED_EMAIL_DOMAINS", "heroku.com,salesforce.com"),
+		allowedUsers:       getListenv("ALLOWED_USERS", ""),
+		sessionIdleTimeout: getDurationenv("SESSION_IDLE_TIMEOUT", 2*time.Hour),
+		sessionMaxAge:      getDurationenv("SESSION_MAX_AGE", 24*time.Hour),
 	}
 
-	// Need to declare err in advance, because cannot use := syntax in next statement as that
-	// will create a main() scoped db variable when we really want a globally scoped variable.
-	var err error
-	db, err = database.NewController(config.dbCreds, config.dbSecret)
-	if err != nil {
-		logger.Fatal("Error connecting to database: ", err)
+	pg := connectDatabase()
+	if err := pg.Migrate(); err != nil {
+		logger.Fatal("Error migrating database: ", err)
 	}
+	db = &pg
+
+	go collectUsage(config.usageInterval)
 
 	// General routing setup
 	router := gin.New()
@@ -78,33 +153,16 @@ func main() {
 		c.String(http.StatusOK, "")
 	})
 
-	// Utility endpoint to generate a new database key
-	// It was easier to put it here than create a new cmd
-	router.GET("/genkey", func(c *gin.Context) {
-		c.String(http.StatusOK, database.GenerateEncodedKey())
-	})
-
-	// Test endpoint for setting up AWS accounts without the UI
-	router.POST("/account", func(c *gin.Context) {
-		account := &database.Account{}
-		c.Bind(account)
-		logger.Print("Saving new AWS creds for Heroku user ", account.OwnerId)
-		err := db.SaveAccount(account)
-		if err != nil {
-			logger.Print("Error saving account: ", err.Error())
-			c.String(500, "Error saving account: "+err.Error())
-		} else {
-			c.String(201, "Account saved.")
-		}
-	})
-
 	// Management Endpoints
 
 	setupManageRoutes(router)
+	setupOperatorRoutes(router)
 
 	// Heroku Addon Endpoints
 
 	setupAddonRoutes(router)
+	setupDashboardRoutes(router)
+	setupWebhookRoutes(router)
 
 	router.Run(":" + config.port)
 }
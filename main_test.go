@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Points db at an empty MemoryStore for the rest of the test.
+func useMemoryStore(t *testing.T) *database.MemoryStore {
+	t.Helper()
+	store := database.NewMemoryStore()
+	previous := db
+	db = store
+	t.Cleanup(func() { db = previous })
+	return store
+}
+
+func serve(router *gin.Engine, method string, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func findAudit(t *testing.T, filter database.AuditFilter) []database.AuditEvent {
+	t.Helper()
+	events, err := db.FindAuditEvents(filter)
+	if err != nil {
+		t.Fatal("Finding audit events: ", err)
+	}
+	return events
+}
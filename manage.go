@@ -2,6 +2,10 @@ package main
 
 import (
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jesperfj/byodemo/database"
@@ -9,34 +13,80 @@ import (
 	"github.com/jesperfj/byodemo/heroku/hgin"
 )
 
+var accountAliasPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,29}$`)
+
 // used to render orgs with accounts page
 type OrgWithAccount struct {
-	Organization   *heroku.Organization
-	HasAccount     bool
-	AWSAccessKeyId string
+	Team *heroku.Team
+	// Default first
+	Accounts    []database.Account
+	ObjectCount int64
+	Size        string
+	// Name of the enterprise account the team is part of, set on the first team of each.
+	EnterpriseHeading string
+}
+
+// The user's personal account followed by their teams. Teams that aren't part of an enterprise
+// account come first, then the rest grouped by enterprise account.
+func findTeams(hc *heroku.Client) ([]*heroku.Team, error) {
+	account, err := hc.Account()
+	if err != nil {
+		return nil, err
+	}
+	teams, err := hc.Teams()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(teams, func(i, j int) bool {
+		return enterpriseName(teams[i]) < enterpriseName(teams[j])
+	})
+	return append([]*heroku.Team{heroku.PersonalTeam(account)}, teams...), nil
 }
 
-func findOrgsWithAccounts(orgs []*heroku.Organization) []*OrgWithAccount {
+func enterpriseName(team *heroku.Team) string {
+	if team.EnterpriseAccount == nil {
+		return ""
+	}
+	return team.EnterpriseAccount.Name
+}
+
+func findOrgsWithAccounts(orgs []*heroku.Team) ([]*OrgWithAccount, error) {
 	result := make([]*OrgWithAccount, len(orgs))
 	ids := make([]string, len(orgs))
 	for i, o := range orgs {
 		ids[i] = o.Id
 	}
-	accounts := db.FindAccounts(ids)
+	accounts, err := db.FindAccounts(ids)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := db.FindLatestUsage(ids)
+	if err != nil {
+		// Usage is informational. Render the page without it.
+		logger.Print("Error finding usage: ", err)
+	}
+	objects := make(map[string]int64)
+	bytes := make(map[string]int64)
+	for _, u := range usage {
+		objects[u.OwnerId] += u.ObjectCount
+		bytes[u.OwnerId] += u.TotalBytes
+	}
 	for i, o := range orgs {
-		key, ok := accounts[o.Id]
 		result[i] = &OrgWithAccount{
-			Organization:   o,
-			HasAccount:     ok,
-			AWSAccessKeyId: key,
+			Team:        o,
+			Accounts:    accounts[o.Id],
+			ObjectCount: objects[o.Id],
+			Size:        formatBytes(bytes[o.Id]),
+		}
+		if name := enterpriseName(o); name != "" && (i == 0 || name != enterpriseName(orgs[i-1])) {
+			result[i].EnterpriseHeading = name
 		}
 	}
-	return result
+	return result, nil
 }
 
-func getAndValidateOrg(c *gin.Context) (org *heroku.Organization, failed bool) {
-	hc := hgin.HerokuClient(c)
-	orgs, err := hc.Organizations()
+func getAndValidateOrg(c *gin.Context) (org *heroku.Team, failed bool) {
+	orgs, err := findTeams(hgin.HerokuClient(c))
 	if err != nil {
 		c.String(500, "Oops: ", err)
 		return org, true
@@ -54,46 +104,96 @@ func getAndValidateOrg(c *gin.Context) (org *heroku.Organization, failed bool) {
 	return org, false
 }
 
+// Only team admins may link, update or unlink accounts, register existing buckets and set the
+// team's policies. Other members can look but not change anything.
+func requireOrgAdmin(c *gin.Context, org *heroku.Team) (failed bool) {
+	if org.Role != "admin" {
+		c.String(403, "Only admins of the "+org.Name+" team can do this.")
+		return true
+	}
+	return false
+}
+
+// Looks up the linked account in the URL. Accounts of other orgs are reported as not found.
+func getAndValidateAccount(c *gin.Context, org *heroku.Team) (account database.Account, failed bool) {
+	id, err := strconv.ParseInt(c.Param("account_id"), 10, 64)
+	if err == nil {
+		account, err = db.FindAccount(org.Id, id)
+	}
+	if err != nil {
+		c.String(404, "Not found.")
+		return account, true
+	}
+	return account, false
+}
+
 func setupManageRoutes(router *gin.Engine) {
-	router.GET("/callback", hgin.HandleCallback(config.cookieSecret, config.oauthSecret, "/manage/orgs/"))
+	sessions := managementSessions()
+	policy := &hgin.EmailPolicy{Domains: config.allowedDomains, Users: config.allowedUsers}
+	router.GET("/callback", hgin.HandleCallback(herokuPlatform(), config.cookieSecret, config.oauthSecret, sessions, policy, "/manage/orgs/"))
+	router.POST("/logout", hgin.HandleLogout(config.cookieSecret, sessions), func(c *gin.Context) {
+		c.HTML(http.StatusOK, "logout.tmpl.html", gin.H{})
+	})
 
-	manage := router.Group("/manage", hgin.CheckAuth(config.cookieSecret, config.oauthId))
+	manage := router.Group("/manage",
+		hgin.CheckAuth(herokuPlatform(), config.cookieSecret, config.oauthId, config.oauthSecret, sessions), hgin.CheckCSRF())
 
 	manage.GET("/orgs", func(c *gin.Context) {
 		c.Redirect(302, "/manage/orgs/")
 	})
 
 	manage.GET("/orgs/", func(c *gin.Context) {
-		hc := hgin.HerokuClient(c)
-		orgs, err := hc.Organizations()
-		orgsWithAccounts := findOrgsWithAccounts(orgs)
+		orgs, err := findTeams(hgin.HerokuClient(c))
 		if err != nil {
 			c.String(500, "Oops: ", err)
 			return
 		}
+		orgsWithAccounts, err := findOrgsWithAccounts(orgs)
+		if err != nil {
+			c.String(500, "Error finding linked accounts: "+err.Error())
+			return
+		}
 
-		c.HTML(http.StatusOK, "orgs.tmpl.html", gin.H{"orgs": orgsWithAccounts})
+		renderManagePage(c, http.StatusOK, "orgs.tmpl.html", gin.H{"orgs": orgsWithAccounts})
 	})
 
 	manage.GET("/orgs/:org_id/link", func(c *gin.Context) {
 		org, failed := getAndValidateOrg(c)
-		if failed {
+		if failed || requireOrgAdmin(c, org) {
 			return
 		}
-		c.HTML(http.StatusOK, "link.tmpl.html", gin.H{"org": org})
+		renderManagePage(c, http.StatusOK, "link.tmpl.html", gin.H{"org": org, "alias": database.DefaultAccountAlias})
 	})
 
 	manage.POST("/orgs/:org_id/link", func(c *gin.Context) {
 		org, failed := getAndValidateOrg(c)
-		if failed {
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		alias := c.PostForm("alias")
+		if !accountAliasPattern.MatchString(alias) {
+			renderManagePage(c, 400, "link.tmpl.html", gin.H{"org": org, "alias": alias,
+				"message": "Names can have up to 30 lowercase letters, digits and dashes, starting with a letter or digit."})
+			return
+		}
+		_, found, err := db.FindAccountByAlias(org.Id, alias)
+		if err != nil {
+			c.String(500, "Error linking account: "+err.Error())
+			return
+		}
+		if found {
+			renderManagePage(c, 400, "link.tmpl.html", gin.H{"org": org, "alias": alias,
+				"message": "The team already has an account named " + alias + "."})
 			return
 		}
 		account := &database.Account{
 			OwnerId:            org.Id,
+			Alias:              alias,
 			AWSAccessKeyId:     c.PostForm("awsAccessKeyId"),
 			AWSSecretAccessKey: c.PostForm("awsSecretAccessKey"),
 		}
-		err := db.SaveAccount(account)
+		err = db.SaveAccount(account)
+		recordAudit(currentUserEmail(c), org.Id, "", auditLink, err)
 		if err != nil {
 			logger.Print("Error saving account: ", err.Error())
 			c.String(500, "Error linking account: "+err.Error())
@@ -102,26 +202,64 @@ func setupManageRoutes(router *gin.Engine) {
 		}
 	})
 
-	manage.GET("/orgs/:org_id/unlink", func(c *gin.Context) {
+	manage.POST("/orgs/:org_id/accounts/:account_id/default", func(c *gin.Context) {
 		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		account, failed := getAndValidateAccount(c, org)
 		if failed {
 			return
 		}
-		c.HTML(http.StatusOK, "unlink.tmpl.html", gin.H{"org": org})
+		if err := db.SetDefaultAccount(org.Id, account.Id); err != nil {
+			c.String(500, "Error changing default account: "+err.Error())
+			return
+		}
+		c.Redirect(302, "/manage/orgs/")
 	})
 
-	manage.POST("/orgs/:org_id/unlink", func(c *gin.Context) {
+	manage.GET("/orgs/:org_id/usage", func(c *gin.Context) {
 		org, failed := getAndValidateOrg(c)
 		if failed {
 			return
 		}
-		err := db.DeleteAccount(org.Id)
+		apps, total, err := findAppUsage(org.Id)
 		if err != nil {
-			logger.Print("Error deleting account: ", err.Error())
-			c.String(500, "Error unlinking account: "+err.Error())
-		} else {
-			c.Redirect(302, "/manage/orgs/")
+			c.String(500, "Error finding usage: "+err.Error())
+			return
 		}
+		policy, err := db.FindTeamPolicy(org.Id)
+		if err != nil {
+			c.String(500, "Error finding policy: "+err.Error())
+			return
+		}
+		renderManagePage(c, http.StatusOK, "usage.tmpl.html", gin.H{"org": org, "apps": apps, "total": formatBytes(total), "policy": policy})
 	})
 
+	// CSV export for chargeback. Covers the last 30 days unless ?days= says otherwise.
+	manage.GET("/orgs/:org_id/usage.csv", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed {
+			return
+		}
+		days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+		if err != nil || days < 1 {
+			c.String(400, "days must be a positive number")
+			return
+		}
+		usage, err := db.FindUsageHistory(org.Id, time.Now().UTC().AddDate(0, 0, -days))
+		if err != nil {
+			c.String(500, "Error finding usage: "+err.Error())
+			return
+		}
+		writeUsageCSV(c, org.Name, usage)
+	})
+
+	setupSettingsRoutes(manage)
+	setupBucketRoutes(manage)
+	setupCredentialsRoutes(manage)
+	setupUnlinkRoutes(manage)
+	setupAuditRoutes(manage)
+	setupTransferRoutes(manage)
+
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+const (
+	// Heroku's id for the add-on. Heroku also uses it as the user name for the add-on API.
+	addonManifestId = "byodemo"
+	addonAPIPath    = "/addon/heroku/resources"
+	addonSSOPath    = "/addon/heroku/sso"
+	defaultAddonURL = "https://byodemo-addon.herokuapp.com"
+)
+
+var (
+	// Set by finishProvisioning. BUCKET_PREFIX only on the shared plan.
+	addonConfigVars = []string{"BUCKET_NAME", "BUCKET_PREFIX", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}
+	// Plans the add-on is listed with. Every plan but shared gets a bucket of its own.
+	addonPlans = []heroku.ManifestPlan{
+		{Id: "basic", Name: "Basic"},
+		{Id: sharedPlan, Name: "Shared bucket"},
+	}
+)
+
+// The manifest for the add-on served at addonURL, authenticated with password and salt.
+func addonManifest(addonURL string, password string, ssoSalt string) heroku.Manifest {
+	addonURL = strings.TrimSuffix(addonURL, "/")
+	testURL := "http://localhost:" + getenvDefault("PORT", "5000")
+	return heroku.Manifest{
+		Id:   addonManifestId,
+		Name: "Bucket Manager",
+		API: heroku.ManifestAPI{
+			ConfigVars: addonConfigVars,
+			// Buckets are created in us-east-1.
+			Regions:  []string{"us"},
+			Password: password,
+			SSOSalt:  ssoSalt,
+			Requires: []string{},
+			Production: heroku.ManifestURLs{
+				BaseURL: addonURL + addonAPIPath,
+				SSOURL:  addonURL + addonSSOPath,
+			},
+			Test: &heroku.ManifestURLs{
+				BaseURL: testURL + addonAPIPath,
+				SSOURL:  testURL + addonSSOPath,
+			},
+			Version: "3",
+		},
+		Plans: addonPlans,
+	}
+}
+
+// The manifest for this deployment, from ADDON_URL, ADDON_PROVIDER_TOKEN and HEROKU_SSO_SALT.
+func manifestFromEnv() heroku.Manifest {
+	return addonManifest(getenvDefault("ADDON_URL", defaultAddonURL),
+		getRequiredenv("ADDON_PROVIDER_TOKEN"), getRequiredenv("HEROKU_SSO_SALT"))
+}
+
+// Where manifest differs from what the add-on expects. Secrets are compared but never printed.
+func manifestMismatches(expected heroku.Manifest, manifest heroku.Manifest) []error {
+	var problems []error
+	mismatch := func(field string, want string, got string) {
+		if want != got {
+			problems = append(problems, errors.New(field+" is "+got+" but the add-on expects "+want))
+		}
+	}
+	mismatch("id", expected.Id, manifest.Id)
+	if manifest.API.Password != expected.API.Password {
+		problems = append(problems, errors.New("api.password doesn't match ADDON_PROVIDER_TOKEN"))
+	}
+	if manifest.API.SSOSalt != expected.API.SSOSalt {
+		problems = append(problems, errors.New("api.sso_salt doesn't match HEROKU_SSO_SALT"))
+	}
+	mismatch("api.production.base_url", expected.API.Production.BaseURL, manifest.API.Production.BaseURL)
+	mismatch("api.production.sso_url", expected.API.Production.SSOURL, manifest.API.Production.SSOURL)
+	mismatch("api.config_vars", sortedList(expected.API.ConfigVars), sortedList(manifest.API.ConfigVars))
+	planIds := func(plans []heroku.ManifestPlan) []string {
+		ids := make([]string, len(plans))
+		for i, p := range plans {
+			ids[i] = p.Id
+		}
+		return ids
+	}
+	mismatch("plans", sortedList(planIds(expected.Plans)), sortedList(planIds(manifest.Plans)))
+	return problems
+}
+
+func sortedList(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return "[" + strings.Join(sorted, ", ") + "]"
+}
+
+// byodemo manifest prints the manifest for this deployment. byodemo manifest validate <file>
+// checks a manifest against Heroku's rules and this deployment's configuration.
+func runManifest(args []string) {
+	expected := manifestFromEnv()
+	if len(args) == 0 {
+		if problems := expected.Validate(); len(problems) > 0 {
+			exitWithProblems("The configuration doesn't make a valid manifest", problems)
+		}
+		out, _ := json.MarshalIndent(expected, "", "  ")
+		os.Stdout.Write(append(out, '\n'))
+		return
+	}
+	if args[0] != "validate" || len(args) != 2 {
+		logger.Fatal("Usage: byodemo manifest [validate <manifest file>]")
+	}
+	raw, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		logger.Fatal("Error reading manifest: ", err)
+	}
+	manifest := heroku.Manifest{}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		logger.Fatal("Manifest is not valid JSON: ", err)
+	}
+	problems := append(manifest.Validate(), manifestMismatches(expected, manifest)...)
+	if len(problems) > 0 {
+		exitWithProblems(args[1]+" is not valid for this add-on", problems)
+	}
+	logger.Print(args[1], " is valid and matches the add-on's configuration")
+}
+
+func exitWithProblems(message string, problems []error) {
+	logger.Print(message, ":")
+	for _, p := range problems {
+		logger.Print("  ", p)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// Heroku team and user ids, as Heroku writes them. Anything else can't be stored as an owner.
+var ownerIdPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// An account link as the operator API shows it. The secret key is never returned.
+type apiAccount struct {
+	Id             int64  `json:"id"`
+	OwnerId        string `json:"owner_id"`
+	Alias          string `json:"alias"`
+	IsDefault      bool   `json:"is_default"`
+	AWSAccessKeyId string `json:"aws_access_key_id"`
+}
+
+type apiAccountRequest struct {
+	// DefaultAccountAlias if empty.
+	Alias              string `json:"alias"`
+	AWSAccessKeyId     string `json:"aws_access_key_id"`
+	AWSSecretAccessKey string `json:"aws_secret_access_key"`
+}
+
+func toAPIAccount(a database.Account) apiAccount {
+	return apiAccount{Id: a.Id, OwnerId: a.OwnerId, Alias: a.Alias, IsDefault: a.IsDefault, AWSAccessKeyId: a.AWSAccessKeyId}
+}
+
+func checkOwnerId(c *gin.Context) {
+	if !ownerIdPattern.MatchString(c.Param("owner_id")) {
+		c.Abort()
+		c.JSON(400, gin.H{"error": "The owner must be a Heroku team or user id, like 01234567-89ab-cdef-0123-456789abcdef"})
+	}
+}
+
+// For operators to link AWS accounts to teams and users without the management pages. Owners are
+// Heroku team or user ids, and aren't checked with Heroku.
+func setupOperatorRoutes(router *gin.Engine) {
+
+	api := router.Group("/admin/api/owners/:owner_id/accounts")
+
+	api.GET("", checkAPIToken(database.ScopeAccountsRead), checkOwnerId, func(c *gin.Context) {
+		ownerId := c.Param("owner_id")
+		accounts, err := db.FindAccounts([]string{ownerId})
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Error finding accounts: " + err.Error()})
+			return
+		}
+		result := make([]apiAccount, 0)
+		for _, a := range accounts[ownerId] {
+			result = append(result, toAPIAccount(a))
+		}
+		c.JSON(200, result)
+	})
+
+	api.POST("", checkAPIToken(database.ScopeAccountsWrite), checkOwnerId, func(c *gin.Context) {
+		ownerId := c.Param("owner_id")
+		request := apiAccountRequest{}
+		if err := json.NewDecoder(c.Request.Body).Decode(&request); err != nil {
+			c.JSON(400, gin.H{"error": "Bad request body: " + err.Error()})
+			return
+		}
+		if request.Alias == "" {
+			request.Alias = database.DefaultAccountAlias
+		}
+		if !accountAliasPattern.MatchString(request.Alias) {
+			c.JSON(400, gin.H{"error": "alias can have up to 30 lowercase letters, digits and dashes, starting with a letter or digit"})
+			return
+		}
+		if request.AWSAccessKeyId == "" || request.AWSSecretAccessKey == "" {
+			c.JSON(400, gin.H{"error": "aws_access_key_id and aws_secret_access_key are required"})
+			return
+		}
+		_, found, err := db.FindAccountByAlias(ownerId, request.Alias)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Error linking account: " + err.Error()})
+			return
+		}
+		if found {
+			c.JSON(409, gin.H{"error": "The owner already has an account named " + request.Alias})
+			return
+		}
+		account := &database.Account{
+			OwnerId:            ownerId,
+			Alias:              request.Alias,
+			AWSAccessKeyId:     request.AWSAccessKeyId,
+			AWSSecretAccessKey: request.AWSSecretAccessKey,
+		}
+		err = db.SaveAccount(account)
+		recordAudit(apiActor(c), ownerId, "", auditLink, err)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Error linking account: " + err.Error()})
+			return
+		}
+		c.JSON(201, toAPIAccount(*account))
+	})
+
+	// Accounts that add-ons still use need ?mode=transfer&transfer_to=<account id>, deprovision
+	// or detach, like unlinking on the management pages.
+	api.DELETE("/:account_id", checkAPIToken(database.ScopeAccountsWrite), checkOwnerId, func(c *gin.Context) {
+		owner := &heroku.Team{Id: c.Param("owner_id")}
+		id, err := strconv.ParseInt(c.Param("account_id"), 10, 64)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Not found"})
+			return
+		}
+		account, err := db.FindAccount(owner.Id, id)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Not found"})
+			return
+		}
+		status, err := unlinkAccount(owner, account, c.Query("mode"), c.Query("transfer_to"))
+		recordAudit(apiActor(c), owner.Id, "", auditUnlink, err)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, toAPIAccount(account))
+	})
+}
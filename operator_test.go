@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+)
+
+const (
+	teamId      = "5f8e3b1a-0c2d-4e6f-8a9b-1c2d3e4f5a6b"
+	otherTeamId = "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+)
+
+// A router with just the operator API, and bearer headers for a reading and a writing token.
+func operatorRouter(t *testing.T) (router *gin.Engine, reader http.Header, writer http.Header) {
+	t.Helper()
+	router = gin.New()
+	setupOperatorRoutes(router)
+	header := func(name string, scopes ...string) http.Header {
+		token, err := newAPIToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveAPIToken(&database.APIToken{Name: name, TokenHash: hashAPIToken(token), Scopes: scopes}); err != nil {
+			t.Fatal(err)
+		}
+		return http.Header{"Authorization": {"Bearer " + token}, "Content-Type": {"application/json"}}
+	}
+	return router, header("reader", database.ScopeAccountsRead),
+		header("writer", database.ScopeAccountsRead, database.ScopeAccountsWrite)
+}
+
+func TestOperatorAPITokens(t *testing.T) {
+	useMemoryStore(t)
+	router, reader, _ := operatorRouter(t)
+	path := "/admin/api/owners/" + teamId + "/accounts"
+	body := []byte(`{"aws_access_key_id":"AKIA","aws_secret_access_key":"secret"}`)
+
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+	}{
+		{"no token", "GET", nil, 401},
+		{"unknown token", "GET", http.Header{"Authorization": {"Bearer byo_unknown"}}, 401},
+		{"not a bearer token", "GET", http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}, 401},
+		{"read scope reading", "GET", reader, 200},
+		{"read scope writing", "POST", reader, 403},
+	}
+	for _, owner := range []string{"team", "5F8E3B1A-0C2D-4E6F-8A9B-1C2D3E4F5A6B", teamId + "0"} {
+		if w := serve(router, "GET", "/admin/api/owners/"+owner+"/accounts", nil, reader); w.Code != 400 {
+			t.Errorf("Owner %s gave %d, want 400: %s", owner, w.Code, w.Body)
+		}
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := serve(router, test.method, path, body, test.header); w.Code != test.status {
+				t.Errorf("Status is %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+	if accounts, _ := db.FindAccounts([]string{teamId}); len(accounts[teamId]) != 0 {
+		t.Errorf("A token without the write scope linked %+v", accounts[teamId])
+	}
+	if token, _, _ := db.FindAPIToken(hashAPIToken(reader.Get("Authorization")[len("Bearer "):])); token.LastUsedAt.IsZero() {
+		t.Error("Using a token didn't record when it was last used")
+	}
+}
+
+func TestOperatorAPILinkAndUnlink(t *testing.T) {
+	useMemoryStore(t)
+	router, _, writer := operatorRouter(t)
+	path := "/admin/api/owners/" + teamId + "/accounts"
+
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"aws_access_key_id":"AKIAPROD","aws_secret_access_key":"secret"}`, 201},
+		{`{"alias":"default","aws_access_key_id":"AKIAPROD","aws_secret_access_key":"secret"}`, 409},
+		{`{"alias":"Not An Alias","aws_access_key_id":"AKIA","aws_secret_access_key":"secret"}`, 400},
+		{`{"alias":"sandbox","aws_access_key_id":"AKIA"}`, 400},
+		{`not json`, 400},
+		{`{"alias":"sandbox","aws_access_key_id":"AKIASANDBOX","aws_secret_access_key":"secret"}`, 201},
+	} {
+		if w := serve(router, "POST", path, []byte(test.body), writer); w.Code != test.status {
+			t.Errorf("Linking %s gave %d, want %d: %s", test.body, w.Code, test.status, w.Body)
+		}
+	}
+
+	w := serve(router, "GET", path, nil, writer)
+	accounts := []apiAccount{}
+	if err := json.Unmarshal(w.Body.Bytes(), &accounts); err != nil {
+		t.Fatal(err, w.Body)
+	}
+	if len(accounts) != 2 || accounts[0].Alias != "default" || !accounts[0].IsDefault || accounts[1].AWSAccessKeyId != "AKIASANDBOX" {
+		t.Errorf("Listed %+v", accounts)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Error("The listing shows secret keys")
+	}
+
+	// An account an add-on still uses needs a mode.
+	sandbox := accounts[1]
+	if err := db.SaveAddonResource(&database.AddonResource{OwnerId: teamId, ProviderId: "p1", AddonId: "a1",
+		BucketName: "b1", AccountId: sandbox.Id}); err != nil {
+		t.Fatal(err)
+	}
+	accountPath := path + "/" + strconv.FormatInt(sandbox.Id, 10)
+	if w := serve(router, "DELETE", accountPath, nil, writer); w.Code != 400 {
+		t.Errorf("Unlinking a used account without a mode gave %d: %s", w.Code, w.Body)
+	}
+	if w := serve(router, "DELETE", "/admin/api/owners/"+otherTeamId+"/accounts/"+strconv.FormatInt(sandbox.Id, 10)+"?mode=detach", nil, writer); w.Code != 404 {
+		t.Errorf("Unlinking another owner's account gave %d: %s", w.Code, w.Body)
+	}
+	if w := serve(router, "DELETE", accountPath+"?mode=detach", nil, writer); w.Code != 200 {
+		t.Errorf("Detaching gave %d: %s", w.Code, w.Body)
+	}
+	if _, err := db.FindAccount(teamId, sandbox.Id); err == nil {
+		t.Error("Detached account is still linked")
+	}
+	if account, _, err := db.FindAccountForAddon("p1"); err != nil || account.Id != sandbox.Id {
+		t.Errorf("The add-on lost its account: %+v, %v", account, err)
+	}
+
+	events := findAudit(t, database.AuditFilter{OwnerId: teamId, Action: auditUnlink})
+	if len(events) != 2 || events[0].Outcome != database.AuditSuccess || events[1].Outcome != database.AuditFailure ||
+		events[0].Actor != "api:writer" {
+		t.Errorf("Audit events are %+v", events)
+	}
+}
+
+// Serves DELETE /apps/:app/addons/:addon for the add-ons in removable, with the token "grant".
+func platformStandIn(t *testing.T, removable map[string]bool) (deleted *[]string) {
+	t.Helper()
+	deleted = &[]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer grant" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.Method != "DELETE" || !removable[r.URL.Path] {
+			w.WriteHeader(422)
+			w.Write([]byte(`{"id":"invalid_params","message":"Can't remove that add-on."}`))
+			return
+		}
+		*deleted = append(*deleted, r.URL.Path)
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	previous := config.herokuAPIURL
+	config.herokuAPIURL = server.URL
+	t.Cleanup(func() { config.herokuAPIURL = previous })
+	return deleted
+}
+
+func TestOperatorAPIDeprovision(t *testing.T) {
+	useMemoryStore(t)
+	router, _, writer := operatorRouter(t)
+	deleted := platformStandIn(t, map[string]bool{"/apps/app1/addons/a1": true, "/apps/app2/addons/a2": true})
+	account := database.Account{OwnerId: teamId, Alias: "prod", AWSAccessKeyId: "AKIA", AWSSecretAccessKey: "secret"}
+	if err := db.SaveAccount(&account); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []database.AddonResource{
+		{OwnerId: teamId, ProviderId: "p1", AddonId: "a1", AppId: "app1", AppName: "one", BucketName: "b1", AccountId: account.Id},
+		{OwnerId: teamId, ProviderId: "p2", AddonId: "a2", AppId: "app2", AppName: "two", BucketName: "b2", AccountId: account.Id},
+		{OwnerId: teamId, ProviderId: "p3", AddonId: "a3", AppId: "app3", AppName: "three", BucketName: "b3", AccountId: account.Id},
+		{OwnerId: teamId, ProviderId: "p4", AddonId: "a4", AppId: "app4", AppName: "four", BucketName: "b4", AccountId: account.Id},
+	} {
+		if err := db.SaveAddonResource(&r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// p3's add-on can't be removed on Heroku and p4 has no grant.
+	for _, providerId := range []string{"p1", "p2", "p3"} {
+		db.SaveAddonGrant(&database.AddonGrant{ProviderId: providerId, AccessToken: "grant"})
+	}
+
+	w := serve(router, "DELETE", "/admin/api/owners/"+teamId+"/accounts/"+strconv.FormatInt(account.Id, 10)+"?mode=deprovision", nil, writer)
+	if w.Code != 502 || !strings.Contains(w.Body.String(), "four, three.") {
+		t.Errorf("Deprovisioning gave %d: %s", w.Code, w.Body)
+	}
+	if len(*deleted) != 2 {
+		t.Errorf("Asked Heroku to remove %q", *deleted)
+	}
+	if _, err := db.FindAccount(teamId, account.Id); err == nil {
+		t.Error("The account is still linked")
+	}
+	// Heroku calls the add-on API's DELETE for the removed ones. Until then they all keep the account.
+	for _, providerId := range []string{"p1", "p3", "p4"} {
+		if a, r, err := db.FindAccountForAddon(providerId); err != nil || a.Id != account.Id || r.MarkedForDeletion {
+			t.Errorf("Resource %s is %+v on %+v: %v", providerId, r, a, err)
+		}
+	}
+	if grant, found, _ := db.FindAddonGrant("p3"); !found || grant.AccessToken != "grant" {
+		t.Error("The grant of an add-on still on Heroku was dropped")
+	}
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"strings"
+
+	fernet "github.com/fernet/fernet-go"
+)
+
+// Rotating the Fernet key:
+//
+//   1. Generate a new key and prepend it to DATABASE_SECRET, e.g. "new,old". New secrets are
+//      encrypted with the new key while existing ones still decrypt with the old.
+//   2. Run `byodemo rotate-keys` to re-encrypt every stored secret with the new key.
+//   3. Remove the old key from DATABASE_SECRET.
+
+const FernetName = "fernet"
+
+// Encrypts with Fernet keys from configuration. This is how secrets were always stored.
+type FernetStore struct {
+	// Newest first. The first key encrypts, all of them decrypt.
+	keys []*fernet.Key
+}
+
+// secret is a comma separated list of Fernet keys, newest first.
+func NewFernetStore(secret string) (*FernetStore, error) {
+	encoded := strings.Split(secret, ",")
+	for i := range encoded {
+		encoded[i] = strings.TrimSpace(encoded[i])
+	}
+	keys, err := fernet.DecodeKeys(encoded...)
+	if err != nil {
+		logger.Print("Couldn't parse secret keys. Are they correctly formatted fernet keys? Error: ", err)
+		return nil, err
+	}
+	return &FernetStore{keys: keys}, nil
+}
+
+func GenerateFernetKey() string {
+	key := fernet.Key{}
+	key.Generate()
+	return key.Encode()
+}
+
+func (s *FernetStore) Name() string {
+	return FernetName
+}
+
+func (s *FernetStore) Encrypt(plaintext string) ([]byte, error) {
+	return fernet.EncryptAndSign([]byte(plaintext), s.keys[0])
+}
+
+func (s *FernetStore) Decrypt(token []byte) (string, error) {
+	plaintext := fernet.VerifyAndDecrypt(token, -1, s.keys)
+	if plaintext == nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+func (s *FernetStore) IsStale(token []byte) bool {
+	return fernet.VerifyAndDecrypt(token, -1, s.keys[:1]) == nil
+}
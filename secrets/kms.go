@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const KMSName = "kms"
+
+// Envelope encryption with AWS KMS. Every secret gets its own data key from KMS, which encrypts it
+// with AES-GCM. Only the KMS encrypted data key is stored next to the secret, so decrypting needs
+// a call to KMS. KMS rotates its key material behind the key id by itself, so tokens never go stale.
+//
+// The KMS client isn't vendored, so this signs the two JSON API calls it needs itself. AWS
+// credentials come from the usual AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables.
+type KMSStore struct {
+	keyId    string
+	region   string
+	endpoint string
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+// What is stored for each secret.
+type kmsEnvelope struct {
+	EncryptedKey []byte `json:"encrypted_key"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+type kmsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// keyId is a key id, ARN or alias like alias/byodemo.
+func NewKMSStore(region string, keyId string) (*KMSStore, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		logger.Print("Error initializing KMS session: ", err)
+		return nil, err
+	}
+	return &KMSStore{
+		keyId:    keyId,
+		region:   region,
+		endpoint: "https://kms." + region + ".amazonaws.com/",
+		signer:   v4.NewSigner(sess.Config.Credentials),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *KMSStore) Name() string {
+	return KMSName
+}
+
+func (s *KMSStore) Encrypt(plaintext string) ([]byte, error) {
+	var dataKey struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	err := s.call("GenerateDataKey", map[string]string{"KeyId": s.keyId, "KeySpec": "AES_256"}, &dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	envelope := kmsEnvelope{EncryptedKey: dataKey.CiphertextBlob, Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext = gcm.Seal(nil, envelope.Nonce, []byte(plaintext), nil)
+	return json.Marshal(envelope)
+}
+
+func (s *KMSStore) Decrypt(token []byte) (string, error) {
+	var envelope kmsEnvelope
+	if err := json.Unmarshal(token, &envelope); err != nil {
+		return "", ErrDecrypt
+	}
+	var dataKey struct {
+		Plaintext []byte
+	}
+	if err := s.call("Decrypt", map[string][]byte{"CiphertextBlob": envelope.EncryptedKey}, &dataKey); err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+func (s *KMSStore) IsStale(token []byte) bool {
+	return false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Calls a KMS API action with input as the JSON body and decodes the response into output.
+func (s *KMSStore) call(action string, input interface{}, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if _, err := s.signer.Sign(req, bytes.NewReader(body), "kms", s.region, time.Now()); err != nil {
+		logger.Print("Error signing KMS request: ", err)
+		return err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		logger.Print("Error calling KMS ", action, ": ", err)
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		kmsErr := kmsError{}
+		json.NewDecoder(res.Body).Decode(&kmsErr)
+		logger.Print("KMS ", action, " failed with ", res.Status, ": ", kmsErr.Type, " ", kmsErr.Message)
+		return errors.New("KMS " + action + " failed: " + kmsErr.Type + " " + kmsErr.Message)
+	}
+	return json.NewDecoder(res.Body).Decode(output)
+}
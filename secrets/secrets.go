@@ -0,0 +1,25 @@
+package secrets
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// Encrypts the AWS secrets of linked accounts before they are stored. Every stored secret records
+// the Name of the store that encrypted it, so secrets keep decrypting after the configured store
+// changes, as long as the old store is still configured too.
+type SecretStore interface {
+	Name() string
+	Encrypt(plaintext string) ([]byte, error)
+	Decrypt(token []byte) (string, error)
+	// True if the token decrypts but should be re-encrypted, e.g. because it was made with a key
+	// that is being rotated out.
+	IsStale(token []byte) bool
+}
+
+var (
+	logger = log.New(os.Stderr, "[secrets] ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	ErrDecrypt = errors.New("Couldn't decrypt stored secret. Is the key it was encrypted with still configured?")
+)
@@ -0,0 +1,156 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jesperfj/byodemo/secrets/secretstest"
+)
+
+func newTestVaultStore(t *testing.T) *VaultStore {
+	t.Helper()
+	server := secretstest.NewVault("vault-token", "byodemo")
+	t.Cleanup(server.Close)
+	return NewVaultStore(server.URL+"/", "vault-token", "byodemo")
+}
+
+func newTestKMSStore(t *testing.T) *KMSStore {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIATEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	server := secretstest.NewKMS("alias/byodemo")
+	t.Cleanup(server.Close)
+	store, err := NewKMSStore("us-east-1", "alias/byodemo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.endpoint = server.URL + "/"
+	return store
+}
+
+func newTestFernetStore(t *testing.T) *FernetStore {
+	t.Helper()
+	store, err := NewFernetStore(GenerateFernetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, newStore := range map[string]func(t *testing.T) SecretStore{
+		FernetName: func(t *testing.T) SecretStore { return newTestFernetStore(t) },
+		VaultName:  func(t *testing.T) SecretStore { return newTestVaultStore(t) },
+		KMSName:    func(t *testing.T) SecretStore { return newTestKMSStore(t) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			if store.Name() != name {
+				t.Errorf("Store is named %q", store.Name())
+			}
+			for _, plaintext := range []string{"secret", "", "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"} {
+				token, err := store.Encrypt(plaintext)
+				if err != nil {
+					t.Fatal("Encrypting: ", err)
+				}
+				if plaintext != "" && string(token) == plaintext {
+					t.Error("Token is the plaintext")
+				}
+				if decrypted, err := store.Decrypt(token); err != nil || decrypted != plaintext {
+					t.Errorf("Decrypted %q: %q, %v", plaintext, decrypted, err)
+				}
+				if store.IsStale(token) {
+					t.Error("A new token is stale")
+				}
+			}
+			// Each secret is encrypted on its own.
+			first, _ := store.Encrypt("secret")
+			second, _ := store.Encrypt("secret")
+			if string(first) == string(second) {
+				t.Error("Encrypting the same secret twice gave the same token")
+			}
+		})
+	}
+}
+
+func TestFernetKeyRotation(t *testing.T) {
+	oldKey, newKey := GenerateFernetKey(), GenerateFernetKey()
+	old, _ := NewFernetStore(oldKey)
+	rotating, _ := NewFernetStore(newKey + ", " + oldKey)
+	rotated, _ := NewFernetStore(newKey)
+
+	token, _ := old.Encrypt("secret")
+	if plaintext, err := rotating.Decrypt(token); err != nil || plaintext != "secret" || !rotating.IsStale(token) {
+		t.Errorf("The old token gave %q, %v during rotation", plaintext, err)
+	}
+	if _, err := rotated.Decrypt(token); err != ErrDecrypt {
+		t.Errorf("Got %v after dropping the old key, want ErrDecrypt", err)
+	}
+	if token, _ := rotating.Encrypt("secret"); rotating.IsStale(token) {
+		t.Error("A token made with the new key is stale")
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	store := newTestVaultStore(t)
+	if _, err := store.Decrypt([]byte("vault:v1:unknown")); err == nil || err == ErrDecrypt {
+		t.Errorf("Got %v for a ciphertext Vault can't decrypt, want Vault's error", err)
+	}
+	store.token = "wrong"
+	if _, err := store.Encrypt("secret"); err == nil {
+		t.Error("Encrypted with the wrong Vault token")
+	}
+
+	// Vault answering with something that isn't base64.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"plaintext":"not base64!"}}`))
+	}))
+	defer server.Close()
+	if _, err := NewVaultStore(server.URL, "vault-token", "byodemo").Decrypt([]byte("vault:v1:x")); err != ErrDecrypt {
+		t.Errorf("Got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestKMSErrors(t *testing.T) {
+	store := newTestKMSStore(t)
+	token, err := store.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope kmsEnvelope
+	if err := json.Unmarshal(token, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	tampered := envelope
+	tampered.Ciphertext = append([]byte{}, envelope.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	tamperedToken, _ := json.Marshal(tampered)
+	unknownKey := envelope
+	unknownKey.EncryptedKey = []byte("unknown")
+	unknownKeyToken, _ := json.Marshal(unknownKey)
+
+	tests := []struct {
+		name       string
+		token      []byte
+		errDecrypt bool
+	}{
+		{"not an envelope", []byte("not json"), true},
+		{"changed ciphertext", tamperedToken, true},
+		{"data key KMS doesn't know", unknownKeyToken, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := store.Decrypt(test.token)
+			if err == nil || (err == ErrDecrypt) != test.errDecrypt {
+				t.Errorf("Got %v", err)
+			}
+		})
+	}
+
+	store.keyId = "alias/missing"
+	if _, err := store.Encrypt("secret"); err == nil {
+		t.Error("Encrypted with a key KMS doesn't have")
+	}
+}
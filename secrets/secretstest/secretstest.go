@@ -0,0 +1,129 @@
+// Package secretstest serves stand-ins for the key services the secrets package calls, so stores
+// can be tested without Vault or AWS.
+package secretstest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+type keyService struct {
+	mu sync.Mutex
+	// What each ciphertext handed out decrypts to.
+	plaintexts map[string]string
+}
+
+func newKeyService() *keyService {
+	return &keyService{plaintexts: make(map[string]string)}
+}
+
+func (k *keyService) seal(plaintext string) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ciphertext := base64.StdEncoding.EncodeToString(id)
+	k.plaintexts[ciphertext] = plaintext
+	return ciphertext
+}
+
+func (k *keyService) open(ciphertext string) (plaintext string, ok bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	plaintext, ok = k.plaintexts[ciphertext]
+	return plaintext, ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Serves Vault's transit/encrypt and transit/decrypt endpoints for the transit key named key to
+// requests with the Vault token token. Close the server when done.
+func NewVault(token string, key string) *httptest.Server {
+	k := newKeyService()
+	vaultError := func(w http.ResponseWriter, status int, message string) {
+		writeJSON(w, status, map[string][]string{"errors": {message}})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			vaultError(w, 403, "permission denied")
+			return
+		}
+		var input map[string]string
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&input) != nil {
+			vaultError(w, 400, "invalid request")
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/" + key:
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]string{
+				"ciphertext": "vault:v1:" + k.seal(input["plaintext"])}})
+		case "/v1/transit/decrypt/" + key:
+			plaintext, ok := k.open(strings.TrimPrefix(input["ciphertext"], "vault:v1:"))
+			if !ok {
+				vaultError(w, 400, "invalid ciphertext: unable to decrypt")
+				return
+			}
+			writeJSON(w, 200, map[string]interface{}{"data": map[string]string{"plaintext": plaintext}})
+		default:
+			vaultError(w, 400, "encryption key not found")
+		}
+	}))
+}
+
+// Serves the KMS GenerateDataKey and Decrypt actions for the key keyId to signed requests. Close
+// the server when done.
+func NewKMS(keyId string) *httptest.Server {
+	k := newKeyService()
+	kmsError := func(w http.ResponseWriter, errorType string, message string) {
+		writeJSON(w, 400, map[string]string{"__type": errorType, "message": message})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+			kmsError(w, "MissingAuthenticationTokenException", "Missing Authentication Token")
+			return
+		}
+		var input struct {
+			KeyId          string
+			KeySpec        string
+			CiphertextBlob []byte
+		}
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&input) != nil {
+			kmsError(w, "SerializationException", "Couldn't read the request")
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			if input.KeyId != keyId {
+				kmsError(w, "NotFoundException", "Key '"+input.KeyId+"' does not exist")
+				return
+			}
+			if input.KeySpec != "AES_256" {
+				kmsError(w, "ValidationException", "KeySpec must be AES_256 here")
+				return
+			}
+			dataKey := make([]byte, 32)
+			rand.Read(dataKey)
+			blob := k.seal(base64.StdEncoding.EncodeToString(dataKey))
+			writeJSON(w, 200, map[string]interface{}{"KeyId": keyId, "CiphertextBlob": []byte(blob), "Plaintext": dataKey})
+		case "TrentService.Decrypt":
+			encoded, ok := k.open(string(input.CiphertextBlob))
+			if !ok {
+				kmsError(w, "InvalidCiphertextException", "")
+				return
+			}
+			dataKey, _ := base64.StdEncoding.DecodeString(encoded)
+			writeJSON(w, 200, map[string]interface{}{"KeyId": keyId, "Plaintext": dataKey})
+		default:
+			kmsError(w, "UnknownOperationException", "")
+		}
+	}))
+}
@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const VaultName = "vault"
+
+// Encrypts with a HashiCorp Vault transit key. Vault keeps the key, so only its ciphertext is
+// stored. Works against `vault server -dev` after `vault secrets enable transit` and
+// `vault write -f transit/keys/<key>`. Vault rewraps to new key versions itself with
+// transit/rewrap, so tokens never go stale here.
+type VaultStore struct {
+	addr   string
+	token  string
+	key    string
+	client *http.Client
+}
+
+type vaultResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// addr is Vault's base URL, e.g. http://127.0.0.1:8200, and key the name of the transit key.
+func NewVaultStore(addr string, token string, key string) *VaultStore {
+	return &VaultStore{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *VaultStore) Name() string {
+	return VaultName
+}
+
+func (s *VaultStore) Encrypt(plaintext string) ([]byte, error) {
+	res, err := s.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext))})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(res.Data.Ciphertext), nil
+}
+
+func (s *VaultStore) Decrypt(token []byte) (string, error) {
+	res, err := s.call("decrypt", map[string]string{"ciphertext": string(token)})
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(res.Data.Plaintext)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+func (s *VaultStore) IsStale(token []byte) bool {
+	return false
+}
+
+func (s *VaultStore) call(operation string, input map[string]string) (res vaultResponse, err error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return res, err
+	}
+	req, err := http.NewRequest("POST", s.addr+"/v1/transit/"+operation+"/"+s.key, bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+	httpRes, err := s.client.Do(req)
+	if err != nil {
+		logger.Print("Error calling Vault ", operation, ": ", err)
+		return res, err
+	}
+	defer httpRes.Body.Close()
+	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil && httpRes.StatusCode == http.StatusOK {
+		return res, err
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		logger.Print("Vault ", operation, " failed with ", httpRes.Status, ": ", res.Errors)
+		return res, errors.New("Vault " + operation + " failed: " + httpRes.Status + " " + strings.Join(res.Errors, ", "))
+	}
+	return res, nil
+}
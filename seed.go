@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// Objects from another resource's bucket that a new resource should start out with.
+// Requested with --opt copy_from=<add-on name or id> and optionally --opt copy_prefix=<prefix>.
+type seedSource struct {
+	resource database.AddonResource
+	prefix   string
+	objects  bucket.ObjectList
+}
+
+// Resolves and measures the copy_from source before anything is created, so a bad source or one
+// over the size limit fails provisioning early. A copy that fails later is cleaned up by
+// finishProvisioning. Returns nil if copy_from wasn't given.
+func findSeedSource(c *heroku.Client, bc bucket.BucketController, resource *database.AddonResource, options map[string]string) (*seedSource, error) {
+	copyFrom, ok := options["copy_from"]
+	if !ok {
+		return nil, nil
+	}
+	// Copying into a bucket the team already has would mix objects into its data, and removing
+	// them again after a failed copy isn't possible without deleting the team's own.
+	if _, adopt := options["adopt"]; adopt {
+		return nil, errors.New("copy_from can't be combined with adopt")
+	}
+	addon, err := c.AddonInfo(copyFrom)
+	if err != nil || addon.Id == "" {
+		return nil, errors.New("Add-on " + copyFrom + " not found")
+	}
+	source, err := db.FindAddonResource(addon.Id)
+	if err != nil {
+		return nil, errors.New("Add-on " + copyFrom + " is not a bucket from this add-on")
+	}
+	// Report other teams' resources as not found rather than confirming they exist.
+	if source.OwnerId != resource.OwnerId {
+		return nil, errors.New("Add-on " + copyFrom + " not found")
+	}
+	// The copy runs with the new resource's credentials, which can't read another account's buckets.
+	if source.AccountId != resource.AccountId {
+		return nil, errors.New("Add-on " + copyFrom + " uses a different AWS account. Choose the same one with --opt account=<alias>")
+	}
+	seed := &seedSource{resource: source, prefix: source.BucketPrefix + options["copy_prefix"]}
+	seed.objects, err = bc.ListObjects(resourceBucketName(source.ProviderId, source.BucketName), seed.prefix)
+	if err != nil {
+		return nil, err
+	}
+	if seed.objects.TotalBytes > config.copyMaxBytes {
+		return nil, errors.New("Add-on " + copyFrom + " has " + formatBytes(seed.objects.TotalBytes) +
+			" to copy, more than the limit of " + formatBytes(config.copyMaxBytes) + ". Use copy_prefix to copy less.")
+	}
+	return seed, nil
+}
+
+// Copies the seed objects into the newly provisioned resource, logging progress as it goes.
+func seedBucket(bc bucket.BucketController, seed *seedSource, resource *database.AddonResource) error {
+	total := len(seed.objects.Objects)
+	logger.Print("Provisioning ", resource.AddonId, ": copying ", total, " objects (",
+		formatBytes(seed.objects.TotalBytes), ") from add-on ", seed.resource.AddonId)
+	return bc.CopyObjects(seed.objects,
+		resourceBucketName(seed.resource.ProviderId, seed.resource.BucketName), seed.resource.BucketPrefix,
+		resource.BucketName, resource.BucketPrefix,
+		func(copied int, copiedBytes int64) {
+			if copied%100 == 0 || copied == total {
+				logger.Print("Provisioning ", resource.AddonId, ": copied ", copied, "/", total, " objects (",
+					formatBytes(copiedBytes), ")")
+			}
+		})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+)
+
+func TestSeedSourceOptions(t *testing.T) {
+	useMemoryStore(t)
+	resource := &database.AddonResource{OwnerId: "team", ProviderId: "p1", AddonId: "a1"}
+
+	// Neither Heroku nor AWS is asked about anything in these cases.
+	if seed, err := findSeedSource(nil, bucket.BucketController{}, resource, map[string]string{}); seed != nil || err != nil {
+		t.Errorf("Without copy_from got %+v, %v", seed, err)
+	}
+	options := map[string]string{"copy_from": "fixtures", "adopt": "existing"}
+	if _, err := findSeedSource(nil, bucket.BucketController{}, resource, options); err == nil {
+		t.Error("Seeding an adopted bucket was allowed")
+	}
+}
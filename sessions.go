@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+	"github.com/jesperfj/byodemo/heroku/hgin"
+)
+
+// Keeps the sessions of signed in users in the database, with their tokens encrypted.
+type userSessions struct{}
+
+func (userSessions) SaveSession(session *hgin.Session) error {
+	return db.SaveUserSession(&database.UserSession{
+		IdHash:       session.IdHash,
+		UserId:       session.UserId,
+		Email:        session.Email,
+		Name:         session.Name,
+		AccessToken:  session.Authorization.AccessToken,
+		RefreshToken: session.Authorization.RefreshToken,
+		ExpiresAt:    session.Authorization.ExpiresAt,
+		CreatedAt:    session.CreatedAt,
+		LastSeenAt:   session.LastSeenAt,
+	})
+}
+
+func (userSessions) FindSession(idHash string) (session hgin.Session, found bool, err error) {
+	s, found, err := db.FindUserSession(idHash)
+	if !found || err != nil {
+		return session, found, err
+	}
+	return hgin.Session{
+		IdHash: s.IdHash,
+		UserId: s.UserId,
+		Email:  s.Email,
+		Name:   s.Name,
+		Authorization: heroku.Authorization{
+			AccessToken:  s.AccessToken,
+			RefreshToken: s.RefreshToken,
+			ExpiresAt:    s.ExpiresAt,
+		},
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+	}, true, nil
+}
+
+func (userSessions) UpdateSessionAuthorization(idHash string, auth *heroku.Authorization) error {
+	return db.UpdateUserSessionTokens(idHash, auth.AccessToken, auth.RefreshToken, auth.ExpiresAt)
+}
+
+func (userSessions) TouchSession(idHash string, lastSeenAt time.Time) error {
+	return db.TouchUserSession(idHash, lastSeenAt)
+}
+
+func (userSessions) DeleteSession(idHash string) error {
+	return db.DeleteUserSession(idHash)
+}
+
+func (userSessions) DeleteExpiredSessions(lastSeenBefore time.Time, createdBefore time.Time) error {
+	deleted, err := db.DeleteExpiredUserSessions(lastSeenBefore, createdBefore)
+	if deleted > 0 {
+		logger.Print("Deleted ", deleted, " expired sessions")
+	}
+	return err
+}
+
+func managementSessions() *hgin.Sessions {
+	return &hgin.Sessions{Store: userSessions{}, IdleTimeout: config.sessionIdleTimeout, MaxAge: config.sessionMaxAge}
+}
+
+// The email of the signed in user, for the audit trail.
+func currentUserEmail(c *gin.Context) string {
+	if email := hgin.CurrentSession(c).Email; email != "" {
+		return email
+	}
+	return "unknown"
+}
+
+// Renders a management page. Every page shows who is signed in, and forms need the CSRF token.
+func renderManagePage(c *gin.Context, status int, name string, data gin.H) {
+	data["user"] = hgin.CurrentSession(c)
+	data["csrfToken"] = hgin.CSRFToken(c)
+	c.HTML(status, name, data)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+	"github.com/jesperfj/byodemo/heroku/hgin"
+)
+
+const settingsHistoryLength = 20
+
+// Where a resource's settings pages are served from. On the management pages only team admins may
+// change settings. Developers who signed on to the resource from Heroku may change its settings
+// from its dashboard.
+type settingsPage struct {
+	// The HTML page. Forms post to <path>/<setting>.
+	path string
+	// Nil on the dashboard.
+	org   *heroku.Team
+	actor string
+}
+
+func (p settingsPage) canEdit() bool {
+	return p.org == nil || p.org.Role == "admin"
+}
+
+// Turns the request away if the user may only look at the settings.
+func (p settingsPage) requireEditor(c *gin.Context) (failed bool) {
+	return p.org != nil && requireOrgAdmin(c, p.org)
+}
+
+// Looks up the resource whose settings are asked for, with a controller for its account.
+type findSettingsResource func(c *gin.Context) (page settingsPage, addon database.AddonResource, bc bucket.BucketController, failed bool)
+
+// Bucket settings would apply to every app sharing the bucket.
+func checkOwnBucket(c *gin.Context, addon database.AddonResource) (failed bool) {
+	if addon.BucketPrefix != "" {
+		c.String(400, "Resources on the "+sharedPlan+" plan share their team's bucket and have no settings of their own.")
+		return true
+	}
+	return false
+}
+
+// Looks up the resource in the URL and makes sure it belongs to the org. Resources in other orgs
+// are reported as not found.
+func getAndValidateResource(c *gin.Context, org *heroku.Team) (addon database.AddonResource, bc bucket.BucketController, failed bool) {
+	account, addon, err := db.FindAccountForAddon(c.Param("resource_id"))
+	if err != nil || addon.OwnerId != org.Id {
+		c.String(404, "Not found.")
+		return addon, bc, true
+	}
+	if checkOwnBucket(c, addon) {
+		return addon, bc, true
+	}
+	bc, err = bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
+	if err != nil {
+		c.String(500, "Error initializing bucket controller: "+err.Error())
+		return addon, bc, true
+	}
+	return addon, bc, false
+}
+
+func findManagedSettings(c *gin.Context) (page settingsPage, addon database.AddonResource, bc bucket.BucketController, failed bool) {
+	org, failed := getAndValidateOrg(c)
+	if failed {
+		return page, addon, bc, true
+	}
+	addon, bc, failed = getAndValidateResource(c, org)
+	page = settingsPage{
+		path:  "/manage/orgs/" + org.Id + "/resources/" + addon.ProviderId + "/settings",
+		org:   org,
+		actor: currentUserEmail(c),
+	}
+	return page, addon, bc, failed
+}
+
+func findDashboardSettings(c *gin.Context) (page settingsPage, addon database.AddonResource, bc bucket.BucketController, failed bool) {
+	addon, bc, failed = getDashboardResource(c)
+	if failed || checkOwnBucket(c, addon) {
+		return page, addon, bc, true
+	}
+	page = settingsPage{path: "/dashboard/" + c.Param("addon_id") + "/settings", actor: hgin.CurrentSSOSession(c).Email}
+	if page.actor == "" {
+		page.actor = "unknown"
+	}
+	return page, addon, bc, false
+}
+
+// Decodes, validates and applies one of the bucket settings, then records the change. The returned
+// status is meant for the HTTP response when err is not nil.
+func updateSetting(actor string, addon database.AddonResource, bc bucket.BucketController, setting string, raw []byte) (status int, err error) {
+	bucketName := resourceBucketName(addon.ProviderId, addon.BucketName)
+	var doc interface{}
+	var apply func() error
+	switch setting {
+	case "cors":
+		rules := make([]bucket.CORSRule, 0)
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return 400, errors.New("CORS rules must be a JSON list: " + err.Error())
+		}
+		if err := bucket.ValidateCORS(rules); err != nil {
+			return 400, err
+		}
+		doc, apply = rules, func() error { return bc.PutCORS(bucketName, rules) }
+	case "lifecycle":
+		rules := make([]bucket.LifecycleRule, 0)
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return 400, errors.New("Lifecycle rules must be a JSON list: " + err.Error())
+		}
+		if err := bucket.ValidateLifecycle(rules); err != nil {
+			return 400, err
+		}
+		doc, apply = rules, func() error { return bc.PutLifecycle(bucketName, rules) }
+	case "website":
+		website := bucket.Website{}
+		if err := json.Unmarshal(raw, &website); err != nil {
+			return 400, errors.New("Website settings must be a JSON object: " + err.Error())
+		}
+		if err := bucket.ValidateWebsite(website); err != nil {
+			return 400, err
+		}
+		doc, apply = website, func() error { return bc.PutWebsite(bucketName, website) }
+	default:
+		return 404, errors.New("Unknown setting " + setting)
+	}
+
+	if err := apply(); err != nil {
+		if _, ok := err.(*bucket.UnsupportedLifecycleError); ok {
+			return 409, err
+		}
+		return 502, errors.New("AWS rejected the change: " + err.Error())
+	}
+
+	document, _ := json.Marshal(doc)
+	err = db.SaveSettingsChange(&database.SettingsChange{
+		ProviderId: addon.ProviderId,
+		Actor:      actor,
+		Setting:    setting,
+		Document:   string(document),
+	})
+	if err != nil {
+		// The bucket has already changed, so don't report a failure to the user.
+		logger.Print("Settings for ", addon.ProviderId, " changed but the change was not recorded: ", err)
+	}
+	return 200, nil
+}
+
+func renderSettings(c *gin.Context, status int, page settingsPage, addon database.AddonResource, bc bucket.BucketController, message string) {
+	settings, err := bc.GetSettings(resourceBucketName(addon.ProviderId, addon.BucketName))
+	if err != nil {
+		c.String(502, "Error reading bucket settings: "+err.Error())
+		return
+	}
+	if settings.CORS == nil {
+		settings.CORS = make([]bucket.CORSRule, 0)
+	}
+	if settings.Lifecycle == nil {
+		settings.Lifecycle = make([]bucket.LifecycleRule, 0)
+	}
+	cors, _ := json.MarshalIndent(settings.CORS, "", "  ")
+	lifecycle, _ := json.MarshalIndent(settings.Lifecycle, "", "  ")
+	changes, err := db.FindSettingsChanges(addon.ProviderId, settingsHistoryLength)
+	if err != nil {
+		logger.Print("Error finding settings changes: ", err)
+	}
+	data := gin.H{
+		"org":       page.org,
+		"path":      page.path,
+		"canEdit":   page.canEdit(),
+		"addon":     addon,
+		"bucket":    resourceBucketName(addon.ProviderId, addon.BucketName),
+		"cors":      string(cors),
+		"lifecycle": string(lifecycle),
+		// Rules the page can't show in full are read-only.
+		"lifecycleUnsupported": settings.LifecycleUnsupported,
+		"website":              settings.Website,
+		"changes":              changes,
+		"message":              message,
+	}
+	if page.org != nil {
+		renderManagePage(c, status, "settings.tmpl.html", data)
+		return
+	}
+	data["csrfToken"] = hgin.CSRFToken(c)
+	c.HTML(status, "settings.tmpl.html", data)
+}
+
+func setupSettingsRoutes(manage *gin.RouterGroup) {
+	addSettingsRoutes(manage.Group("/orgs/:org_id/resources/:resource_id"),
+		manage.Group("/api/orgs/:org_id/resources/:resource_id"), findManagedSettings)
+}
+
+// The settings page under pages, and a JSON API for the same settings, for scripting, under api.
+func addSettingsRoutes(pages *gin.RouterGroup, api *gin.RouterGroup, find findSettingsResource) {
+
+	pages.GET("/settings", func(c *gin.Context) {
+		page, addon, bc, failed := find(c)
+		if failed {
+			return
+		}
+		renderSettings(c, http.StatusOK, page, addon, bc, "")
+	})
+
+	pages.POST("/settings/:setting", func(c *gin.Context) {
+		page, addon, bc, failed := find(c)
+		if failed || page.requireEditor(c) {
+			return
+		}
+		raw := []byte(c.PostForm("document"))
+		if c.Param("setting") == "website" {
+			raw, _ = json.Marshal(bucket.Website{
+				Enabled:       c.PostForm("enabled") == "on",
+				IndexDocument: c.PostForm("indexDocument"),
+				ErrorDocument: c.PostForm("errorDocument"),
+			})
+		}
+		status, err := updateSetting(page.actor, addon, bc, c.Param("setting"), raw)
+		if err != nil {
+			renderSettings(c, status, page, addon, bc, err.Error())
+			return
+		}
+		c.Redirect(302, page.path)
+	})
+
+	api.GET("/settings", func(c *gin.Context) {
+		_, addon, bc, failed := find(c)
+		if failed {
+			return
+		}
+		settings, err := bc.GetSettings(resourceBucketName(addon.ProviderId, addon.BucketName))
+		if err != nil {
+			c.JSON(502, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, settings)
+	})
+
+	api.PUT("/settings/:setting", func(c *gin.Context) {
+		page, addon, bc, failed := find(c)
+		if failed || page.requireEditor(c) {
+			return
+		}
+		raw, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		status, err := updateSetting(page.actor, addon, bc, c.Param("setting"), raw)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"message": c.Param("setting") + " updated"})
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+)
+
+// One of newOwner's linked accounts for the same AWS account as account, default first.
+func findAccountInSameAWSAccount(newOwner string, account database.Account) (target database.Account, err error) {
+	accounts, err := db.FindAccounts([]string{newOwner})
+	if err != nil {
+		return target, err
+	}
+	from, err := awsAccountId(account)
+	if err != nil {
+		return target, err
+	}
+	for _, a := range accounts[newOwner] {
+		if to, err := awsAccountId(a); err == nil && to == from {
+			return a, nil
+		}
+	}
+	return target, errors.New("The new team hasn't linked the AWS account the bucket is in")
+}
+
+// Deals with the resource's app having moved to newOwner, as the resource's current team has
+// chosen. The resource follows the app only if its bucket can stay where it is: the bucket is the
+// resource's own and the new team has linked the same AWS account. Otherwise the resource stays
+// and is flagged. Returns whether the resource moved.
+func transferResource(account database.Account, resource *database.AddonResource, newOwner string) bool {
+	policy, err := db.FindTeamPolicy(resource.OwnerId)
+	if err != nil {
+		logger.Print("Couldn't find app transfer policy of ", resource.OwnerId, ". Flagging ", resource.ProviderId, ": ", err)
+	}
+	reason := errors.New("App " + resource.AppName + " moved to another team. The add-on stays with this team's AWS account")
+	if err == nil && policy.AppTransfer == database.AppTransferMigrate {
+		if resource.Adopted || resource.BucketPrefix != "" {
+			reason = errors.New(reason.Error() + " because its bucket belongs to the team")
+		} else if target, err := findAccountInSameAWSAccount(newOwner, account); err != nil {
+			reason = errors.New(reason.Error() + ": " + err.Error())
+		} else {
+			err := db.MoveResource(resource.ProviderId, newOwner, target.Id)
+			recordAudit(platformActor, resource.OwnerId, resource.ProviderId, auditAppTransfer, err)
+			recordAudit(platformActor, newOwner, resource.ProviderId, auditAppTransfer, err)
+			if err == nil {
+				logger.Print("Moved ", resource.ProviderId, " from ", resource.OwnerId, " to ", newOwner, " with its app")
+				resource.OwnerId, resource.AccountId, resource.MovedToOwnerId = newOwner, target.Id, ""
+				return true
+			}
+			return false
+		}
+	}
+	logger.Print("Flagging ", resource.ProviderId, ": ", reason)
+	if err := db.FlagResourceMoved(resource.ProviderId, newOwner); err != nil {
+		reason = err
+	}
+	// Recorded as a failure so the team's admins find it among the things to look at.
+	recordAudit(platformActor, resource.OwnerId, resource.ProviderId, auditAppTransfer, reason)
+	resource.MovedToOwnerId = newOwner
+	return false
+}
+
+func setupTransferRoutes(manage *gin.RouterGroup) {
+
+	manage.POST("/orgs/:org_id/policy", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		policy := &database.TeamPolicy{OwnerId: org.Id, AppTransfer: c.PostForm("appTransfer")}
+		if policy.AppTransfer != database.AppTransferFlag && policy.AppTransfer != database.AppTransferMigrate {
+			c.String(400, "appTransfer must be "+database.AppTransferFlag+" or "+database.AppTransferMigrate)
+			return
+		}
+		if err := db.SaveTeamPolicy(policy); err != nil {
+			c.String(500, "Error saving policy: "+err.Error())
+			return
+		}
+		c.Redirect(302, "/manage/orgs/"+org.Id+"/usage")
+	})
+}
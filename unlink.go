@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+// What happens to the resources still using an account when it's unlinked.
+const (
+	unlinkTransfer    = "transfer"
+	unlinkDeprovision = "deprovision"
+	unlinkDetach      = "detach"
+)
+
+func renderUnlink(c *gin.Context, status int, org *heroku.Team, account database.Account, message string) {
+	resources, err := db.FindAccountResources(account.Id)
+	if err != nil {
+		c.String(500, "Error finding resources: "+err.Error())
+		return
+	}
+	accounts, err := db.FindAccounts([]string{org.Id})
+	if err != nil {
+		c.String(500, "Error finding linked accounts: "+err.Error())
+		return
+	}
+	others := make([]database.Account, 0)
+	for _, a := range accounts[org.Id] {
+		if a.Id != account.Id {
+			others = append(others, a)
+		}
+	}
+	renderManagePage(c, status, "unlink.tmpl.html", gin.H{
+		"org":       org,
+		"account":   account,
+		"resources": resources,
+		"others":    others,
+		"message":   message,
+	})
+}
+
+// Asks Heroku to remove the resource's add-on from its app, with the grant it was provisioned
+// with. An add-on Heroku no longer has is deprovisioned here instead.
+func destroyAddon(resource database.AddonResource) error {
+	c, err := addonClient(resource.ProviderId)
+	if err != nil {
+		return err
+	}
+	if resource.AppId == "" {
+		return errors.New("The app of resource " + resource.ProviderId + " isn't known")
+	}
+	err = c.DeleteAddon(resource.AppId, resource.AddonId)
+	if heroku.IsStatus(err, http.StatusNotFound) {
+		if err := db.MarkResourceForDeletion(resource.ProviderId); err != nil {
+			return err
+		}
+		go deleteResource(resource.ProviderId)
+		return nil
+	}
+	return err
+}
+
+// Unlinks the account, first dealing with the resources still using it as mode says. Refuses if
+// there are resources and no mode was chosen. The returned status is meant for the HTTP response
+// when err is not nil.
+func unlinkAccount(org *heroku.Team, account database.Account, mode string, transferTo string) (status int, err error) {
+	resources, err := db.FindAccountResources(account.Id)
+	if err != nil {
+		return 500, err
+	}
+	if len(resources) == 0 {
+		return 500, db.DeleteAccount(org.Id, account.Id)
+	}
+
+	switch mode {
+	case unlinkTransfer:
+		id, _ := strconv.ParseInt(transferTo, 10, 64)
+		target, err := db.FindAccount(org.Id, id)
+		if err != nil || target.Id == account.Id {
+			return 400, errors.New("Choose another of the team's linked accounts to transfer the add-ons to")
+		}
+		// The buckets stay where they are, so the target must be able to reach them.
+		from, err := awsAccountId(account)
+		if err != nil {
+			return 400, errors.New("Couldn't check which AWS account " + account.Alias + " belongs to: " + err.Error())
+		}
+		to, err := awsAccountId(target)
+		if err != nil {
+			return 400, errors.New("Couldn't check which AWS account " + target.Alias + " belongs to: " + err.Error())
+		}
+		if from != to {
+			return 400, errors.New(target.Alias + " is in a different AWS account. Add-ons can only be transferred " +
+				"to credentials for the same AWS account.")
+		}
+		if err := db.TransferAccountResources(org.Id, account.Id, target.Id); err != nil {
+			return 500, err
+		}
+		return 500, db.DeleteAccount(org.Id, account.Id)
+	case unlinkDeprovision:
+		// Heroku deprovisions each add-on through the add-on API, which deletes its AWS resources.
+		// The detached account is deleted after the last one.
+		if err := db.DetachAccount(org.Id, account.Id); err != nil {
+			return 500, err
+		}
+		var remaining []string
+		for _, r := range resources {
+			if err := destroyAddon(r); err != nil {
+				logger.Print("Couldn't remove add-on ", r.AddonId, " of ", r.ProviderId, " from Heroku: ", err)
+				remaining = append(remaining, r.AppName)
+			}
+		}
+		if len(remaining) > 0 {
+			return 502, errors.New("The account was detached, but Heroku couldn't remove the add-ons of " +
+				strings.Join(remaining, ", ") + ". Remove them with heroku addons:destroy. The account is deleted " +
+				"after the last one.")
+		}
+		return 200, nil
+	case unlinkDetach:
+		return 500, db.DetachAccount(org.Id, account.Id)
+	}
+	return 400, errors.New(strconv.Itoa(len(resources)) + " add-ons still use this account. Choose what happens to them.")
+}
+
+func setupUnlinkRoutes(manage *gin.RouterGroup) {
+
+	manage.GET("/orgs/:org_id/accounts/:account_id/unlink", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		account, failed := getAndValidateAccount(c, org)
+		if failed {
+			return
+		}
+		renderUnlink(c, http.StatusOK, org, account, "")
+	})
+
+	manage.POST("/orgs/:org_id/accounts/:account_id/unlink", func(c *gin.Context) {
+		org, failed := getAndValidateOrg(c)
+		if failed || requireOrgAdmin(c, org) {
+			return
+		}
+		account, failed := getAndValidateAccount(c, org)
+		if failed {
+			return
+		}
+		status, err := unlinkAccount(org, account, c.PostForm("mode"), c.PostForm("transferTo"))
+		recordAudit(currentUserEmail(c), org.Id, "", auditUnlink, err)
+		if err != nil {
+			logger.Print("Error unlinking account: ", err.Error())
+			renderUnlink(c, status, org, account, "Error unlinking account: "+err.Error())
+			return
+		}
+		c.Redirect(302, "/manage/orgs/")
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+)
+
+// used to render the per team usage page
+type AppUsage struct {
+	AppName    string
+	AddonId    string
+	ProviderId string
+	Shared     bool
+	// The app moved to another team and the resource stayed.
+	MovedAway   bool
+	ObjectCount int64
+	Size        string
+	CollectedAt string
+}
+
+// How often each process checks whether usage is due.
+const usageClaimCheck = 10 * time.Minute
+
+// Runs forever, collecting usage for every active resource once per interval. Every web dyno
+// runs this, and the one that claims a run in the database collects it.
+func collectUsage(interval time.Duration) {
+	check := usageClaimCheck
+	if interval < check {
+		check = interval
+	}
+	for {
+		claimed, err := db.ClaimUsageCollection(time.Now().UTC(), interval)
+		if err != nil {
+			logger.Print("Usage collection skipped. Error claiming it: ", err)
+		}
+		if claimed {
+			collectUsageOnce()
+		}
+		time.Sleep(check)
+	}
+}
+
+func collectUsageOnce() {
+	resources, err := db.FindActiveAddonResources()
+	if err != nil {
+		logger.Print("Usage collection skipped. Error finding resources: ", err)
+		return
+	}
+	logger.Print("Collecting usage for ", len(resources), " resources")
+	for _, r := range resources {
+		account, _, err := db.FindAccountForAddon(r.ProviderId)
+		if err != nil {
+			logger.Print("Skipping usage for ", r.ProviderId, ". Error finding account: ", err)
+			continue
+		}
+		bc, err := bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
+		if err != nil {
+			logger.Print("Skipping usage for ", r.ProviderId, ". Error initializing bucket controller: ", err)
+			continue
+		}
+		usage, err := bc.Usage(resourceBucketName(r.ProviderId, r.BucketName), r.BucketPrefix)
+		if err != nil {
+			logger.Print("Skipping usage for ", r.ProviderId, ": ", err)
+			continue
+		}
+		err = db.SaveBucketUsage(&database.BucketUsage{
+			ProviderId:  r.ProviderId,
+			ObjectCount: usage.ObjectCount,
+			TotalBytes:  usage.TotalBytes,
+			CollectedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			logger.Print("Usage for ", r.ProviderId, " collected but not saved: ", err)
+		}
+	}
+}
+
+func findAppUsage(orgId string) (apps []*AppUsage, total int64, err error) {
+	usage, err := db.FindLatestUsage([]string{orgId})
+	if err != nil {
+		return nil, 0, err
+	}
+	apps = make([]*AppUsage, len(usage))
+	for i, u := range usage {
+		total += u.TotalBytes
+		apps[i] = &AppUsage{
+			AppName:     appLabel(u),
+			AddonId:     u.AddonId,
+			ProviderId:  u.ProviderId,
+			Shared:      u.BucketPrefix != "",
+			MovedAway:   u.MovedToOwnerId != "",
+			ObjectCount: u.ObjectCount,
+			Size:        formatBytes(u.TotalBytes),
+			CollectedAt: "not measured yet",
+		}
+		if !u.CollectedAt.IsZero() {
+			apps[i].CollectedAt = u.CollectedAt.Format(time.RFC822)
+		}
+	}
+	return apps, total, nil
+}
+
+// Resources provisioned before app names were recorded only have an add-on id.
+func appLabel(u database.ResourceUsage) string {
+	if u.AppName != "" {
+		return u.AppName
+	}
+	return "(add-on " + u.AddonId + ")"
+}
+
+func writeUsageCSV(c *gin.Context, orgName string, usage []database.ResourceUsage) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=\"usage-"+orgName+".csv\"")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"team", "app_id", "app_name", "addon_id", "bucket", "prefix", "collected_at", "object_count", "total_bytes"})
+	for _, u := range usage {
+		w.Write([]string{
+			orgName,
+			u.AppId,
+			u.AppName,
+			u.AddonId,
+			resourceBucketName(u.ProviderId, u.BucketName),
+			u.BucketPrefix,
+			u.CollectedAt.Format(time.RFC3339),
+			strconv.FormatInt(u.ObjectCount, 10),
+			strconv.FormatInt(u.TotalBytes, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logger.Print("Error writing usage CSV: ", err)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
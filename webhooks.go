@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/bucket"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+const (
+	addonWebhooksPath = "/addon/heroku/webhooks"
+	// App events are small. Anything bigger isn't from Heroku.
+	maxWebhookBytes = 1 << 20
+)
+
+// Each resource's webhook gets its own secret, derived from HEROKU_WEBHOOK_SECRET so it doesn't
+// have to be stored.
+func webhookSecret(providerId string) string {
+	mac := hmac.New(sha256.New, []byte(config.webhookSecret))
+	mac.Write([]byte(providerId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Asks Heroku to tell the add-on when the resource's app is renamed, moves to another team or is
+// deleted. Does nothing unless HEROKU_WEBHOOK_SECRET is set.
+func subscribeAppWebhook(c *heroku.Client, resource *database.AddonResource) error {
+	if config.webhookSecret == "" {
+		return nil
+	}
+	_, err := c.CreateAddonWebhook(resource.AddonId, heroku.AddonWebhookRequest{
+		Include: []string{"api:app"},
+		Level:   "notify",
+		Secret:  webhookSecret(resource.ProviderId),
+		URL:     config.addonURL + addonWebhooksPath + "/" + resource.ProviderId,
+	})
+	if err != nil {
+		logger.Print("Couldn't subscribe to app webhooks for ", resource.ProviderId, ": ", err)
+	}
+	return err
+}
+
+// Tags a bucket of the resource's own with its app and owner, so they show up in AWS billing.
+// Adopted and shared buckets belong to the team and keep their tags.
+func tagResourceBucket(bc bucket.BucketController, resource *database.AddonResource) {
+	if resource.Adopted || resource.BucketPrefix != "" {
+		return
+	}
+	err := bc.PutTags(resourceBucketName(resource.ProviderId, resource.BucketName), map[string]string{
+		"heroku-app":    resource.AppName,
+		"heroku-app-id": resource.AppId,
+		"heroku-owner":  resource.OwnerId,
+	})
+	if err != nil {
+		logger.Print("Couldn't tag bucket of ", resource.ProviderId, ": ", err)
+	}
+}
+
+// Brings the resource up to date with its app after an api:app event.
+func handleAppEvent(account database.Account, resource database.AddonResource, event heroku.AppWebhookEvent) {
+	if resource.MarkedForDeletion {
+		return
+	}
+	switch event.Action {
+	case "update":
+		changed := false
+		if event.Data.Name != "" && event.Data.Name != resource.AppName {
+			err := db.SetAppName(resource.ProviderId, event.Data.Name)
+			recordAudit(platformActor, resource.OwnerId, resource.ProviderId, auditAppRename, err)
+			resource.AppName, changed = event.Data.Name, err == nil
+		}
+		owner := event.Data.Owner.Id
+		if owner != "" && owner != resource.OwnerId && owner != resource.MovedToOwnerId {
+			changed = transferResource(account, &resource, owner) || changed
+		} else if owner == resource.OwnerId && resource.MovedToOwnerId != "" {
+			// The app came back.
+			err := db.FlagResourceMoved(resource.ProviderId, "")
+			recordAudit(platformActor, resource.OwnerId, resource.ProviderId, auditAppTransfer, err)
+		}
+		if !changed {
+			return
+		}
+		bc, err := bucket.NewController("us-east-1", account.AWSAccessKeyId, account.AWSSecretAccessKey)
+		if err != nil {
+			logger.Print("Couldn't retag bucket of ", resource.ProviderId, ": ", err)
+			return
+		}
+		tagResourceBucket(bc, &resource)
+	case "destroy":
+		// Heroku deprovisions the app's add-ons on its own. Just let the team know why.
+		logger.Print("App ", event.Data.Name, " of resource ", resource.ProviderId, " was deleted")
+		recordAudit(platformActor, resource.OwnerId, resource.ProviderId, auditAppDelete, nil)
+	}
+}
+
+func setupWebhookRoutes(router *gin.Engine) {
+
+	// Heroku signs deliveries instead of using the add-on API's basic auth.
+	router.POST(addonWebhooksPath+"/:provider_id", func(c *gin.Context) {
+		providerId := c.Param("provider_id")
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBytes))
+		if err != nil {
+			c.String(400, "Error reading body: "+err.Error())
+			return
+		}
+		if config.webhookSecret == "" ||
+			!heroku.VerifyWebhook(webhookSecret(providerId), body, c.Request.Header.Get(heroku.WebhookSignatureHeader)) {
+			logger.Print("Rejected webhook delivery for ", providerId, " with a bad signature")
+			c.String(401, "Bad signature")
+			return
+		}
+		event := heroku.AppWebhookEvent{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			c.String(400, "Bad event: "+err.Error())
+			return
+		}
+		account, resource, err := db.FindAccountForAddon(providerId)
+		if err != nil {
+			// Deliveries for deleted resources are expected until Heroku removes the webhook.
+			c.String(200, "")
+			return
+		}
+		c.String(200, "")
+		if event.Resource == "app" {
+			go handleAppEvent(account, resource, event)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jesperfj/byodemo/database"
+	"github.com/jesperfj/byodemo/heroku"
+)
+
+func TestWebhookSignatures(t *testing.T) {
+	useMemoryStore(t)
+	config.webhookSecret = "webhook-secret"
+	defer func() { config.webhookSecret = "" }()
+	router := gin.New()
+	setupWebhookRoutes(router)
+	// An unknown resource, so the event isn't acted on.
+	body, _ := json.Marshal(heroku.AppWebhookEvent{Action: "update", Resource: "app", Data: heroku.App{Name: "app"}})
+	path := addonWebhooksPath + "/p1"
+
+	tests := []struct {
+		name      string
+		signature string
+		status    int
+	}{
+		{"unsigned", "", 401},
+		{"signed for another resource", heroku.WebhookSignature(webhookSecret("p2"), body), 401},
+		{"signed with the shared secret", heroku.WebhookSignature(config.webhookSecret, body), 401},
+		{"signed for the resource", heroku.WebhookSignature(webhookSecret("p1"), body), 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{heroku.WebhookSignatureHeader: {test.signature}}
+			if w := serve(router, "POST", path, body, header); w.Code != test.status {
+				t.Errorf("Status is %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+// Saves a resource with a bucket of its own and its account for team.
+func saveTransferResource(t *testing.T, resource database.AddonResource) (database.Account, database.AddonResource) {
+	t.Helper()
+	account := database.Account{OwnerId: "team", Alias: "prod", AWSAccessKeyId: "AKIA", AWSSecretAccessKey: "secret"}
+	if err := db.SaveAccount(&account); err != nil {
+		t.Fatal(err)
+	}
+	resource.OwnerId, resource.ProviderId, resource.AddonId, resource.AppName = "team", "p1", "a1", "app"
+	resource.AccountId = account.Id
+	if err := db.SaveAddonResource(&resource); err != nil {
+		t.Fatal(err)
+	}
+	return account, resource
+}
+
+func TestTransferResourceIsFlagged(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		resource database.AddonResource
+	}{
+		{"flag policy", database.AppTransferFlag, database.AddonResource{BucketName: "b1"}},
+		{"adopted bucket", database.AppTransferMigrate, database.AddonResource{BucketName: "b1", Adopted: true}},
+		{"shared bucket", database.AppTransferMigrate, database.AddonResource{BucketName: "shared", BucketPrefix: "p1/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useMemoryStore(t)
+			account, resource := saveTransferResource(t, test.resource)
+			db.SaveTeamPolicy(&database.TeamPolicy{OwnerId: "team", AppTransfer: test.policy})
+
+			if transferResource(account, &resource, "new-team") {
+				t.Error("The resource moved")
+			}
+			saved, _ := db.FindAddonResource("a1")
+			if saved.OwnerId != "team" || saved.MovedToOwnerId != "new-team" || resource.MovedToOwnerId != "new-team" {
+				t.Errorf("Resource is %+v after the transfer", saved)
+			}
+			events := findAudit(t, database.AuditFilter{OwnerId: "team", Action: auditAppTransfer})
+			if len(events) != 1 || events[0].Outcome != database.AuditFailure || events[0].Actor != platformActor {
+				t.Errorf("Audit events are %+v", events)
+			}
+		})
+	}
+}
+
+func TestAppEventReturningAppClearsFlag(t *testing.T) {
+	useMemoryStore(t)
+	account, resource := saveTransferResource(t, database.AddonResource{BucketName: "b1"})
+	db.FlagResourceMoved(resource.ProviderId, "new-team")
+	resource, _ = db.FindAddonResource("a1")
+
+	// Same name, back with its team: nothing to retag.
+	handleAppEvent(account, resource, heroku.AppWebhookEvent{Action: "update", Resource: "app",
+		Data: heroku.App{Name: "app", Owner: heroku.AppOwner{Id: "team"}}})
+	if saved, _ := db.FindAddonResource("a1"); saved.MovedToOwnerId != "" {
+		t.Errorf("Resource is still flagged: %+v", saved)
+	}
+	// Events for the team it's already flagged for don't flag it again.
+	db.FlagResourceMoved(resource.ProviderId, "new-team")
+	resource, _ = db.FindAddonResource("a1")
+	handleAppEvent(account, resource, heroku.AppWebhookEvent{Action: "update", Resource: "app",
+		Data: heroku.App{Name: "app", Owner: heroku.AppOwner{Id: "new-team"}}})
+	if events := findAudit(t, database.AuditFilter{OwnerId: "team", Action: auditAppTransfer}); len(events) != 1 {
+		t.Errorf("Audit events are %+v", events)
+	}
+}
+
+func TestAppEventForDeletedResource(t *testing.T) {
+	useMemoryStore(t)
+	account, resource := saveTransferResource(t, database.AddonResource{BucketName: "b1"})
+	db.MarkResourceForDeletion(resource.ProviderId)
+	resource, _ = db.FindAddonResource("a1")
+
+	handleAppEvent(account, resource, heroku.AppWebhookEvent{Action: "update", Resource: "app",
+		Data: heroku.App{Name: "renamed", Owner: heroku.AppOwner{Id: "new-team"}}})
+	if saved, _ := db.FindAddonResource("a1"); saved.AppName != "app" || saved.MovedToOwnerId != "" {
+		t.Errorf("A resource being deprovisioned was changed: %+v", saved)
+	}
+}